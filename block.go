@@ -15,6 +15,7 @@ package blackfriday
 
 import (
 	"bytes"
+	"fmt"
 
 	"github.com/shurcooL/sanitized_anchor_name"
 )
@@ -22,19 +23,33 @@ import (
 // Parse block-level data.
 // Note: this function and many that it calls assume that
 // the input buffer ends with a newline.
-func (p *parser) block(out *bytes.Buffer, data []byte) {
+func (p *parser) block(out *Node, data []byte) {
 	if len(data) == 0 || data[len(data)-1] != '\n' {
-		panic("block input is missing terminating newline")
+		p.fail("block input is missing terminating newline")
+		return
 	}
 
 	// this is called recursively: enforce a maximum depth
 	if p.nesting >= p.maxNesting {
+		p.tooDeep(out, data, true)
 		return
 	}
 	p.nesting++
 
-	// parse out one block-level construct at a time
-	for len(data) > 0 {
+	// parse out one block-level construct at a time, crediting the bytes it
+	// consumed as the source of the nodes it added
+	var last *Node
+	var rest []byte
+	for ; len(data) > 0; setSource(out, last, rest[:len(rest)-len(data)]) {
+		last, rest = out.LastChild, data
+		p.checkContext()
+
+		// custom blocks that go before the built-in ones
+		if i := p.customBlock(out, data, true); i > 0 {
+			data = data[i:]
+			continue
+		}
+
 		// prefixed header:
 		//
 		// # Header 1
@@ -51,7 +66,7 @@ func (p *parser) block(out *bytes.Buffer, data []byte) {
 		// <div>
 		//     ...
 		// </div>
-		if data[0] == '<' {
+		if data[0] == '<' || p.flags&EXTENSION_COMMONMARK != 0 {
 			if i := p.html(out, data, true); i > 0 {
 				data = data[i:]
 				continue
@@ -108,6 +123,18 @@ func (p *parser) block(out *bytes.Buffer, data []byte) {
 			}
 		}
 
+		// display math:
+		//
+		// $$
+		// e^{i\pi} + 1 = 0
+		// $$
+		if p.flags&EXTENSION_MATH != 0 {
+			if i := p.mathBlock(out, data); i > 0 {
+				data = data[i:]
+				continue
+			}
+		}
+
 		// horizontal rule:
 		//
 		// ------
@@ -116,7 +143,7 @@ func (p *parser) block(out *bytes.Buffer, data []byte) {
 		// or
 		// ______
 		if p.isHRule(data) {
-			p.r.HRule(out)
+			out.add(HorizontalRule)
 			var i int
 			for i = 0; data[i] != '\n'; i++ {
 			}
@@ -146,13 +173,24 @@ func (p *parser) block(out *bytes.Buffer, data []byte) {
 			}
 		}
 
+		// a list, as CommonMark has it:
+		//
+		// 1) Item 1
+		// 2) Item 2
+		if p.flags&EXTENSION_COMMONMARK != 0 {
+			if width, _ := p.listMarker(data); width > 0 {
+				data = data[p.listCommonMark(out, data):]
+				continue
+			}
+		}
+
 		// an itemized/unordered list:
 		//
 		// * Item 1
 		// * Item 2
 		//
 		// also works with + or -
-		if p.uliPrefix(data) > 0 {
+		if p.flags&EXTENSION_COMMONMARK == 0 && p.uliPrefix(data) > 0 {
 			data = data[p.list(out, data, 0):]
 			continue
 		}
@@ -161,11 +199,17 @@ func (p *parser) block(out *bytes.Buffer, data []byte) {
 		//
 		// 1. Item 1
 		// 2. Item 2
-		if p.oliPrefix(data) > 0 {
+		if p.flags&EXTENSION_COMMONMARK == 0 && p.oliPrefix(data) > 0 {
 			data = data[p.list(out, data, LIST_TYPE_ORDERED):]
 			continue
 		}
 
+		// the rest of the custom blocks
+		if i := p.customBlock(out, data, false); i > 0 {
+			data = data[i:]
+			continue
+		}
+
 		// anything else must look like a normal paragraph
 		// note: this finds underlined headers, too
 		data = data[p.paragraph(out, data):]
@@ -174,30 +218,73 @@ func (p *parser) block(out *bytes.Buffer, data []byte) {
 	p.nesting--
 }
 
+// customBlock tries the parsers added with WithBlockParser that go before
+// the built-in ones, or the ones that go after them.
+func (p *parser) customBlock(out *Node, data []byte, before bool) int {
+	for _, custom := range p.blockParsers {
+		if (custom.Priority > 0) != before || !custom.Starts(data) {
+			continue
+		}
+		i := custom.Parse(p.public, out, data)
+		if i > len(data) {
+			p.fail(fmt.Sprintf("block parser used %d bytes, only %d were left", i, len(data)))
+			return len(data)
+		}
+		if i > 0 {
+			return i
+		}
+	}
+	return 0
+}
+
+// isCustomBlock tells if the line at the start of 'data' begins a custom
+// block.
+func (p *parser) isCustomBlock(data []byte) bool {
+	for _, custom := range p.blockParsers {
+		if custom.Starts(data) {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *parser) isPrefixHeader(data []byte) bool {
-	if data[0] != '#' {
+	i := 0
+	if p.flags&EXTENSION_COMMONMARK != 0 {
+		// CommonMark allows up to three spaces of indentation
+		for i < 3 && data[i] == ' ' {
+			i++
+		}
+	}
+	if data[i] != '#' {
 		return false
 	}
 
 	if p.flags&EXTENSION_SPACE_HEADERS != 0 {
 		level := 0
-		for level < 6 && data[level] == '#' {
+		for level < 6 && data[i+level] == '#' {
 			level++
 		}
-		if data[level] != ' ' {
+		// an empty header is fine with CommonMark
+		end := data[i+level]
+		if end != ' ' && (end != '\n' || p.flags&EXTENSION_COMMONMARK == 0) {
 			return false
 		}
 	}
 	return true
 }
 
-func (p *parser) prefixHeader(out *bytes.Buffer, data []byte) int {
+func (p *parser) prefixHeader(out *Node, data []byte) int {
+	indent := 0
+	for data[indent] == ' ' {
+		indent++
+	}
 	level := 0
-	for level < 6 && data[level] == '#' {
+	for level < 6 && data[indent+level] == '#' {
 		level++
 	}
 	i, end := 0, 0
-	for i = level; data[i] == ' '; i++ {
+	for i = indent + level; data[i] == ' '; i++ {
 	}
 	for end = i; data[end] != '\n'; end++ {
 	}
@@ -220,62 +307,65 @@ func (p *parser) prefixHeader(out *bytes.Buffer, data []byte) int {
 			}
 		}
 	}
-	for end > 0 && data[end-1] == '#' {
-		end--
+	// CommonMark lets spaces follow the closing hashes
+	if p.flags&EXTENSION_COMMONMARK != 0 {
+		for end > i && (data[end-1] == ' ' || data[end-1] == '\t') {
+			end--
+		}
 	}
-	for end > 0 && data[end-1] == ' ' {
+	closing := end
+	for closing > i && data[closing-1] == '#' {
+		closing--
+	}
+	// with CommonMark, the closing hashes must be set apart by a space
+	if p.flags&EXTENSION_COMMONMARK == 0 || closing == i || data[closing-1] == ' ' || data[closing-1] == '\t' {
+		end = closing
+	}
+	for end > i && (data[end-1] == ' ' || data[end-1] == '\t') {
 		end--
 	}
-	if end > i {
+	if end > i || p.flags&EXTENSION_COMMONMARK != 0 {
 		if id == "" && p.flags&EXTENSION_AUTO_HEADER_IDS != 0 {
 			id = sanitized_anchor_name.Create(string(data[i:end]))
 		}
-		work := func() bool {
-			p.inline(out, data[i:end])
-			return true
-		}
-		p.r.Header(out, work, level, id)
+		header := out.add(Header)
+		header.Level = level
+		header.HeaderID = id
+		p.inline(header, data[i:end])
 	}
 	return skip
 }
 
 func (p *parser) isUnderlinedHeader(data []byte) int {
-	// test of level 1 header
-	if data[0] == '=' {
-		i := 1
-		for data[i] == '=' {
-			i++
-		}
-		for data[i] == ' ' {
+	i := 0
+	if p.flags&EXTENSION_COMMONMARK != 0 {
+		// CommonMark allows up to three spaces of indentation
+		for i < 3 && data[i] == ' ' {
 			i++
 		}
-		if data[i] == '\n' {
-			return 1
-		} else {
-			return 0
-		}
 	}
 
-	// test of level 2 header
-	if data[0] == '-' {
-		i := 1
-		for data[i] == '-' {
-			i++
-		}
-		for data[i] == ' ' {
-			i++
-		}
-		if data[i] == '\n' {
-			return 2
-		} else {
-			return 0
-		}
+	// '=' underlines a level 1 header, '-' a level 2 one
+	c := data[i]
+	if c != '=' && c != '-' {
+		return 0
 	}
-
-	return 0
+	for data[i] == c {
+		i++
+	}
+	for data[i] == ' ' {
+		i++
+	}
+	if data[i] != '\n' {
+		return 0
+	}
+	if c == '=' {
+		return 1
+	}
+	return 2
 }
 
-func (p *parser) titleBlock(out *bytes.Buffer, data []byte, doRender bool) int {
+func (p *parser) titleBlock(out *Node, data []byte, doRender bool) int {
 	if data[0] != '%' {
 		return 0
 	}
@@ -289,14 +379,18 @@ func (p *parser) titleBlock(out *bytes.Buffer, data []byte, doRender bool) int {
 	}
 
 	data = bytes.Join(splitData[0:i], []byte("\n"))
-	p.r.TitleBlock(out, data)
+	out.add(TitleBlock).Literal = data
 
 	return len(data)
 }
 
-func (p *parser) html(out *bytes.Buffer, data []byte, doRender bool) int {
+func (p *parser) html(out *Node, data []byte, doRender bool) int {
 	var i, j int
 
+	if p.flags&EXTENSION_COMMONMARK != 0 {
+		return p.htmlCommonMark(out, data, doRender)
+	}
+
 	// identify the opening tag
 	if data[0] != '<' {
 		return 0
@@ -386,14 +480,143 @@ func (p *parser) html(out *bytes.Buffer, data []byte, doRender bool) int {
 		for end > 0 && data[end-1] == '\n' {
 			end--
 		}
-		p.r.BlockHtml(out, data[:end])
+		out.add(HtmlBlock).Literal = data[:end]
+	}
+
+	return i
+}
+
+// These are the tags that start an HTML block that ends with a blank line,
+// according to CommonMark.
+var commonMarkBlockTags = map[string]bool{
+	"address": true, "article": true, "aside": true, "base": true,
+	"basefont": true, "blockquote": true, "body": true, "caption": true,
+	"center": true, "col": true, "colgroup": true, "dd": true,
+	"details": true, "dialog": true, "dir": true, "div": true, "dl": true,
+	"dt": true, "fieldset": true, "figcaption": true, "figure": true,
+	"footer": true, "form": true, "frame": true, "frameset": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"head": true, "header": true, "hr": true, "html": true, "iframe": true,
+	"legend": true, "li": true, "link": true, "main": true, "menu": true,
+	"menuitem": true, "nav": true, "noframes": true, "ol": true,
+	"optgroup": true, "option": true, "p": true, "param": true,
+	"search": true, "section": true, "summary": true, "table": true,
+	"tbody": true, "td": true, "tfoot": true, "th": true, "thead": true,
+	"title": true, "tr": true, "track": true, "ul": true,
+}
+
+// The tags of HTML blocks that hold raw text, which end with the closing tag.
+var commonMarkRawTags = []string{"script", "pre", "style", "textarea"}
+
+// What ends the HTML blocks of each kind that don't end with a blank line.
+var commonMarkHtmlEnds = [...][]string{
+	1: {"</script>", "</pre>", "</style>", "</textarea>"},
+	2: {"-->"},
+	3: {"?>"},
+	4: {">"},
+	5: {"]]>"},
+}
+
+// htmlBlockKind tells which of the seven kinds of HTML block of CommonMark
+// starts at the beginning of 'data', or returns 0 if there is none.
+//
+// The first five end with the line that holds their end marker, the last two
+// with a blank line. Only the last kind can't interrupt a paragraph.
+func (p *parser) htmlBlockKind(data []byte) int {
+	i := 0
+	for i < 3 && data[i] == ' ' {
+		i++
+	}
+	if data[i] != '<' {
+		return 0
+	}
+	line := data[i+1:]
+	line = line[:bytes.IndexByte(line, '\n')+1]
+
+	// the end of a tag name, as far as the first six kinds are concerned
+	endsTag := func(rest []byte) bool {
+		return rest[0] == ' ' || rest[0] == '\n' || rest[0] == '>' ||
+			rest[0] == '/' && rest[1] == '>'
+	}
+
+	for _, tag := range commonMarkRawTags {
+		if len(line) > len(tag) && bytes.EqualFold(line[:len(tag)], []byte(tag)) &&
+			line[len(tag)] != '/' && endsTag(line[len(tag):]) {
+			return 1
+		}
+	}
+	switch {
+	case bytes.HasPrefix(line, []byte("!--")):
+		return 2
+	case line[0] == '?':
+		return 3
+	case bytes.HasPrefix(line, []byte("![CDATA[")):
+		return 5
+	case line[0] == '!' && isletter(line[1]):
+		return 4
+	}
+
+	name := line
+	if name[0] == '/' {
+		name = name[1:]
+	}
+	j := 0
+	for isalnum(name[j]) {
+		j++
+	}
+	if j > 0 && commonMarkBlockTags[string(bytes.ToLower(name[:j]))] && endsTag(name[j:]) {
+		return 6
+	}
+
+	// a whole tag alone on its line
+	if end := elementTagCommonMark(p, data[i:i+len(line)]); end > 0 && p.isEmpty(data[i+end:]) > 0 {
+		return 7
+	}
+	return 0
+}
+
+// htmlCommonMark parses an HTML block by the rules of CommonMark, which take
+// the lines of the block as they are, without looking for a matching
+// closing tag.
+func (p *parser) htmlCommonMark(out *Node, data []byte, doRender bool) int {
+	kind := p.htmlBlockKind(data)
+	if kind == 0 {
+		return 0
+	}
+
+	i := 0
+	for i < len(data) {
+		end := i + bytes.IndexByte(data[i:], '\n') + 1
+		line := data[i:end]
+		if kind >= 6 {
+			if p.isEmpty(line) > 0 {
+				break
+			}
+			i = end
+			continue
+		}
+
+		i = end
+		if kind == 1 {
+			line = bytes.ToLower(line)
+		}
+		found := false
+		for _, marker := range commonMarkHtmlEnds[kind] {
+			found = found || bytes.Contains(line, []byte(marker))
+		}
+		if found {
+			break
+		}
 	}
 
+	if doRender {
+		out.add(HtmlBlock).Literal = bytes.TrimRight(data[:i], "\n")
+	}
 	return i
 }
 
 // HTML comment, lax form
-func (p *parser) htmlComment(out *bytes.Buffer, data []byte, doRender bool) int {
+func (p *parser) htmlComment(out *Node, data []byte, doRender bool) int {
 	if data[0] != '<' || data[1] != '!' || data[2] != '-' || data[3] != '-' {
 		return 0
 	}
@@ -420,7 +643,7 @@ func (p *parser) htmlComment(out *bytes.Buffer, data []byte, doRender bool) int
 			for end > 0 && data[end-1] == '\n' {
 				end--
 			}
-			p.r.BlockHtml(out, data[:end])
+			out.add(HtmlBlock).Literal = data[:end]
 		}
 		return size
 	}
@@ -429,7 +652,7 @@ func (p *parser) htmlComment(out *bytes.Buffer, data []byte, doRender bool) int
 }
 
 // HR, which is the only self-closing block tag considered
-func (p *parser) htmlHr(out *bytes.Buffer, data []byte, doRender bool) int {
+func (p *parser) htmlHr(out *Node, data []byte, doRender bool) int {
 	if data[0] != '<' || (data[1] != 'h' && data[1] != 'H') || (data[2] != 'r' && data[2] != 'R') {
 		return 0
 	}
@@ -453,7 +676,7 @@ func (p *parser) htmlHr(out *bytes.Buffer, data []byte, doRender bool) int {
 				for end > 0 && data[end-1] == '\n' {
 					end--
 				}
-				p.r.BlockHtml(out, data[:end])
+				out.add(HtmlBlock).Literal = data[:end]
 			}
 			return size
 		}
@@ -586,9 +809,12 @@ func (p *parser) isFencedCode(data []byte, syntax **string, oldmarker string) (s
 	}
 	marker = string(data[i-size : i])
 
-	// if this is the end marker, it must match the beginning marker
+	// if this is the end marker, it must match the beginning marker;
+	// CommonMark settles for one of the same char that is at least as long
 	if oldmarker != "" && marker != oldmarker {
-		return
+		if p.flags&EXTENSION_COMMONMARK == 0 || marker[0] != oldmarker[0] || len(marker) < len(oldmarker) {
+			return
+		}
 	}
 
 	if syntax != nil {
@@ -637,7 +863,24 @@ func (p *parser) isFencedCode(data []byte, syntax **string, oldmarker string) (s
 		}
 
 		language := string(data[syntaxStart : syntaxStart+syn])
+		if p.flags&EXTENSION_COMMONMARK != 0 {
+			language = string(unescapeCommonMark(data[syntaxStart : syntaxStart+syn]))
+		}
 		*syntax = &language
+
+		// CommonMark lets the info string go on after the language, but
+		// not with a backtick in it if the fence is made of them
+		if p.flags&EXTENSION_COMMONMARK != 0 {
+			for i < len(data) && data[i] != '\n' {
+				if c == '`' && data[i] == '`' {
+					return
+				}
+				i++
+			}
+			if c == '`' && bytes.IndexByte(data[syntaxStart:i], '`') >= 0 {
+				return
+			}
+		}
 	}
 
 	for i < len(data) && data[i] == ' ' {
@@ -651,18 +894,31 @@ func (p *parser) isFencedCode(data []byte, syntax **string, oldmarker string) (s
 	return
 }
 
-func (p *parser) fencedCode(out *bytes.Buffer, data []byte, doRender bool) int {
+// isFence tells if the line at the start of 'data' opens a fenced code block.
+func (p *parser) isFence(data []byte) bool {
+	var lang *string
+	i, _ := p.isFencedCode(data, &lang, "")
+	return i > 0
+}
+
+func (p *parser) fencedCode(out *Node, data []byte, doRender bool) int {
 	var lang *string
 	beg, marker := p.isFencedCode(data, &lang, "")
-	if beg == 0 || beg >= len(data) {
+	if beg == 0 || beg >= len(data) && p.flags&EXTENSION_COMMONMARK == 0 {
 		return 0
 	}
 
 	var work bytes.Buffer
 
-	for {
-		// safe to assume beg < len(data)
+	// CommonMark takes the indentation of the fence off the code
+	indent := 0
+	if p.flags&EXTENSION_COMMONMARK != 0 {
+		for data[indent] == ' ' {
+			indent++
+		}
+	}
 
+	for beg < len(data) {
 		// check for the end of the code block
 		fenceEnd, _ := p.isFencedCode(data[beg:], nil, marker)
 		if fenceEnd != 0 {
@@ -675,16 +931,23 @@ func (p *parser) fencedCode(out *bytes.Buffer, data []byte, doRender bool) int {
 		for end < len(data) && data[end] != '\n' {
 			end++
 		}
-		end++
+		if end < len(data) {
+			end++
+		}
 
 		// did we reach the end of the buffer without a closing marker?
-		if end >= len(data) {
+		// CommonMark has the code block run to the end of it
+		if end >= len(data) && p.flags&EXTENSION_COMMONMARK == 0 {
 			return 0
 		}
 
 		// verbatim copy to the working buffer
 		if doRender {
-			work.Write(data[beg:end])
+			line := data[beg:end]
+			for i := 0; i < indent && len(line) > 1 && line[0] == ' '; i++ {
+				line = line[1:]
+			}
+			work.Write(line)
 		}
 		beg = end
 	}
@@ -695,20 +958,67 @@ func (p *parser) fencedCode(out *bytes.Buffer, data []byte, doRender bool) int {
 	}
 
 	if doRender {
-		p.r.BlockCode(out, work.Bytes(), syntax)
+		code := out.add(CodeBlock)
+		code.Literal = work.Bytes()
+		code.Lang = syntax
 	}
 
 	return beg
 }
 
-func (p *parser) table(out *bytes.Buffer, data []byte) int {
-	var header bytes.Buffer
-	i, columns := p.tableHeader(&header, data)
+// mathBlock parses a block of display math: TeX between $$ and $$, the
+// closing one at the end of a line. It returns the number of bytes it used,
+// or 0 if there is no such block at the start of 'data'.
+func (p *parser) mathBlock(out *Node, data []byte) int {
+	i := 0
+	for i < 3 && data[i] == ' ' {
+		i++
+	}
+	if i+1 >= len(data) || data[i] != '$' || data[i+1] != '$' {
+		return 0
+	}
+	i += 2
+	beg := i
+
+	// look for the closing dollars, which can't be followed by anything
+	// else, within the paragraph
+	for ; i+1 < len(data); i++ {
+		switch {
+		case data[i] == '\\':
+			i++
+		case data[i] == '\n' && p.isEmpty(data[i+1:]) > 0:
+			return 0
+		case data[i] == '$' && data[i+1] == '$':
+			end := i
+			i += 2
+			for data[i] == ' ' {
+				i++
+			}
+			if data[i] != '\n' {
+				return 0
+			}
+			text := bytes.TrimSpace(data[beg:end])
+			if len(text) == 0 {
+				return 0
+			}
+			out.add(MathBlock).Literal = text
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (p *parser) table(out *Node, data []byte) int {
+	table := NewNode(Table)
+	header := table.add(TableHead)
+	i, columns := p.tableHeader(header, data)
 	if i == 0 {
 		return 0
 	}
+	header.source = data[:i]
 
-	var body bytes.Buffer
+	body := table.add(TableBody)
+	bodyStart := i
 
 	for i < len(data) {
 		pipes, rowStart := 0, i
@@ -725,10 +1035,12 @@ func (p *parser) table(out *bytes.Buffer, data []byte) int {
 
 		// include the newline in data sent to tableRow
 		i++
-		p.tableRow(&body, data[rowStart:i], columns, false)
+		p.tableRow(body, data[rowStart:i], columns, false)
 	}
 
-	p.r.Table(out, header.Bytes(), body.Bytes(), columns)
+	body.source = data[bodyStart:i]
+	table.Columns = columns
+	out.AppendChild(table)
 
 	return i
 }
@@ -742,7 +1054,7 @@ func isBackslashEscaped(data []byte, i int) bool {
 	return backslashes&1 == 1
 }
 
-func (p *parser) tableHeader(out *bytes.Buffer, data []byte) (size int, columns []int) {
+func (p *parser) tableHeader(out *Node, data []byte) (size int, columns []int) {
 	i := 0
 	colCount := 1
 	for i = 0; data[i] != '\n'; i++ {
@@ -847,9 +1159,10 @@ func (p *parser) tableHeader(out *bytes.Buffer, data []byte) (size int, columns
 	return
 }
 
-func (p *parser) tableRow(out *bytes.Buffer, data []byte, columns []int, header bool) {
+func (p *parser) tableRow(out *Node, data []byte, columns []int, header bool) {
 	i, col := 0, 0
-	var rowWork bytes.Buffer
+	row := out.add(TableRow)
+	row.source = data
 
 	if data[i] == '|' && !isBackslashEscaped(data, i) {
 		i++
@@ -875,28 +1188,22 @@ func (p *parser) tableRow(out *bytes.Buffer, data []byte, columns []int, header
 			cellEnd--
 		}
 
-		var cellWork bytes.Buffer
-		p.inline(&cellWork, data[cellStart:cellEnd])
-
-		if header {
-			p.r.TableHeaderCell(&rowWork, cellWork.Bytes(), columns[col])
-		} else {
-			p.r.TableCell(&rowWork, cellWork.Bytes(), columns[col])
-		}
+		cell := row.add(TableCell)
+		cell.Align = columns[col]
+		cell.IsHeader = header
+		cell.source = data[cellStart:cellEnd]
+		p.inline(cell, data[cellStart:cellEnd])
 	}
 
 	// pad it out with empty columns to get the right number
 	for ; col < len(columns); col++ {
-		if header {
-			p.r.TableHeaderCell(&rowWork, nil, columns[col])
-		} else {
-			p.r.TableCell(&rowWork, nil, columns[col])
-		}
+		cell := row.add(TableCell)
+		cell.Align = columns[col]
+		cell.IsHeader = header
+		cell.source = data[len(data):]
 	}
 
 	// silently ignore rows with too many cells
-
-	p.r.TableRow(out, rowWork.Bytes())
 }
 
 // returns blockquote prefix length
@@ -915,8 +1222,12 @@ func (p *parser) quotePrefix(data []byte) int {
 }
 
 // parse a blockquote fragment
-func (p *parser) quote(out *bytes.Buffer, data []byte) int {
-	var raw bytes.Buffer
+func (p *parser) quote(out *Node, data []byte) int {
+	if p.flags&EXTENSION_COMMONMARK != 0 {
+		return p.quoteCommonMark(out, data)
+	}
+
+	raw := sourceBuffer{src: p.sources}
 	beg, end := 0, 0
 	for beg < len(data) {
 		end = beg
@@ -937,16 +1248,105 @@ func (p *parser) quote(out *bytes.Buffer, data []byte) int {
 		}
 
 		// this line is part of the blockquote
-		raw.Write(data[beg:end])
+		raw.copy(data[beg:end])
 		beg = end
 	}
 
-	var cooked bytes.Buffer
-	p.block(&cooked, raw.Bytes())
-	p.r.BlockQuote(out, cooked.Bytes())
+	p.block(out.add(BlockQuote), raw.finish())
 	return end
 }
 
+// parse a blockquote the way CommonMark does: it ends with a blank line, and
+// lines without a prefix only belong to it if they continue a paragraph
+func (p *parser) quoteCommonMark(out *Node, data []byte) int {
+	raw := sourceBuffer{src: p.sources}
+	beg, para := 0, false
+	for beg < len(data) {
+		end := beg
+		for data[end] != '\n' {
+			end++
+		}
+		end++
+
+		line := data[beg:end]
+		if pre := p.quotePrefix(line); pre > 0 {
+			line = line[pre:]
+			para = p.continuesParagraph(line, para)
+		} else if !para || p.interruptsParagraph(line, true) {
+			break
+		}
+
+		// this line is part of the blockquote
+		raw.copy(line)
+		beg = end
+	}
+
+	p.block(out.add(BlockQuote), raw.finish())
+	return beg
+}
+
+// continuesParagraph tells if a paragraph is open after 'line', the content
+// of a line within a block quote or a list item, so that a lazy line without
+// the prefix can continue it. 'para' tells if one was open before it.
+func (p *parser) continuesParagraph(line []byte, para bool) bool {
+	// look into the block quotes and list items the line starts
+	for {
+		if i := p.quotePrefix(line); i > 0 {
+			line, para = line[i:], false
+		} else if width, _ := p.listMarker(line); width > 0 && !p.isHRule(line) {
+			if width >= len(line) {
+				return false
+			}
+			line, para = line[width:], false
+		} else {
+			break
+		}
+	}
+
+	switch {
+	case p.isEmpty(line) > 0, p.isPrefixHeader(line), p.isHRule(line),
+		p.isFence(line), p.htmlBlockKind(line) > 0:
+		return false
+	case p.codePrefix(line) > 0:
+		// indented code can't start within a paragraph
+		return para
+	}
+	return true
+}
+
+// interruptsParagraph tells if the line at the start of 'data' begins a block
+// that ends a paragraph in CommonMark. A lazy line, one that could continue
+// the paragraph of a block quote or a list item without their prefix, can be
+// ended by more than a paragraph can.
+func (p *parser) interruptsParagraph(data []byte, lazy bool) bool {
+	if p.isEmpty(data) > 0 || p.isPrefixHeader(data) || p.isHRule(data) ||
+		p.quotePrefix(data) > 0 || p.isFence(data) {
+		return true
+	}
+	if kind := p.htmlBlockKind(data); kind > 0 && kind < 7 {
+		return true
+	}
+
+	width, delim := p.listMarker(data)
+	switch {
+	case width == 0:
+		return false
+	case lazy:
+		return true
+	case width >= len(data) || p.isEmpty(data[width:]) > 0:
+		// an empty list item can't interrupt a paragraph
+		return false
+	case delim == '.' || delim == ')':
+		// and neither can an ordered list that doesn't start at 1
+		i := 0
+		for data[i] == ' ' {
+			i++
+		}
+		return data[i] == '1' && (data[i+1] == '.' || data[i+1] == ')')
+	}
+	return true
+}
+
 // returns prefix length for block code
 func (p *parser) codePrefix(data []byte) int {
 	if data[0] == ' ' && data[1] == ' ' && data[2] == ' ' && data[3] == ' ' {
@@ -955,10 +1355,10 @@ func (p *parser) codePrefix(data []byte) int {
 	return 0
 }
 
-func (p *parser) code(out *bytes.Buffer, data []byte) int {
+func (p *parser) code(out *Node, data []byte) int {
 	var work bytes.Buffer
 
-	i := 0
+	i, last := 0, 0
 	for i < len(data) {
 		beg := i
 		for data[i] != '\n' {
@@ -967,7 +1367,8 @@ func (p *parser) code(out *bytes.Buffer, data []byte) int {
 		i++
 
 		blankline := p.isEmpty(data[beg:i]) > 0
-		if pre := p.codePrefix(data[beg:i]); pre > 0 {
+		pre := p.codePrefix(data[beg:i])
+		if pre > 0 {
 			beg += pre
 		} else if !blankline {
 			// non-empty, non-prefixed line breaks the pre
@@ -975,27 +1376,22 @@ func (p *parser) code(out *bytes.Buffer, data []byte) int {
 			break
 		}
 
-		// verbatim copy to the working buffeu
-		if blankline {
+		// verbatim copy to the working buffer; CommonMark keeps what is
+		// past the indentation of a blank line, too
+		if blankline && (pre == 0 || p.flags&EXTENSION_COMMONMARK == 0) {
 			work.WriteByte('\n')
 		} else {
 			work.Write(data[beg:i])
 		}
+		if !blankline {
+			last = work.Len()
+		}
 	}
 
-	// trim all the \n off the end of work
-	workbytes := work.Bytes()
-	eol := len(workbytes)
-	for eol > 0 && workbytes[eol-1] == '\n' {
-		eol--
-	}
-	if eol != len(workbytes) {
-		work.Truncate(eol)
-	}
-
-	work.WriteByte('\n')
+	// trim the blank lines off the end of work
+	work.Truncate(last)
 
-	p.r.BlockCode(out, work.Bytes(), "")
+	out.add(CodeBlock).Literal = work.Bytes()
 
 	return i
 }
@@ -1040,29 +1436,27 @@ func (p *parser) oliPrefix(data []byte) int {
 }
 
 // parse ordered or unordered list block
-func (p *parser) list(out *bytes.Buffer, data []byte, flags int) int {
+func (p *parser) list(out *Node, data []byte, flags int) int {
 	i := 0
 	flags |= LIST_ITEM_BEGINNING_OF_LIST
-	work := func() bool {
-		for i < len(data) {
-			skip := p.listItem(out, data[i:], &flags)
-			i += skip
+	list := out.add(List)
+	list.ListFlags = flags
+	for i < len(data) {
+		skip := p.listItem(list, data[i:], &flags)
+		i += skip
 
-			if skip == 0 || flags&LIST_ITEM_END_OF_LIST != 0 {
-				break
-			}
-			flags &= ^LIST_ITEM_BEGINNING_OF_LIST
+		if skip == 0 || flags&LIST_ITEM_END_OF_LIST != 0 {
+			break
 		}
-		return true
+		flags &= ^LIST_ITEM_BEGINNING_OF_LIST
 	}
 
-	p.r.List(out, work, flags)
 	return i
 }
 
 // Parse a single list item.
 // Assumes initial prefix is already removed if this is a sublist.
-func (p *parser) listItem(out *bytes.Buffer, data []byte, flags *int) int {
+func (p *parser) listItem(out *Node, data []byte, flags *int) int {
 	// keep track of the indentation of the first line
 	itemIndent := 0
 	for itemIndent < 3 && data[itemIndent] == ' ' {
@@ -1082,6 +1476,14 @@ func (p *parser) listItem(out *bytes.Buffer, data []byte, flags *int) int {
 		i++
 	}
 
+	// the checkbox of a task goes into the flags of this item only
+	task := 0
+	if p.flags&EXTENSION_TASK_LISTS != 0 {
+		var n int
+		n, task = taskMarker(data[i:])
+		i += n
+	}
+
 	// find the end of the line
 	line := i
 	for data[i-1] != '\n' {
@@ -1089,10 +1491,10 @@ func (p *parser) listItem(out *bytes.Buffer, data []byte, flags *int) int {
 	}
 
 	// get working buffer
-	var raw bytes.Buffer
+	raw := sourceBuffer{src: p.sources}
 
 	// put the first line into the working buffer
-	raw.Write(data[line:i])
+	raw.copy(data[line:i])
 	line = i
 
 	// process the following lines
@@ -1164,7 +1566,7 @@ gatherlines:
 
 		// a blank line means this should be parsed as a block
 		case containsBlankLine:
-			raw.WriteByte('\n')
+			raw.fill('\n', 1, data[line:])
 			*flags |= LIST_ITEM_CONTAINS_BLOCK
 		}
 
@@ -1172,52 +1574,546 @@ gatherlines:
 		// re-introduce the blank into the buffer
 		if containsBlankLine {
 			containsBlankLine = false
-			raw.WriteByte('\n')
+			raw.fill('\n', 1, data[line:])
 		}
 
 		// add the line into the working buffer without prefix
-		raw.Write(data[line+indent : i])
+		raw.copy(data[line+indent : i])
 
 		line = i
 	}
 
-	rawBytes := raw.Bytes()
+	rawBytes := raw.finish()
 
-	// render the contents of the list item
-	var cooked bytes.Buffer
+	// parse the contents of the list item
+	item := out.add(Item)
+	item.source = data[:line]
 	if *flags&LIST_ITEM_CONTAINS_BLOCK != 0 {
-		// intermediate render of block li
+		// block li
 		if sublist > 0 {
-			p.block(&cooked, rawBytes[:sublist])
-			p.block(&cooked, rawBytes[sublist:])
+			p.block(item, rawBytes[:sublist])
+			p.block(item, rawBytes[sublist:])
 		} else {
-			p.block(&cooked, rawBytes)
+			p.block(item, rawBytes)
 		}
 	} else {
-		// intermediate render of inline li
+		// inline li
 		if sublist > 0 {
-			p.inline(&cooked, rawBytes[:sublist])
-			p.block(&cooked, rawBytes[sublist:])
+			p.inline(item, rawBytes[:sublist])
+			p.block(item, rawBytes[sublist:])
 		} else {
-			p.inline(&cooked, rawBytes)
+			p.inline(item, rawBytes)
 		}
 	}
+	item.ListFlags = *flags | task
 
-	// render the actual list item
-	cookedBytes := cooked.Bytes()
-	parsedEnd := len(cookedBytes)
+	return line
+}
 
-	// strip trailing newlines
-	for parsedEnd > 0 && cookedBytes[parsedEnd-1] == '\n' {
-		parsedEnd--
+// taskMarker looks for the checkbox of a task list item, "[ ]" or "[x]"
+// followed by a space, at the start of the text of an item. It returns the
+// number of bytes it takes up with the spaces after it, and the
+// LIST_ITEM_TASK and LIST_ITEM_CHECKED flags for it.
+func taskMarker(data []byte) (int, int) {
+	if len(data) < 4 || data[0] != '[' || data[2] != ']' || data[3] != ' ' {
+		return 0, 0
+	}
+	flags := LIST_ITEM_TASK
+	switch data[1] {
+	case ' ':
+	case 'x', 'X':
+		flags |= LIST_ITEM_CHECKED
+	default:
+		return 0, 0
 	}
-	p.r.ListItem(out, cookedBytes[:parsedEnd], *flags)
 
-	return line
+	// a checkbox with nothing after it is just text
+	i := 3
+	for i < len(data) && data[i] == ' ' {
+		i++
+	}
+	if i >= len(data) || data[i] == '\n' {
+		return 0, 0
+	}
+	return i, flags
+}
+
+// listMarker finds a list item marker at the start of 'data' by the rules of
+// CommonMark: a bullet, or up to nine digits followed by '.' or ')'. It
+// returns the column the content of the item starts at, which is also how
+// deep the lines after the first have to be indented to belong to the item,
+// and the char that ends the marker. The width is 0 if there is no marker.
+//
+// The content starts right after the spaces that follow the marker, unless
+// there are more than four of them, when the content is indented code and
+// starts after one space, or none, when the width counts the newline.
+func (p *parser) listMarker(data []byte) (int, byte) {
+	i := 0
+	for i < 3 && i < len(data) && data[i] == ' ' {
+		i++
+	}
+	if i >= len(data) {
+		return 0, 0
+	}
+
+	var delim byte
+	switch c := data[i]; {
+	case c == '*' || c == '+' || c == '-':
+		delim = c
+	case c >= '0' && c <= '9':
+		start := i
+		for i-start < 9 && i < len(data) && data[i] >= '0' && data[i] <= '9' {
+			i++
+		}
+		if i >= len(data) || data[i] != '.' && data[i] != ')' {
+			return 0, 0
+		}
+		delim = data[i]
+	default:
+		return 0, 0
+	}
+	i++
+
+	spaces := 0
+	for i+spaces < len(data) && data[i+spaces] == ' ' {
+		spaces++
+	}
+	switch {
+	case i+spaces >= len(data):
+		return 0, 0
+	case data[i+spaces] == '\n', spaces > 4:
+		return i + 1, delim
+	case spaces == 0:
+		return 0, 0
+	}
+	return i + spaces, delim
+}
+
+// parse a list the way CommonMark does: the items go on for as long as their
+// markers end with the same char, and if any of them are set apart by a blank
+// line, or have one between the blocks they hold, all the items of the list
+// hold paragraphs
+func (p *parser) listCommonMark(out *Node, data []byte) int {
+	_, delim := p.listMarker(data)
+	flags := LIST_ITEM_BEGINNING_OF_LIST
+	if delim == '.' || delim == ')' {
+		flags |= LIST_TYPE_ORDERED
+	}
+	list := out.add(List)
+	list.ListFlags = flags
+
+	// an ordered list starts at the number of its first item
+	if flags&LIST_TYPE_ORDERED != 0 {
+		start := 0
+		for _, c := range bytes.TrimLeft(data, " ") {
+			if !isdigit(c) {
+				break
+			}
+			start = start*10 + int(c-'0')
+		}
+		if start != 1 {
+			list.ListFlags |= LIST_START
+			list.ListStart = start
+		}
+	}
+
+	i, loose := 0, false
+	for i < len(data) {
+		width, d := p.listMarker(data[i:])
+		if width == 0 || d != delim || p.isHRule(data[i:]) {
+			break
+		}
+		size, blankWithin := p.listItemCommonMark(list, data[i:], width, flags)
+		flags &^= LIST_ITEM_BEGINNING_OF_LIST
+		loose = loose || blankWithin
+		i += size
+
+		// the list goes on past blank lines if there is another item
+		// after them
+		j := i
+		for j < len(data) && p.isEmpty(data[j:]) > 0 {
+			j += p.isEmpty(data[j:])
+		}
+		if j == len(data) {
+			break
+		}
+		if width, d := p.listMarker(data[j:]); width == 0 || d != delim || p.isHRule(data[j:]) {
+			break
+		}
+		loose = loose || j > i
+		i = j
+	}
+
+	for item := list.FirstChild; item != nil; item = item.Next {
+		if loose {
+			item.ListFlags |= LIST_ITEM_CONTAINS_BLOCK
+			continue
+		}
+
+		// the paragraphs of a tight list are left out, keeping their text
+		for child := item.FirstChild; child != nil; {
+			next := child.Next
+			if child.Type == Paragraph {
+				for child.FirstChild != nil {
+					child.InsertBefore(child.FirstChild)
+				}
+				child.Unlink()
+			}
+			child = next
+		}
+	}
+
+	return i
+}
+
+// Parse a single list item by the rules of CommonMark. 'width' is the column
+// the content of the item starts at. It returns the bytes the item used,
+// which don't include the blank lines after it, and tells if there is a blank
+// line between two of the blocks within it.
+func (p *parser) listItemCommonMark(out *Node, data []byte, width int, flags int) (int, bool) {
+	// find the end of the first line
+	line := 0
+	for data[line] != '\n' {
+		line++
+	}
+	line++
+
+	// put the content of the first line into the working buffer, after the
+	// checkbox of a task
+	raw := sourceBuffer{src: p.sources}
+	empty := width >= line || p.isEmpty(data[width:line]) > 0
+	first := width
+	if !empty && p.flags&EXTENSION_TASK_LISTS != 0 {
+		n, task := taskMarker(data[width:line])
+		first += n
+		flags |= task
+	}
+	if !empty {
+		raw.copy(data[first:line])
+	}
+
+	size := line
+	blanks := 0
+	blankWithin := false
+	para := !empty && p.continuesParagraph(data[first:line], false)
+	fence := ""
+
+	// the width of the marker of a list nested in the item, if any: lines
+	// indented that much after a blank line belong to the nested list
+	sub := 0
+	if !empty {
+		sub, _ = p.listMarker(data[first:line])
+		var lang *string
+		if i, marker := p.isFencedCode(data[first:line], &lang, ""); i > 0 {
+			fence = marker
+		}
+	}
+
+	for line < len(data) {
+		end := line
+		for data[end] != '\n' {
+			end++
+		}
+		end++
+		chunk := data[line:end]
+
+		// blank lines are only part of the item if something follows them,
+		// and an item can start with one blank line at most
+		if p.isEmpty(chunk) > 0 {
+			if raw.Len() == 0 {
+				break
+			}
+			blanks++
+			para = false
+			line = end
+			continue
+		}
+
+		indent := 0
+		for indent < width && chunk[indent] == ' ' {
+			indent++
+		}
+
+		switch {
+		case indent == width:
+			chunk = chunk[width:]
+
+			// a blank line before a block of the item itself, as opposed
+			// to one of a nested list, makes the list loose
+			nested := 0
+			for nested < sub && chunk[nested] == ' ' {
+				nested++
+			}
+			marker, _ := p.listMarker(chunk)
+			if blanks > 0 && fence == "" && (sub == 0 || nested < sub && marker == 0) {
+				blankWithin = true
+			}
+			if chunk[0] != ' ' {
+				sub = marker
+			}
+
+		case blanks == 0 && para && !p.interruptsParagraph(chunk, true):
+			// a lazy continuation of the paragraph
+
+		default:
+			return p.finishItemCommonMark(out, data[:size], &raw, flags), blankWithin
+		}
+
+		for ; blanks > 0; blanks-- {
+			raw.fill('\n', 1, chunk)
+		}
+		raw.copy(chunk)
+
+		// keep track of fenced code, where blank lines don't count
+		if fence == "" {
+			var lang *string
+			if i, marker := p.isFencedCode(chunk, &lang, ""); i > 0 {
+				fence = marker
+			}
+		} else if i, _ := p.isFencedCode(chunk, nil, fence); i > 0 {
+			fence = ""
+		}
+		para = fence == "" && p.continuesParagraph(chunk, para)
+
+		line = end
+		size = end
+	}
+
+	return p.finishItemCommonMark(out, data[:size], &raw, flags), blankWithin
+}
+
+// finishItemCommonMark parses the content gathered for a list item.
+func (p *parser) finishItemCommonMark(out *Node, data []byte, raw *sourceBuffer, flags int) int {
+	rawBytes := raw.finish()
+	item := out.add(Item)
+	item.source = data
+	item.ListFlags = flags
+	if len(rawBytes) > 0 {
+		p.block(item, rawBytes)
+	}
+	return len(data)
+}
+
+// returns the length of the prefix of a definition in a definition list,
+// a ':' followed by spaces, or 0 if 'data' does not start with one
+func (p *parser) definitionPrefix(data []byte) int {
+	i := 0
+
+	// start with up to 3 spaces
+	for i < 3 && i < len(data) && data[i] == ' ' {
+		i++
+	}
+
+	// need a : followed by a space
+	if i+1 >= len(data) || data[i] != ':' || data[i+1] != ' ' {
+		return 0
+	}
+	i++
+	for i < len(data) && data[i] == ' ' {
+		i++
+	}
+	return i
+}
+
+// isDefinitionTerm tells if the line at the start of 'data' can be a term of
+// a definition list: some text that does not start another block.
+func (p *parser) isDefinitionTerm(data []byte) bool {
+	indent := 0
+	for indent < len(data) && data[indent] == ' ' {
+		indent++
+	}
+	return indent < 4 && p.isEmpty(data) == 0 && data[indent] != '<' &&
+		!p.isPrefixHeader(data) && !p.isHRule(data) && !p.isFence(data) &&
+		p.quotePrefix(data) == 0 && p.uliPrefix(data) == 0 && p.oliPrefix(data) == 0
+}
+
+// definitionTerms returns the length of the lines of terms at the start of
+// 'data' if a definition follows them, maybe after some blank lines, or 0 if
+// none does.
+func (p *parser) definitionTerms(data []byte) int {
+	if i, defined := p.termLines(data); defined {
+		return i
+	}
+	return 0
+}
+
+// termLines returns the length of the lines that can be terms at the start of
+// 'data', and whether a definition follows them, maybe after some blank lines.
+func (p *parser) termLines(data []byte) (int, bool) {
+	i := 0
+	for i < len(data) && p.isDefinitionTerm(data[i:]) && p.definitionPrefix(data[i:]) == 0 {
+		for data[i] != '\n' {
+			i++
+		}
+		i++
+	}
+	if i == 0 {
+		return 0, false
+	}
+
+	j := i
+	for j < len(data) && p.isEmpty(data[j:]) > 0 {
+		j += p.isEmpty(data[j:])
+	}
+	return i, j < len(data) && p.definitionPrefix(data[j:]) > 0
+}
+
+// Parse a definition list. The first 'terms' bytes of 'data' hold the lines of
+// its first terms, one per line; the definitions come after them, maybe after
+// some blank lines.
+//
+// Apple
+// :   Pomaceous fruit of plants of the genus Malus.
+//
+// Orange
+// :   The fruit of an evergreen tree of the genus Citrus.
+func (p *parser) definitionList(out *Node, data []byte, terms int) int {
+	list := out.add(List)
+	list.ListFlags = LIST_TYPE_DEFINITION
+
+	i := 0
+	for {
+		// every line is a term of its own
+		for i < terms {
+			end := i
+			for data[end] != '\n' {
+				end++
+			}
+			beg := i
+			for data[beg] == ' ' {
+				beg++
+			}
+			eol := end
+			for eol > beg && data[eol-1] == ' ' {
+				eol--
+			}
+			term := list.add(Item)
+			term.ListFlags = LIST_TYPE_DEFINITION | LIST_TYPE_TERM
+			term.source = data[beg:eol]
+			p.inline(term, data[beg:eol])
+			i = end + 1
+		}
+
+		// then come the definitions, each of them a block if there is a
+		// blank line before it
+		for {
+			j := i
+			for j < len(data) && p.isEmpty(data[j:]) > 0 {
+				j += p.isEmpty(data[j:])
+			}
+			if j >= len(data) || p.definitionPrefix(data[j:]) == 0 {
+				break
+			}
+			i = j + p.definition(list, data[j:], j > i)
+		}
+
+		// and another group of terms may go on with the list
+		j := i
+		for j < len(data) && p.isEmpty(data[j:]) > 0 {
+			j += p.isEmpty(data[j:])
+		}
+		if j >= len(data) {
+			return i
+		}
+		if terms = p.definitionTerms(data[j:]); terms == 0 {
+			return i
+		}
+		i, terms = j, j+terms
+	}
+}
+
+// Parse a single definition of a definition list. The lines after the first
+// one belong to it as long as they are indented, or continue its paragraph,
+// and after a blank line only if they are indented by 4 spaces.
+func (p *parser) definition(out *Node, data []byte, block bool) int {
+	i := p.definitionPrefix(data)
+
+	// find the end of the first line
+	line := i
+	for data[i] != '\n' {
+		i++
+	}
+	i++
+
+	// get working buffer
+	raw := sourceBuffer{src: p.sources}
+
+	// put the first line into the working buffer
+	raw.copy(data[line:i])
+	line = i
+	end := i
+
+	// the lines before 'undefined' are terms that no definition follows,
+	// which every line of them would find again when looked up one by one
+	undefined := 0
+
+	containsBlankLine := false
+	for line < len(data) {
+		// find the end of this line
+		for data[i] != '\n' {
+			i++
+		}
+		i++
+
+		// blank lines go into the definition if something follows them
+		if p.isEmpty(data[line:i]) > 0 {
+			containsBlankLine = true
+			line = i
+			continue
+		}
+
+		// calculate the indentation
+		indent := 0
+		for indent < 4 && line+indent < i && data[line+indent] == ' ' {
+			indent++
+		}
+
+		// after a blank line, only indented lines are part of it; before
+		// one, the next definition, a term followed by one, or a block
+		// that cannot continue the paragraph ends it
+		if indent < 4 && (containsBlankLine || !p.isDefinitionTerm(data[line:]) ||
+			p.definitionPrefix(data[line:]) > 0) {
+			break
+		}
+		if indent < 4 && line >= undefined {
+			n, defined := p.termLines(data[line:])
+			if defined {
+				break
+			}
+			undefined = line + n
+		}
+
+		// if this line was preceeded by one or more blanks,
+		// re-introduce the blank into the buffer
+		if containsBlankLine {
+			containsBlankLine = false
+			raw.fill('\n', 1, data[line:])
+			block = true
+		}
+
+		// add the line into the working buffer without prefix
+		raw.copy(data[line+indent : i])
+		line, end = i, i
+	}
+
+	rawBytes := raw.finish()
+
+	// parse the contents of the definition
+	item := out.add(Item)
+	item.source = data[:end]
+	item.ListFlags = LIST_TYPE_DEFINITION
+	if block {
+		item.ListFlags |= LIST_ITEM_CONTAINS_BLOCK
+		p.block(item, rawBytes)
+	} else {
+		p.inline(item, rawBytes)
+	}
+
+	return end
 }
 
 // render a single paragraph that has already been parsed out
-func (p *parser) renderParagraph(out *bytes.Buffer, data []byte) {
+func (p *parser) renderParagraph(out *Node, data []byte) {
 	if len(data) == 0 {
 		return
 	}
@@ -1231,19 +2127,17 @@ func (p *parser) renderParagraph(out *bytes.Buffer, data []byte) {
 	// trim trailing newline
 	end := len(data) - 1
 
-	// trim trailing spaces
-	for end > beg && data[end-1] == ' ' {
+	// trim trailing spaces, and the tabs CommonMark leaves in
+	for end > beg && (data[end-1] == ' ' || data[end-1] == '\t') {
 		end--
 	}
 
-	work := func() bool {
-		p.inline(out, data[beg:end])
-		return true
-	}
-	p.r.Paragraph(out, work)
+	paragraph := out.add(Paragraph)
+	paragraph.source = data[beg:end]
+	p.inline(paragraph, data[beg:end])
 }
 
-func (p *parser) paragraph(out *bytes.Buffer, data []byte) int {
+func (p *parser) paragraph(out *Node, data []byte) int {
 	// prev: index of 1st char of previous line
 	// line: index of 1st char of current line
 	// i: index of cursor/end of current line
@@ -1258,15 +2152,38 @@ func (p *parser) paragraph(out *bytes.Buffer, data []byte) int {
 
 		// did we find a blank line marking the end of the paragraph?
 		if n := p.isEmpty(current); n > 0 {
+			// with definition lists, the paragraph may have been the terms
+			// of a definition after the blank lines
+			if p.flags&EXTENSION_DEFINITION_LISTS != 0 {
+				j := i + n
+				for j < len(data) && p.isEmpty(data[j:]) > 0 {
+					j += p.isEmpty(data[j:])
+				}
+				if j < len(data) && p.definitionPrefix(data[j:]) > 0 {
+					return p.definitionList(out, data, i)
+				}
+			}
+
 			p.renderParagraph(out, data[:i])
 			return i + n
 		}
 
+		// a definition after some text makes the lines of text its terms
+		if p.flags&EXTENSION_DEFINITION_LISTS != 0 && i > 0 && p.definitionPrefix(current) > 0 {
+			return p.definitionList(out, data, i)
+		}
+
 		// an underline under some text marks a header, so our paragraph ended on prev line
 		if i > 0 {
 			if level := p.isUnderlinedHeader(current); level > 0 {
+				// with CommonMark, the whole paragraph is the header
+				if p.flags&EXTENSION_COMMONMARK != 0 {
+					prev = 0
+				}
+
 				// render the paragraph
 				p.renderParagraph(out, data[:prev])
+				start := prev
 
 				// ignore leading and trailing whitespace
 				eol := i - 1
@@ -1278,25 +2195,18 @@ func (p *parser) paragraph(out *bytes.Buffer, data []byte) int {
 				}
 
 				// render the header
-				// this ugly double closure avoids forcing variables onto the heap
-				work := func(o *bytes.Buffer, pp *parser, d []byte) func() bool {
-					return func() bool {
-						pp.inline(o, d)
-						return true
-					}
-				}(out, p, data[prev:eol])
-
-				id := ""
+				header := out.add(Header)
+				header.Level = level
 				if p.flags&EXTENSION_AUTO_HEADER_IDS != 0 {
-					id = sanitized_anchor_name.Create(string(data[prev:eol]))
+					header.HeaderID = sanitized_anchor_name.Create(string(data[prev:eol]))
 				}
-
-				p.r.Header(out, work, level, id)
+				p.inline(header, data[prev:eol])
 
 				// find the end of the underline
 				for data[i] != '\n' {
 					i++
 				}
+				header.source = data[start:i]
 				return i
 			}
 		}
@@ -1310,8 +2220,15 @@ func (p *parser) paragraph(out *bytes.Buffer, data []byte) int {
 			}
 		}
 
-		// if there's a prefixed header or a horizontal rule after this, paragraph is over
-		if p.isPrefixHeader(current) || p.isHRule(current) {
+		// if there's a prefixed header, a horizontal rule or a custom block
+		// after this, paragraph is over
+		if p.isPrefixHeader(current) || p.isHRule(current) || i > 0 && p.isCustomBlock(current) {
+			p.renderParagraph(out, data[:i])
+			return i
+		}
+
+		// CommonMark lets most other blocks end a paragraph, too
+		if p.flags&EXTENSION_COMMONMARK != 0 && i > 0 && p.interruptsParagraph(current, false) {
 			p.renderParagraph(out, data[:i])
 			return i
 		}
@@ -14,15 +14,16 @@
 package blackfriday
 
 import (
+	"bytes"
 	"testing"
 )
 
-func runMarkdownBlockWithRenderer(input string, extensions int, renderer Renderer) string {
-	return string(Markdown([]byte(input), renderer, extensions))
+func runMarkdownBlockWithRenderer(input string, extensions Extensions, renderer Renderer) string {
+	return string(Markdown([]byte(input), WithRenderer(renderer), WithExtensions(extensions)))
 }
 
-func runMarkdownBlock(input string, extensions int) string {
-	htmlFlags := 0
+func runMarkdownBlock(input string, extensions Extensions) string {
+	var htmlFlags HtmlFlags
 	htmlFlags |= HTML_USE_XHTML
 
 	renderer := HtmlRenderer(htmlFlags, "", "")
@@ -30,9 +31,9 @@ func runMarkdownBlock(input string, extensions int) string {
 	return runMarkdownBlockWithRenderer(input, extensions, renderer)
 }
 
-func runnerWithRendererParameters(parameters HtmlRendererParameters) func(string, int) string {
-	return func(input string, extensions int) string {
-		htmlFlags := 0
+func runnerWithRendererParameters(parameters HtmlRendererParameters) func(string, Extensions) string {
+	return func(input string, extensions Extensions) string {
+		var htmlFlags HtmlFlags
 		htmlFlags |= HTML_USE_XHTML
 
 		renderer := HtmlRendererWithParameters(htmlFlags, "", "", parameters)
@@ -41,11 +42,11 @@ func runnerWithRendererParameters(parameters HtmlRendererParameters) func(string
 	}
 }
 
-func doTestsBlock(t *testing.T, tests []string, extensions int) {
+func doTestsBlock(t *testing.T, tests []string, extensions Extensions) {
 	doTestsBlockWithRunner(t, tests, extensions, runMarkdownBlock)
 }
 
-func doTestsBlockWithRunner(t *testing.T, tests []string, extensions int, runner func(string, int) string) {
+func doTestsBlockWithRunner(t *testing.T, tests []string, extensions Extensions, runner func(string, Extensions) string) {
 	// catch and report panics
 	var candidate string
 	defer func() {
@@ -1294,3 +1295,254 @@ func TestTitleBlock_EXTENSION_TITLEBLOCK(t *testing.T) {
 	doTestsBlock(t, tests, EXTENSION_TITLEBLOCK)
 
 }
+
+func TestTaskList_EXTENSION_TASK_LISTS(t *testing.T) {
+	var tests = []string{
+		"* [ ] todo\n* [x] done\n* [X] done too\n* plain\n",
+		"<ul>\n<li><input type=\"checkbox\" disabled=\"\" /> todo</li>\n" +
+			"<li><input type=\"checkbox\" disabled=\"\" checked=\"\" /> done</li>\n" +
+			"<li><input type=\"checkbox\" disabled=\"\" checked=\"\" /> done too</li>\n" +
+			"<li>plain</li>\n</ul>\n",
+
+		"1. [x] first\n\n    more\n\n2. [ ] second\n",
+		"<ol>\n<li><input type=\"checkbox\" disabled=\"\" checked=\"\" /> <p>first</p>\n\n<p>more</p></li>\n\n" +
+			"<li><input type=\"checkbox\" disabled=\"\" /> <p>second</p></li>\n</ol>\n",
+
+		// not a checkbox
+		"* [ ]\n* [y] no\n* [ ]no\n* \\[ ] no\n",
+		"<ul>\n<li>[ ]</li>\n<li>[y] no</li>\n<li>[ ]no</li>\n<li>[ ] no</li>\n</ul>\n",
+
+		// only at the start of an item
+		"[ ] not in a list\n\n* a [ ] b\n",
+		"<p>[ ] not in a list</p>\n\n<ul>\n<li>a [ ] b</li>\n</ul>\n",
+	}
+	doTestsBlock(t, tests, EXTENSION_TASK_LISTS)
+
+	tests = []string{
+		"- [ ] todo\n- [x] done\n",
+		"<ul>\n<li><input type=\"checkbox\" disabled=\"\" /> todo</li>\n" +
+			"<li><input type=\"checkbox\" disabled=\"\" checked=\"\" /> done</li>\n</ul>\n",
+	}
+	doTestsBlock(t, tests, EXTENSION_TASK_LISTS|EXTENSION_COMMONMARK)
+
+	// without the extension, the brackets are text
+	doTestsBlock(t, []string{
+		"* [ ] todo\n",
+		"<ul>\n<li>[ ] todo</li>\n</ul>\n",
+	}, 0)
+}
+
+func TestDefinitionList_EXTENSION_DEFINITION_LISTS(t *testing.T) {
+	var tests = []string{
+		"Apple\n:   Pomaceous fruit\n    of Malus.\n",
+		"<dl>\n<dt>Apple</dt>\n<dd>Pomaceous fruit\nof Malus.</dd>\n</dl>\n",
+
+		// several terms and definitions, and the next entry of the list
+		"Orange\nCitrus\n: The fruit.\n: A color.\n\n*Lemon*\n: Sour.\n",
+		"<dl>\n<dt>Orange</dt>\n<dt>Citrus</dt>\n<dd>The fruit.</dd>\n<dd>A color.</dd>\n" +
+			"<dt><em>Lemon</em></dt>\n<dd>Sour.</dd>\n</dl>\n",
+
+		// a blank line before a definition makes it a block
+		"Term\n\n:   First paragraph.\n\n    Second paragraph.\n\n        code\n\nAfter.\n",
+		"<dl>\n<dt>Term</dt>\n\n<dd><p>First paragraph.</p>\n\n<p>Second paragraph.</p>\n\n" +
+			"<pre><code>code\n</code></pre></dd>\n</dl>\n\n<p>After.</p>\n",
+
+		"Term\n:   def\n\n    * a\n    * b\n",
+		"<dl>\n<dt>Term</dt>\n\n<dd><p>def</p>\n\n<ul>\n<li>a</li>\n<li>b</li>\n</ul></dd>\n</dl>\n",
+
+		// only the paragraph right before the definition holds its terms
+		"a\nb\n\nc\n: d\n\nnot indented\n",
+		"<p>a\nb</p>\n\n<dl>\n<dt>c</dt>\n<dd>d</dd>\n</dl>\n\n<p>not indented</p>\n",
+
+		"Term\n: def\n* list\n",
+		"<dl>\n<dt>Term</dt>\n<dd>def</dd>\n</dl>\n\n<ul>\n<li>list</li>\n</ul>\n",
+
+		// not a definition
+		": alone\n\nTerm\n:no space\n",
+		"<p>: alone</p>\n\n<p>Term\n:no space</p>\n",
+	}
+	doTestsBlock(t, tests, EXTENSION_DEFINITION_LISTS)
+
+	// without the extension, it is a paragraph
+	doTestsBlock(t, []string{
+		"Term\n: def\n",
+		"<p>Term\n: def</p>\n",
+	}, 0)
+}
+
+func TestMathBlock_EXTENSION_MATH(t *testing.T) {
+	var tests = []string{
+		"$$\ne^{i\\pi} + 1 = 0\n$$\n",
+		"<p><span class=\"math display\">\\[e^{i\\pi} + 1 = 0\\]</span></p>\n",
+
+		"Text\n\n  $$ a_1 < a_2 $$  \nafter\n",
+		"<p>Text</p>\n\n<p><span class=\"math display\">\\[a_1 &lt; a_2\\]</span></p>\n\n<p>after</p>\n",
+
+		// not a block
+		"$$ a $$ b\n\n$$\na\n\n$$\n",
+		"<p><span class=\"math display\">\\[a\\]</span> b</p>\n\n<p>$$\na</p>\n\n<p>$$</p>\n",
+	}
+	doTestsBlock(t, tests, EXTENSION_MATH)
+
+	// without the extension, it is text
+	doTestsBlock(t, []string{
+		"$$\na_1\n$$\n",
+		"<p>$$\na_1\n$$</p>\n",
+	}, 0)
+}
+
+func TestTabs_EXTENSION_COMMONMARK(t *testing.T) {
+	var tests = []string{
+		"\tfoo\tbar\n\t\t\n\tbaz\n",
+		"<pre><code>foo\tbar\n    \nbaz\n</code></pre>\n",
+
+		"-\tfoo\tbar\n",
+		"<ul>\n<li>foo\tbar</li>\n</ul>\n",
+
+		"foo\t\nbar\t\n",
+		"<p>foo\nbar</p>\n",
+
+		"# foo\t#\t\n",
+		"<h1>foo</h1>\n",
+	}
+	doTestsBlock(t, tests, EXTENSION_COMMONMARK)
+
+	// without it, tabs are expanded everywhere
+	doTestsBlock(t, []string{
+		"\tfoo\tbar\n",
+		"<pre><code>foo bar\n</code></pre>\n",
+	}, 0)
+}
+
+func runMarkdownBlockSourcePos(input string, extensions Extensions) string {
+	renderer := HtmlRenderer(HTML_USE_XHTML|HTML_SOURCEPOS, "", "")
+	return runMarkdownBlockWithRenderer(input, extensions, renderer)
+}
+
+func TestSourcePos(t *testing.T) {
+	var tests = []string{
+		"# Header\n\nSome *text*\nhere.\n",
+		"<h1 data-sourcepos=\"1:1-1:8\">Header</h1>\n\n<p data-sourcepos=\"3:1-4:5\">Some <em>text</em>\nhere.</p>\n",
+
+		"> quote\n>\n> * one\n> * two\n",
+		"<blockquote data-sourcepos=\"1:1-4:7\">\n" +
+			"<p data-sourcepos=\"1:3-1:7\">quote</p>\n\n" +
+			"<ul>\n<li data-sourcepos=\"3:3-3:7\">one</li>\n<li data-sourcepos=\"4:3-4:7\">two</li>\n</ul>\n" +
+			"</blockquote>\n",
+
+		"\tcode\n\n```go\nfenced\n```\n",
+		"<pre data-sourcepos=\"1:1-1:5\"><code>code\n</code></pre>\n\n" +
+			"<pre data-sourcepos=\"3:1-5:3\"><code class=\"language-go\">fenced\n</code></pre>\n",
+
+		"a | b\n---|---\n1 | 2\n",
+		"<table data-sourcepos=\"1:1-3:5\">\n<thead>\n<tr>\n<th>a</th>\n<th>b</th>\n</tr>\n</thead>\n\n" +
+			"<tbody>\n<tr>\n<td>1</td>\n<td>2</td>\n</tr>\n</tbody>\n</table>\n",
+
+		"## Title {#id}\n",
+		"<h2 id=\"id\" data-sourcepos=\"1:1-1:14\">Title</h2>\n",
+
+		// the attribute goes in the tag, whatever the id holds
+		"# H {#a>b}\n",
+		"<h1 id=\"a>b\" data-sourcepos=\"1:1-1:10\">H</h1>\n",
+
+		"- [x] done\n- [ ] todo\n\nTerm\n: Def\n\n$$\nx\n$$\n",
+		"<ul>\n<li data-sourcepos=\"1:1-1:10\"><input type=\"checkbox\" disabled=\"\" checked=\"\" /> done</li>\n" +
+			"<li data-sourcepos=\"2:1-2:10\"><input type=\"checkbox\" disabled=\"\" /> todo</li>\n</ul>\n\n" +
+			"<dl>\n<dt data-sourcepos=\"4:1-4:4\">Term</dt>\n<dd data-sourcepos=\"5:1-5:5\">Def</dd>\n</dl>\n\n" +
+			"<p data-sourcepos=\"7:1-9:2\"><span class=\"math display\">\\[x\\]</span></p>\n",
+	}
+	doTestsBlockWithRunner(t, tests, EXTENSION_TABLES|EXTENSION_FENCED_CODE|EXTENSION_HEADER_IDS|
+		EXTENSION_TASK_LISTS|EXTENSION_DEFINITION_LISTS|EXTENSION_MATH, runMarkdownBlockSourcePos)
+}
+
+// isContainer tells if the line starts a :::name container.
+func isContainer(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(":::")) && len(data) > 3 && isalnum(data[3])
+}
+
+// container parses a :::name container, up to a line with just :::, as a div
+// of that class.
+func container(p *Parser, out *Node, data []byte) int {
+	eol := bytes.IndexByte(data, '\n')
+	name := string(data[3:eol])
+	end := bytes.Index(data[eol:], []byte("\n:::\n"))
+	if end < 0 {
+		return 0
+	}
+	end += eol
+
+	block := NewNode(CustomBlock)
+	block.Value = name
+	block.Render = func(r Renderer, out Writer, text []byte) {
+		r.BlockHtml(out, []byte(`<div class="`+name+"\">\n"+string(text)+"</div>"))
+	}
+	out.AppendChild(block)
+	p.Block(block, data[eol+1:end+1])
+	return end + 5
+}
+
+// diagram takes over fenced code blocks of mermaid diagrams.
+func diagram(p *Parser, out *Node, data []byte) int {
+	end := bytes.Index(data, []byte("\n```\n"))
+	block := NewNode(CustomBlock)
+	block.Render = func(r Renderer, out Writer, text []byte) {
+		r.BlockHtml(out, []byte(`<div class="mermaid"></div>`))
+	}
+	out.AppendChild(block)
+	return end + 5
+}
+
+func TestBlockParser(t *testing.T) {
+	var tests = []string{
+		":::note\nSome *text*.\n\n* one\n* two\n:::\n",
+		"<div class=\"note\">\n<p>Some <em>text</em>.</p>\n\n<ul>\n<li>one</li>\n<li>two</li>\n</ul>\n</div>\n",
+
+		"text\n:::warning\nmore\n:::\n",
+		"<p>text</p>\n\n<div class=\"warning\">\n<p>more</p>\n</div>\n",
+
+		// not closed, so not a container
+		":::note\ntext\n",
+		"<p>:::note\ntext</p>\n",
+
+		"```mermaid\ngraph TD\n```\n\n```go\ncode\n```\n",
+		"<div class=\"mermaid\"></div>\n\n<pre><code class=\"language-go\">code\n</code></pre>\n",
+	}
+	opts := []Option{
+		WithRenderer(HtmlRenderer(0, "", "")),
+		WithExtensions(EXTENSION_FENCED_CODE),
+		WithBlockParser(BlockParser{Starts: isContainer, Parse: container}),
+		WithBlockParser(BlockParser{
+			Starts: func(data []byte) bool {
+				return bytes.HasPrefix(data, []byte("```mermaid\n"))
+			},
+			Parse:    diagram,
+			Priority: 1,
+		}),
+	}
+	for i := 0; i < len(tests); i += 2 {
+		output, err := MarkdownE([]byte(tests[i]), opts...)
+		if err != nil || string(output) != tests[i+1] {
+			t.Errorf("Input %q:\nExpected[%#v]\nActual  [%#v] %v", tests[i], tests[i+1], string(output), err)
+		}
+	}
+
+	// the custom block is in the tree
+	doc := Parse([]byte("text\n\n:::note\nmore\n:::\n"), opts...)
+	block := doc.LastChild
+	if block.Type != CustomBlock || block.Value != "note" || block.Start.Line != 3 || block.End.Line != 5 {
+		t.Errorf("unexpected custom block %v from %v to %v", block, block.Start, block.End)
+	}
+	if block.FirstChild == nil || block.FirstChild.Type != Paragraph {
+		t.Errorf("expected a paragraph in the custom block, got %v", block.FirstChild)
+	}
+
+	// parsers that go past the end get caught
+	greedy := BlockParser{
+		Starts: func(data []byte) bool { return true },
+		Parse:  func(p *Parser, out *Node, data []byte) int { return len(data) + 1 },
+	}
+	_, err := MarkdownE([]byte("text\n"), WithBlockParser(greedy))
+	if _, ok := err.(*InvariantError); !ok {
+		t.Errorf("expected an *InvariantError, got %v", err)
+	}
+}
@@ -0,0 +1,711 @@
+//
+// Blackfriday Markdown Processor
+// Available at http://github.com/russross/blackfriday
+//
+// Copyright © 2011 Russ Ross <russ@russross.com>.
+// Distributed under the Simplified BSD License.
+// See README.md for details.
+//
+
+//
+//
+// Delimiter matching for inline parsing
+//
+//
+
+package blackfriday
+
+// Emphasis markers and link brackets are matched by looking forward from the
+// opening delimiter for a closing one. Looking afresh from every opener means
+// that a span full of openers that never close, like thousands of '*' or
+// '[', takes quadratic time.
+//
+// Instead, the delimiters of a span are worked out all at once, the first
+// time the span needs them: brackets are paired with a stack, and for each
+// kind of emphasis a table records which closer the search starting at every
+// position would end at. The tables are built in a single pass from the end
+// of the span, and every lookup after that is constant time.
+//
+// This is not the delimiter stack of the CommonMark reference algorithm, on
+// purpose. There, every closer is matched with the nearest opener before it
+// that fits. Markdown.pl, and blackfriday after it, has every opener take the
+// first closer after it that fits instead, with rules of its own for the code
+// spans and links in between, and documents written for it depend on that:
+// '*a **b* c**' is not parsed the same way by the two. A stack can't answer
+// the question the old forward search asked, but these tables answer it
+// exactly, once per span instead of once per opener, so the output stays the
+// same. With EXTENSION_COMMONMARK, where the spec's rules are wanted, the
+// stack is used; see matchRuns below.
+//
+// With EXTENSION_COMMONMARK, the text of a link or an image is parsed as a
+// span of its own, within the span it is in. Such a span looks things up in
+// the tables of the one around it, which say where it ends, instead of
+// working out tables of its own: with links within images within links, that
+// would take time in proportion to how deep they go, for every byte.
+
+type delimiters struct {
+	*spanTables
+
+	// Where the span ends in the data of the tables; lookups that find
+	// nothing before it say so
+	end int
+
+	// The runs of emphasis chars found so far, when following CommonMark
+	runs, lastRun *delimRun
+}
+
+// spanTables holds the lookup tables of a span, which are worked out when
+// they are first needed.
+type spanTables struct {
+	p    *parser
+	data []byte
+
+	next     map[byte][]int32    // first position at or after k holding the byte
+	space    []int32             // first position at or after k that is not ' ' or '\n'
+	emph     map[byte][]int32    // what the search for an emphasis char from k finds
+	closers  map[emphKey][]int32 // where the emphasis searched for from k ends
+	brackets []int32             // the bracket closing the one at k
+	openers  []int32             // the first '[' that counts at or after k
+	links    []int8              // what the brackets opened at k hold, once known
+	scans    map[string][]int32  // first of a set of bytes at or after k, skipping escapes
+	math     [2][]int32          // the closer of math with 1 or 2 dollars searched for from k
+	ticks    []int32             // the number of backticks in a row from k
+	maxTicks []int32             // the longest run of backticks at or after k
+	sameRun  []int32             // the next run of backticks as long as the one from k
+	strs     map[string][]int32  // first position at or after k where a string starts
+	controls []int32             // first space or control char at or after k
+}
+
+type emphKey struct {
+	c     byte
+	count int
+}
+
+func newDelimiters(p *parser, data []byte) delimiters {
+	return delimiters{spanTables: &spanTables{p: p, data: data}, end: len(data)}
+}
+
+// pushSpan starts a span of inline content. The delimiters of spans that
+// are done with are reused.
+func (p *parser) pushSpan(data []byte) {
+	d := newDelimiters(p, data)
+	if k := len(p.spans) - 1; k >= 0 && len(data) > 0 && p.flags&EXTENSION_COMMONMARK != 0 {
+		// a span within the one around it shares its tables
+		outer := p.spans[k]
+		at := cap(outer.data) - cap(data)
+		if at >= 0 && at+len(data) <= outer.end && &outer.data[at] == &data[0] {
+			d = delimiters{spanTables: outer.spanTables, end: at + len(data)}
+		}
+	}
+	if n := len(p.spans); n < cap(p.spans) && p.spans[:n+1][n] != nil {
+		p.spans = p.spans[:n+1]
+		*p.spans[n] = d
+		return
+	}
+	p.spans = append(p.spans, &d)
+}
+
+func (p *parser) popSpan() {
+	p.spans = p.spans[:len(p.spans)-1]
+}
+
+// delimitersFor returns the delimiters of the span being parsed, and the
+// position of 'data' in it. 'data' has to be a suffix of the span; if it is
+// not, its delimiters are worked out on their own.
+func (p *parser) delimitersFor(data []byte) (*delimiters, int) {
+	if k := len(p.spans) - 1; k >= 0 && len(data) > 0 {
+		d := p.spans[k]
+		if n := d.end; len(data) <= n && &data[len(data)-1] == &d.data[n-1] {
+			return d, n - len(data)
+		}
+	}
+	d := newDelimiters(p, data)
+	return &d, 0
+}
+
+// table makes a lookup table with room for every position of the span and
+// one past the end, which is what it says when there is no answer.
+func (d *spanTables) table() []int32 {
+	n := len(d.data)
+	d.p.spend(n)
+	t := make([]int32, n+1)
+	t[n] = int32(n)
+	return t
+}
+
+// lookup looks up k in a table, where an answer past the end of the span is
+// no answer.
+func (d *delimiters) lookup(t []int32, k int) int {
+	if k >= d.end {
+		return d.end
+	}
+	return min(int(t[k]), d.end)
+}
+
+// nextByte finds the first 'b' at or after k.
+func (d *delimiters) nextByte(b byte, k int) int {
+	t := d.next[b]
+	if t == nil {
+		if d.next == nil {
+			d.next = make(map[byte][]int32)
+		}
+		t = d.table()
+		for i := len(d.data) - 1; i >= 0; i-- {
+			if d.data[i] == b {
+				t[i] = int32(i)
+			} else {
+				t[i] = t[i+1]
+			}
+		}
+		d.next[b] = t
+	}
+	return d.lookup(t, k)
+}
+
+// skipSpace skips spaces and newlines from k.
+func (d *delimiters) skipSpace(k int) int {
+	if d.space == nil {
+		d.space = d.table()
+		for i := len(d.data) - 1; i >= 0; i-- {
+			if d.data[i] == ' ' || d.data[i] == '\n' {
+				d.space[i] = d.space[i+1]
+			} else {
+				d.space[i] = int32(i)
+			}
+		}
+	}
+	return d.lookup(d.space, k)
+}
+
+// scan finds the first byte in 'set' at or after k, skipping over the
+// characters that follow backslashes.
+func (d *delimiters) scan(set string, k int) int {
+	t := d.scans[set]
+	if t == nil {
+		if d.scans == nil {
+			d.scans = make(map[string][]int32)
+		}
+		t = d.table()
+		for i := len(d.data) - 1; i >= 0; i-- {
+			switch {
+			case d.data[i] == '\\':
+				t[i] = int32(d.lookup(t, i+2))
+			case indexByte(set, d.data[i]):
+				t[i] = int32(i)
+			default:
+				t[i] = t[i+1]
+			}
+		}
+		d.scans[set] = t
+	}
+	return d.lookup(t, k)
+}
+
+// closeMath finds the closer of math opened with 'n' dollars, searching from
+// k: a '$' after something other than a space and not followed by a digit,
+// or "$$".
+func (d *delimiters) closeMath(n int, k int) int {
+	t := d.math[n-1]
+	if t == nil {
+		data := d.data
+		t = d.table()
+		for i := len(data) - 1; i >= 0; i-- {
+			switch {
+			case data[i] == '\\':
+				t[i] = int32(d.lookup(t, i+2))
+			case n == 2 && data[i] == '$' && i+1 < len(data) && data[i+1] == '$',
+				n == 1 && data[i] == '$' && i > 0 && !isspace(data[i-1]) &&
+					(i+1 >= len(data) || data[i+1] < '0' || data[i+1] > '9'):
+				t[i] = int32(i)
+			default:
+				t[i] = t[i+1]
+			}
+		}
+		d.math[n-1] = t
+	}
+	return d.lookup(t, k)
+}
+
+// backticks works out the runs of backticks of the span, for code spans to
+// find their closers without each of them looking through the rest of it.
+func (d *delimiters) backticks() {
+	data, n := d.data, len(d.data)
+	d.ticks, d.maxTicks, d.sameRun = d.table(), d.table(), d.table()
+	d.ticks[n], d.maxTicks[n] = 0, 0
+
+	// the start of the first run of each length after i
+	runs := make(map[int32]int32)
+	for i := n - 1; i >= 0; i-- {
+		d.sameRun[i] = int32(n)
+		if data[i] == '`' {
+			d.ticks[i] = d.ticks[i+1] + 1
+			if next, ok := runs[d.ticks[i]]; ok {
+				d.sameRun[i] = next
+			}
+			if i == 0 || data[i-1] != '`' {
+				runs[d.ticks[i]] = int32(i)
+			}
+		} else {
+			d.ticks[i] = 0
+		}
+		d.maxTicks[i] = max(d.ticks[i], d.maxTicks[i+1])
+	}
+}
+
+// tickRun returns the number of backticks in a row from k.
+func (d *delimiters) tickRun(k int) int {
+	if d.ticks == nil {
+		d.backticks()
+	}
+	if k >= d.end {
+		return 0
+	}
+	return min(int(d.ticks[k]), d.end-k)
+}
+
+// longestTicks returns the length of the longest run of backticks at or
+// after k.
+func (d *delimiters) longestTicks(k int) int {
+	if d.ticks == nil {
+		d.backticks()
+	}
+	if k >= d.end {
+		return 0
+	}
+	return int(d.maxTicks[k])
+}
+
+// closeTicks finds the first whole run of backticks after the one from k
+// that is exactly as long.
+func (d *delimiters) closeTicks(k int) int {
+	if d.ticks == nil {
+		d.backticks()
+	}
+	return d.lookup(d.sameRun, k)
+}
+
+// nextString finds the first 's' that starts at or after k.
+func (d *delimiters) nextString(s string, k int) int {
+	t := d.strs[s]
+	if t == nil {
+		if d.strs == nil {
+			d.strs = make(map[string][]int32)
+		}
+		t = d.table()
+		for i := len(d.data) - 1; i >= 0; i-- {
+			if i+len(s) <= len(d.data) && string(d.data[i:i+len(s)]) == s {
+				t[i] = int32(i)
+			} else {
+				t[i] = t[i+1]
+			}
+		}
+		d.strs[s] = t
+	}
+	return d.lookup(t, k)
+}
+
+// nextControl finds the first space or ASCII control char at or after k,
+// which is where the URI of a CommonMark link or autolink ends.
+func (d *delimiters) nextControl(k int) int {
+	if d.controls == nil {
+		d.controls = d.table()
+		for i := len(d.data) - 1; i >= 0; i-- {
+			if c := d.data[i]; c <= ' ' || c == 0x7f {
+				d.controls[i] = int32(i)
+			} else {
+				d.controls[i] = d.controls[i+1]
+			}
+		}
+	}
+	return d.lookup(d.controls, k)
+}
+
+func indexByte(s string, c byte) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] == c {
+			return true
+		}
+	}
+	return false
+}
+
+// emphTable says where the search for the next emphasis char 'c' from each
+// position ends, skipping code spans and links.
+func (d *delimiters) emphTable(c byte) []int32 {
+	t := d.emph[c]
+	if t == nil {
+		if d.emph == nil {
+			d.emph = make(map[byte][]int32)
+		}
+		t = d.table()
+		for i := len(d.data) - 1; i >= 0; i-- {
+			t[i] = int32(d.findEmphAt(t, c, i))
+		}
+		d.emph[c] = t
+	}
+	return t
+}
+
+// findEmphAt works out where the search from k ends, given where it ends from
+// every position after k.
+func (d *delimiters) findEmphAt(t []int32, c byte, k int) int {
+	data, n := d.data, len(d.data)
+	switch b := data[k]; {
+	case b == c:
+		return k
+	case b != '`' && b != '[':
+		return int(t[k+1])
+	case k > 0 && data[k-1] == '\\':
+		// do not count escaped chars
+		return int(t[k+1])
+	case b == '`':
+		// skip a code span; if it is not closed, settle for an emphasis
+		// char inside it
+		end := d.nextByte('`', k+1)
+		if end >= n {
+			return d.nextByte(c, k+1)
+		}
+		return d.lookup(t, end+1)
+	}
+
+	// skip a link, or settle for an emphasis char inside the brackets if
+	// it is not one
+	end := d.nextByte(']', k+1)
+	inside := d.nextByte(c, k+1)
+	if inside >= end {
+		inside = n
+	}
+	i := d.skipSpace(end + 1)
+	if i >= n {
+		return inside
+	}
+	if data[i] != '[' && data[i] != '(' {
+		if inside < n {
+			return inside
+		}
+		return d.lookup(t, i)
+	}
+	close := d.nextByte(data[i], i+1)
+	if inside == n {
+		if j := d.nextByte(c, i+1); j < close {
+			return j
+		}
+	}
+	if close >= n {
+		return inside
+	}
+	return d.lookup(t, close+1)
+}
+
+// closeEmph finds the closing delimiter of an emphasis with 'count' chars 'c',
+// searching from k on. For triple emphasis, this is the first delimiter that
+// could close any kind of emphasis.
+func (d *delimiters) closeEmph(c byte, count int, k int) int {
+	key := emphKey{c, count}
+	t := d.closers[key]
+	if t == nil {
+		if d.closers == nil {
+			d.closers = make(map[emphKey][]int32)
+		}
+		t = d.table()
+		data, n := d.data, len(d.data)
+		noIntra := d.p.flags&EXTENSION_NO_INTRA_EMPHASIS != 0
+		find := d.emphTable(c)
+		for i := n - 1; i >= 0; i-- {
+			j := int(find[i+1])
+			switch {
+			case j >= n:
+				t[i] = int32(n)
+
+			case count == 1:
+				switch {
+				case j+1 < n && data[j+1] == c:
+					// a double char doesn't close
+					t[i] = t[j+1]
+				case isspace(data[j-1]),
+					noIntra && !(j+1 == n || isspace(data[j+1]) || ispunct(data[j+1])):
+					t[i] = t[j]
+				default:
+					t[i] = int32(j)
+				}
+
+			case count == 2:
+				if j+1 < n && data[j+1] == c && !isspace(data[j-1]) {
+					t[i] = int32(j)
+				} else {
+					t[i] = t[j+1]
+				}
+
+			default:
+				// skip whitespace preceded symbols
+				if isspace(data[j-1]) {
+					t[i] = t[j]
+				} else {
+					t[i] = int32(j)
+				}
+			}
+		}
+		d.closers[key] = t
+	}
+	return d.lookup(t, k)
+}
+
+// closeBracket finds the bracket that closes the '[' at k. Escaped brackets
+// don't count, and with CommonMark, neither do the ones in code spans,
+// autolinks and raw HTML, which go first.
+//
+// With the depth of the brackets counted from the start of the span, that
+// is the first position after k where the depth drops below what it is at
+// k, which a stack finds for every position in one go.
+func (d *delimiters) closeBracket(k int) int {
+	if d.brackets == nil {
+		data, n := d.data, len(d.data)
+		depth := make([]int32, n)
+		d.openers = d.table()
+		level := int32(0)
+		for i := 0; i < n; i++ {
+			if end := d.skipOpaque(i); end > i {
+				for ; i < end; i++ {
+					depth[i] = level
+					d.openers[i] = -1
+				}
+				i--
+				continue
+			}
+			d.openers[i] = -1
+			if i == 0 || data[i-1] != '\\' {
+				switch data[i] {
+				case '[':
+					level++
+					d.openers[i] = int32(i)
+				case ']':
+					level--
+				}
+			}
+			depth[i] = level
+		}
+		for i := n - 1; i >= 0; i-- {
+			if d.openers[i] < 0 {
+				d.openers[i] = d.openers[i+1]
+			}
+		}
+
+		d.brackets = d.table()
+		var stack []int32
+		for i := n - 1; i >= 0; i-- {
+			for len(stack) > 0 && depth[stack[len(stack)-1]] >= depth[i] {
+				stack = stack[:len(stack)-1]
+			}
+			if len(stack) > 0 {
+				d.brackets[i] = stack[len(stack)-1]
+			} else {
+				d.brackets[i] = int32(n)
+			}
+			stack = append(stack, int32(i))
+		}
+	}
+	return d.lookup(d.brackets, k)
+}
+
+// What linkInfo finds out about the brackets opened at some position
+const (
+	bracketsKnown    = 1 << iota // the brackets have been looked at
+	bracketsLink                 // they make a link
+	bracketsHoldLink             // there is a link within them
+)
+
+// makesLink tells if the brackets opened at k make a link. With CommonMark,
+// a link within them keeps them from making one of their own: the innermost
+// link wins.
+func (d *delimiters) makesLink(k int) bool {
+	return d.linkInfo(k)&bracketsLink != 0
+}
+
+// linkInfo works out if the brackets opened at k make a link, and if there is
+// one within them. The brackets within are looked at once each, whichever of
+// the brackets around them asks first, so that deeply nested brackets don't
+// take quadratic time.
+func (d *delimiters) linkInfo(k int) int8 {
+	if d.links == nil {
+		d.links = make([]int8, len(d.data))
+	}
+	if info := d.links[k]; info != 0 {
+		return info
+	}
+
+	info := int8(bracketsKnown)
+	end := d.closeBracket(k)
+	for j := d.lookup(d.openers, k+1); j < end; j = d.lookup(d.openers, d.closeBracket(j)+1) {
+		if d.linkInfo(j)&(bracketsLink|bracketsHoldLink) != 0 {
+			info |= bracketsHoldLink
+		}
+	}
+	if info&bracketsHoldLink == 0 && end < d.end && isLinkCommonMark(d.p, d, k, end) {
+		info |= bracketsLink
+	}
+	d.links[k] = info
+	return info
+}
+
+// skipOpaque returns the end of the code span, autolink or raw HTML that
+// starts at i, with CommonMark, or i if there is none there. A run of
+// backticks that doesn't start a code span is skipped as a whole.
+func (d *delimiters) skipOpaque(i int) int {
+	data := d.data[:d.end]
+	if d.p.flags&EXTENSION_COMMONMARK == 0 || i > 0 && data[i-1] == '\\' {
+		return i
+	}
+	switch data[i] {
+	case '`':
+		n := d.tickRun(i)
+		if end := d.closeTicks(i); end < len(data) {
+			return end + n
+		}
+		return i + n
+	case '<':
+		if end, _ := autoLinkCommonMark(d.p, data[i:]); end > 0 {
+			return i + end
+		}
+		return i + htmlTagCommonMark(d.p, data[i:])
+	}
+	return i
+}
+
+// With EXTENSION_COMMONMARK, emphasis is worked out the way the spec
+// describes it instead: the runs of '*' and '_' are kept as text while the
+// span is parsed, along with whether each can open or close emphasis, and
+// once the whole span has been seen they are matched from left to right,
+// each closer with the nearest opener before it. Runs that find no match stay
+// as they are.
+
+// A delimRun is a run of emphasis chars that can open or close emphasis.
+type delimRun struct {
+	node      *Node // the Text node holding the chars of the run that are left
+	c         byte  // '*' or '_'
+	at        int   // position of the chars that are left in the span
+	count     int   // how many chars are left
+	origCount int   // how many chars there were to start with
+	canOpen   bool
+	canClose  bool
+
+	prev, next *delimRun
+}
+
+// pushRun adds a run to the end of the list.
+func (d *delimiters) pushRun(run *delimRun) {
+	run.prev = d.lastRun
+	if d.lastRun != nil {
+		d.lastRun.next = run
+	} else {
+		d.runs = run
+	}
+	d.lastRun = run
+}
+
+// removeRun takes a run off the list.
+func (d *delimiters) removeRun(run *delimRun) {
+	if run.prev != nil {
+		run.prev.next = run.next
+	} else {
+		d.runs = run.next
+	}
+	if run.next != nil {
+		run.next.prev = run.prev
+	} else {
+		d.lastRun = run.prev
+	}
+}
+
+// matches tells if 'opener' can be closed by 'closer'. When either of them
+// could go both ways, the lengths of the runs decide: their sum must not be
+// a multiple of 3, unless both of them are.
+func (opener *delimRun) matches(closer *delimRun) bool {
+	if opener.c != closer.c || !opener.canOpen || opener.node.Parent != closer.node.Parent {
+		return false
+	}
+	if opener.canClose || closer.canOpen {
+		sum := opener.origCount + closer.origCount
+		return sum%3 != 0 || (opener.origCount%3 == 0 && closer.origCount%3 == 0)
+	}
+	return true
+}
+
+// matchRuns turns the matching runs of the span into emphasis, moving the
+// nodes between them into the new Emphasis and DoubleEmphasis nodes.
+//
+// When the search for the opener of a closer fails, the next closer that is
+// alike, as far as the search is concerned, need not look any further back
+// than that search did. Remembering where each kind of search gave up keeps
+// the whole thing linear.
+func (d *delimiters) matchRuns() {
+	var bottom [2][2][3]*delimRun // by char, whether the closer can open, and length mod 3
+	for closer := d.runs; closer != nil; {
+		if !closer.canClose {
+			closer = closer.next
+			continue
+		}
+
+		kind := 0
+		if closer.c == '_' {
+			kind = 1
+		}
+		canOpen := 0
+		if closer.canOpen {
+			canOpen = 1
+		}
+		stop := &bottom[kind][canOpen][closer.origCount%3]
+
+		var opener *delimRun
+		for o := closer.prev; o != nil && o != *stop; o = o.prev {
+			d.p.spend(1)
+			if o.matches(closer) {
+				opener = o
+				break
+			}
+		}
+
+		if opener == nil {
+			*stop = closer.prev
+			next := closer.next
+			if !closer.canOpen {
+				d.removeRun(closer)
+			}
+			closer = next
+			continue
+		}
+
+		// strong emphasis takes two chars from each side, if both have them
+		use, typ := 1, Emphasis
+		if opener.count >= 2 && closer.count >= 2 {
+			use, typ = 2, DoubleEmphasis
+		}
+		opener.count -= use
+		emph := NewNode(typ)
+		emph.source = d.data[opener.at+opener.count : closer.at+use]
+		for n := opener.node.Next; n != closer.node; n = opener.node.Next {
+			emph.AppendChild(n)
+		}
+		closer.node.InsertBefore(emph)
+
+		// the runs between the two are left as text
+		opener.next, closer.prev = closer, opener
+
+		opener.node.Literal = opener.node.Literal[:opener.count]
+		opener.node.trimSource(use)
+		if opener.count == 0 {
+			opener.node.Unlink()
+			d.removeRun(opener)
+		}
+
+		closer.count -= use
+		closer.at += use
+		closer.node.Literal = closer.node.Literal[use:]
+		closer.node.source = closer.node.source[use:]
+		if closer.count == 0 {
+			next := closer.next
+			closer.node.Unlink()
+			d.removeRun(closer)
+			closer = next
+		}
+	}
+}
@@ -0,0 +1,793 @@
+//
+// Blackfriday Markdown Processor
+// Available at http://github.com/russross/blackfriday
+//
+// Copyright © 2011 Russ Ross <russ@russross.com>.
+// Distributed under the Simplified BSD License.
+// See README.md for details.
+//
+
+//
+//
+// Markdown rendering backend
+//
+//
+
+package blackfriday
+
+import (
+	"bytes"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Formatter is a type that implements the Renderer interface for Markdown
+// output. It writes documents in one consistent style: ATX headers, '*'
+// bullets, fenced code blocks, aligned pipe tables, and reference links
+// collected at the bottom. Formatting its output again gives the same bytes.
+//
+// Do not create this directly, instead use the MarkdownRenderer function.
+type Formatter struct {
+	extensions Extensions
+	indent     string // what a footnote is indented with
+
+	// what is left over from formatting the current document
+	*formatterState
+}
+
+// formatterState is what a Formatter keeps track of while it formats a
+// document.
+type formatterState struct {
+	lists []formatterList // the enclosing lists
+
+	// where text that ended with a newline was written last, which is a
+	// line, not a block, that ends there
+	textOut Writer
+	textEnd int
+
+	// rows of the table being formatted, header rows first
+	rows    [][][]byte
+	cells   [][]byte
+	headers int
+
+	// reference links, in order of appearance
+	links   []formatterLink
+	linkIDs map[formatterLink]string
+	notes   map[string]bool // footnote names, which link ids must not take
+
+	// abbreviations, in order of appearance, and what they stand for
+	abbrNames []string
+	abbrs     map[string]string
+}
+
+type formatterList struct {
+	start int  // number of the first item of an ordered list
+	items int  // number of items so far
+	loose bool // whether the last item was made of blocks
+	term  bool // whether the last item was a term of a definition list
+}
+
+type formatterLink struct {
+	link, title string
+}
+
+func newFormatterState() *formatterState {
+	return &formatterState{
+		linkIDs: make(map[formatterLink]string),
+		notes:   make(map[string]bool),
+		abbrs:   make(map[string]string),
+	}
+}
+
+// MarkdownRenderer creates and configures a Formatter object, which
+// satisfies the Renderer interface.
+//
+// extensions has to be the set of EXTENSION_* options the document is parsed
+// with, so that the output is parsed back into the same document.
+func MarkdownRenderer(extensions Extensions) Renderer {
+	indent := "    "
+	if extensions&EXTENSION_TAB_SIZE_EIGHT != 0 {
+		indent = "        "
+	}
+	return &Formatter{
+		extensions:     extensions,
+		indent:         indent,
+		formatterState: newFormatterState(),
+	}
+}
+
+// NewDocument returns a renderer with the same configuration, to render a
+// single document with.
+func (options *Formatter) NewDocument() Renderer {
+	r := *options
+	r.Reset()
+	return &r
+}
+
+func (options *Formatter) base() Renderer {
+	return options
+}
+
+// Reset forgets about the documents formatted so far, like the reference
+// links to write out at the bottom.
+func (options *Formatter) Reset() {
+	options.formatterState = newFormatterState()
+}
+
+func (options *Formatter) GetFlags() int {
+	return 0
+}
+
+// startBlock separates a block from what comes before it: a blank line after
+// another block, or a line break after the text of a list item.
+func (options *Formatter) startBlock(out Writer) {
+	data := written(out)
+	switch n := len(data); {
+	case n == 0:
+	case data[n-1] != '\n':
+		out.WriteByte('\n')
+	case out == options.textOut && n == options.textEnd:
+	case n < 2 || data[n-2] != '\n':
+		out.WriteByte('\n')
+	}
+}
+
+// prefixLines writes 'text' with 'first' in front of the first line and
+// 'rest' in front of every other line that isn't blank.
+func prefixLines(out Writer, text []byte, first, rest string) {
+	prefix := first
+	for i := 0; len(text) > 0; i++ {
+		end := bytes.IndexByte(text, '\n') + 1
+		if end == 0 {
+			end = len(text)
+		}
+		if text[0] != '\n' || i == 0 {
+			out.WriteString(prefix)
+		}
+		out.Write(text[:end])
+		text = text[end:]
+		prefix = rest
+	}
+}
+
+// taskBox returns the checkbox of a task list item, followed by a space, or
+// nothing if the item is not a task.
+func taskBox(flags int) string {
+	switch {
+	case flags&LIST_ITEM_CHECKED != 0:
+		return "[x] "
+	case flags&LIST_ITEM_TASK != 0:
+		return "[ ] "
+	}
+	return ""
+}
+
+// fence returns a run of 'c' longer than any run of it in 'text', and at
+// least 'min' long.
+func fence(text []byte, c byte, min int) string {
+	longest, run := 0, 0
+	for _, b := range text {
+		if b == c {
+			run++
+			if run > longest {
+				longest = run
+			}
+		} else {
+			run = 0
+		}
+	}
+	if longest < min {
+		longest = min - 1
+	}
+	return string(bytes.Repeat([]byte{c}, longest+1))
+}
+
+func (options *Formatter) BlockCode(out Writer, text []byte, lang string) {
+	options.startBlock(out)
+	if len(text) > 0 && text[len(text)-1] != '\n' {
+		text = append(text[:len(text):len(text)], '\n')
+	}
+
+	// unindented lines that look like references would be taken for them
+	if options.extensions&EXTENSION_FENCED_CODE == 0 || lang == "" && hasReference(text) {
+		prefixLines(out, text, "    ", "    ")
+		return
+	}
+	marker := fence(text, '`', 3)
+	out.WriteString(marker)
+	out.WriteString(lang)
+	out.WriteByte('\n')
+	out.Write(text)
+	out.WriteString(marker)
+	out.WriteByte('\n')
+}
+
+// hasReference tells if a line of 'text' might be a reference.
+func hasReference(text []byte) bool {
+	for len(text) > 0 {
+		line := text
+		if end := bytes.IndexByte(text, '\n'); end >= 0 {
+			line, text = text[:end], text[end+1:]
+		} else {
+			text = nil
+		}
+		line = bytes.TrimLeft(line, " ")
+		if end := bytes.IndexByte(line, ']'); len(line) > 0 && line[0] == '[' &&
+			end > 0 && end+1 < len(line) && line[end+1] == ':' {
+			return true
+		}
+	}
+	return false
+}
+
+func (options *Formatter) MathBlock(out Writer, text []byte) {
+	options.startBlock(out)
+	out.WriteString("$$\n")
+	out.Write(text)
+	out.WriteString("\n$$\n")
+}
+
+func (options *Formatter) TitleBlock(out Writer, text []byte) {
+	options.startBlock(out)
+	out.Write(text)
+	out.WriteByte('\n')
+}
+
+func (options *Formatter) BlockQuote(out Writer, text []byte) {
+	options.startBlock(out)
+	text = bytes.TrimRight(text, "\n")
+	if len(text) == 0 {
+		out.WriteByte('>')
+	}
+	for len(text) > 0 {
+		end := bytes.IndexByte(text, '\n') + 1
+		if end == 0 {
+			end = len(text)
+		}
+		if text[0] != '\n' {
+			out.WriteString("> ")
+		} else {
+			out.WriteByte('>')
+		}
+		out.Write(text[:end])
+		text = text[end:]
+	}
+	out.WriteByte('\n')
+}
+
+func (options *Formatter) BlockHtml(out Writer, text []byte) {
+	options.startBlock(out)
+	out.Write(bytes.TrimRight(text, "\n"))
+	out.WriteByte('\n')
+}
+
+func (options *Formatter) Header(out Writer, text func() bool, level int, id string) {
+	marker := len(written(out))
+	options.startBlock(out)
+	start := len(written(out))
+
+	if !text() {
+		rollback(out, marker)
+		return
+	}
+	title := append([]byte(nil), written(out)[start:]...)
+	rollback(out, start)
+
+	// trailing hashes are taken for the end of an ATX header
+	if level <= 2 && len(title) > 0 && title[len(title)-1] == '#' {
+		out.Write(title)
+		out.WriteByte('\n')
+		out.Write(bytes.Repeat([]byte{"=-"[level-1]}, utf8.RuneCount(title)))
+		out.WriteByte('\n')
+		return
+	}
+	out.WriteString("######"[:level])
+	out.WriteByte(' ')
+	if options.extensions&EXTENSION_HEADER_IDS != 0 {
+		// so that it isn't taken for an id
+		title = bytes.Replace(title, []byte("{#"), []byte("{\\#"), -1)
+	}
+	out.Write(title)
+	if id != "" && options.extensions&EXTENSION_HEADER_IDS != 0 {
+		out.WriteString(" {#")
+		out.WriteString(id)
+		out.WriteByte('}')
+	}
+	out.WriteByte('\n')
+}
+
+func (options *Formatter) HRule(out Writer) {
+	options.startBlock(out)
+	out.WriteString("* * *\n")
+}
+
+func (options *Formatter) List(out Writer, text func() bool, flags int) {
+	options.ListStart(out, text, flags, 1)
+}
+
+// ListStart numbers the items of an ordered list from the number it starts
+// at.
+func (options *Formatter) ListStart(out Writer, text func() bool, flags int, start int) {
+	marker := len(written(out))
+	options.startBlock(out)
+	options.lists = append(options.lists, formatterList{start: start})
+	if !text() {
+		rollback(out, marker)
+	}
+	options.lists = options.lists[:len(options.lists)-1]
+}
+
+func (options *Formatter) ListItem(out Writer, text []byte, flags int) {
+	list := &options.lists[len(options.lists)-1]
+	list.items++
+
+	// a blank line after an item makes it and the ones after it blocks
+	if list.loose {
+		out.WriteByte('\n')
+	}
+	list.loose = flags&LIST_ITEM_CONTAINS_BLOCK != 0
+	bullet := "* "
+	if flags&LIST_TYPE_ORDERED != 0 {
+		bullet = strconv.Itoa(list.start+list.items-1) + ". "
+	}
+	prefixLines(out, append([]byte(taskBox(flags)), text...), bullet, "    ")
+	out.WriteByte('\n')
+}
+
+func (options *Formatter) DefinitionList(out Writer, text func() bool, flags int) {
+	options.List(out, text, flags)
+}
+
+func (options *Formatter) DefinitionTerm(out Writer, text []byte, flags int) {
+	list := &options.lists[len(options.lists)-1]
+	list.items++
+
+	// the entries of the list are set apart by blank lines
+	if list.items > 1 && !list.term {
+		out.WriteByte('\n')
+	}
+	list.term = true
+	out.Write(text)
+	out.WriteByte('\n')
+}
+
+func (options *Formatter) DefinitionData(out Writer, text []byte, flags int) {
+	list := &options.lists[len(options.lists)-1]
+	list.items++
+
+	// a blank line before a definition makes it a block
+	if flags&LIST_ITEM_CONTAINS_BLOCK != 0 {
+		out.WriteByte('\n')
+	}
+	list.term = false
+	prefixLines(out, text, ":   ", "    ")
+	out.WriteByte('\n')
+}
+
+func (options *Formatter) Paragraph(out Writer, text func() bool) {
+	marker := len(written(out))
+	options.startBlock(out)
+	start := len(written(out))
+	if !text() {
+		rollback(out, marker)
+		return
+	}
+
+	// a paragraph that starts with a block-level tag would be taken for a
+	// block of HTML, but not with a space in front
+	if isBlockTag(written(out)[start:]) {
+		text := append([]byte{' '}, written(out)[start:]...)
+		rollback(out, start)
+		out.Write(text)
+	}
+	out.WriteByte('\n')
+}
+
+func isBlockTag(data []byte) bool {
+	if len(data) < 2 || data[0] != '<' {
+		return false
+	}
+	i := 1
+	if data[i] == '!' {
+		return true
+	}
+	if data[i] == '/' {
+		i++
+	}
+	end := i
+	for end < len(data) && isalnum(data[end]) {
+		end++
+	}
+	return blockTags[string(data[i:end])]
+}
+
+func (options *Formatter) Table(out Writer, header []byte, body []byte, columnData []int) {
+	rows, headers := options.rows, options.headers
+	options.rows, options.headers = nil, 0
+	options.startBlock(out)
+
+	widths := make([]int, len(columnData))
+	for i := range widths {
+		widths[i] = 3
+	}
+	for _, row := range rows {
+		for i, cell := range row {
+			if i < len(widths) && utf8.RuneCount(cell) > widths[i] {
+				widths[i] = utf8.RuneCount(cell)
+			}
+		}
+	}
+
+	for i, row := range rows {
+		if i == headers {
+			options.tableRule(out, widths, columnData)
+		}
+		out.WriteByte('|')
+		for j, cell := range row {
+			if j >= len(widths) {
+				break
+			}
+			pad := widths[j] - utf8.RuneCount(cell)
+			left := 0
+			switch columnData[j] {
+			case TABLE_ALIGNMENT_RIGHT:
+				left = pad
+			case TABLE_ALIGNMENT_CENTER:
+				left = pad / 2
+			}
+			out.WriteByte(' ')
+			out.Write(bytes.Repeat([]byte{' '}, left))
+			out.Write(cell)
+			out.Write(bytes.Repeat([]byte{' '}, pad-left))
+			out.WriteString(" |")
+		}
+		out.WriteByte('\n')
+	}
+	if headers == len(rows) {
+		options.tableRule(out, widths, columnData)
+	}
+}
+
+func (options *Formatter) tableRule(out Writer, widths []int, columnData []int) {
+	out.WriteByte('|')
+	for i, width := range widths {
+		rule := bytes.Repeat([]byte{'-'}, width+2)
+		if columnData[i]&TABLE_ALIGNMENT_LEFT != 0 {
+			rule[0] = ':'
+		}
+		if columnData[i]&TABLE_ALIGNMENT_RIGHT != 0 {
+			rule[len(rule)-1] = ':'
+		}
+		out.Write(rule)
+		out.WriteByte('|')
+	}
+	out.WriteByte('\n')
+}
+
+func (options *Formatter) TableRow(out Writer, text []byte) {
+	options.rows = append(options.rows, options.cells)
+	options.cells = nil
+}
+
+func (options *Formatter) TableHeaderCell(out Writer, text []byte, align int) {
+	if len(options.cells) == 0 {
+		options.headers++
+	}
+	options.TableCell(out, text, align)
+}
+
+func (options *Formatter) TableCell(out Writer, text []byte, align int) {
+	// pipes would end the cell
+	var cell []byte
+	for i, c := range text {
+		if c == '|' && !isBackslashEscaped(text, i) {
+			cell = append(cell, '\\')
+		}
+		cell = append(cell, c)
+	}
+	options.cells = append(options.cells, cell)
+}
+
+// Footnotes writes the definitions of the notes, which there are none of when
+// every note is an inline one.
+func (options *Formatter) Footnotes(out Writer, text func() bool) {
+	marker := len(written(out))
+	options.startBlock(out)
+	start := len(written(out))
+	if !text() || len(written(out)) == start {
+		rollback(out, marker)
+	}
+}
+
+// FootnoteItem writes the definition of a note, unless the note was written
+// in the text by InlineNote.
+func (options *Formatter) FootnoteItem(out Writer, name, text []byte, flags int) {
+	if flags&LIST_ITEM_INLINE_NOTE != 0 {
+		return
+	}
+	options.startBlock(out)
+	out.WriteString("[^")
+	out.Write(name)
+	out.WriteString("]:")
+
+	// the contents of a note are taken for blocks when it has more than
+	// one line
+	text = bytes.TrimRight(text, "\n")
+	if flags&LIST_ITEM_CONTAINS_BLOCK != 0 && bytes.IndexByte(text, '\n') < 0 {
+		out.WriteString("\n\n")
+		prefixLines(out, text, options.indent, options.indent)
+	} else {
+		prefixLines(out, text, " ", options.indent)
+	}
+	out.WriteByte('\n')
+}
+
+func (options *Formatter) AutoLink(out Writer, link []byte, kind int) {
+	out.WriteByte('<')
+	out.Write(link)
+	out.WriteByte('>')
+}
+
+func (options *Formatter) CodeSpan(out Writer, text []byte) {
+	if len(text) == 0 {
+		return
+	}
+	marker := fence(text, '`', 1)
+	out.WriteString(marker)
+	if text[0] == '`' {
+		out.WriteByte(' ')
+	}
+	out.Write(text)
+	if text[len(text)-1] == '`' {
+		out.WriteByte(' ')
+	}
+	out.WriteString(marker)
+}
+
+// emphasize writes 'text' between markers made of 'c', or of 'alt' if 'text'
+// already has markers of 'c' in it.
+func emphasize(out Writer, text []byte, c, alt byte, n int) {
+	for i := range text {
+		if text[i] == c && !isBackslashEscaped(text, i) {
+			c = alt
+			break
+		}
+	}
+	marker := bytes.Repeat([]byte{c}, n)
+	out.Write(marker)
+	out.Write(text)
+	out.Write(marker)
+}
+
+func (options *Formatter) MathSpan(out Writer, text []byte, display bool) {
+	delim := "$"
+	if display {
+		delim = "$$"
+	}
+	out.WriteString(delim)
+	out.Write(text)
+	out.WriteString(delim)
+}
+
+func (options *Formatter) DoubleEmphasis(out Writer, text []byte) {
+	emphasize(out, text, '*', '_', 2)
+}
+
+func (options *Formatter) Emphasis(out Writer, text []byte) {
+	emphasize(out, text, '_', '*', 1)
+}
+
+func (options *Formatter) TripleEmphasis(out Writer, text []byte) {
+	emphasize(out, text, '*', '_', 3)
+}
+
+func (options *Formatter) StrikeThrough(out Writer, text []byte) {
+	out.WriteString("~~")
+	out.Write(text)
+	out.WriteString("~~")
+}
+
+// escapeLink escapes what would end a link destination, or be taken out of
+// it.
+func escapeLink(out Writer, link []byte) {
+	for _, c := range link {
+		switch c {
+		case '\\', '(', ')', '<', '>', '\'', '"', ' ':
+			out.WriteByte('\\')
+		}
+		out.WriteByte(c)
+	}
+}
+
+func (options *Formatter) Image(out Writer, link []byte, title []byte, alt []byte) {
+	out.WriteString("![")
+	out.Write(alt)
+	out.WriteString("](")
+	escapeLink(out, link)
+	if len(title) > 0 {
+		out.WriteString(` "`)
+		out.Write(title)
+		out.WriteByte('"')
+	}
+	out.WriteByte(')')
+}
+
+func (options *Formatter) LineBreak(out Writer) {
+	out.WriteString("  \n")
+	options.textOut, options.textEnd = out, len(written(out))
+}
+
+func (options *Formatter) Link(out Writer, link []byte, title []byte, content []byte) {
+	out.WriteByte('[')
+	out.Write(content)
+	out.WriteByte(']')
+
+	// a reference can't have a title spanning lines, nor whitespace in
+	// its destination
+	if bytes.IndexByte(title, '\n') >= 0 || bytes.IndexAny(link, " \t\n") >= 0 {
+		out.WriteByte('(')
+		escapeLink(out, link)
+		if len(title) > 0 {
+			out.WriteString(` "`)
+			out.Write(title)
+			out.WriteByte('"')
+		}
+		out.WriteByte(')')
+		return
+	}
+
+	key := formatterLink{string(link), string(title)}
+	id, found := options.linkIDs[key]
+	if !found {
+		id = options.linkID(len(options.links) + 1)
+		for options.notes[id] {
+			id += "-"
+		}
+		options.links = append(options.links, key)
+		options.linkIDs[key] = id
+	}
+	out.WriteByte('[')
+	out.WriteString(id)
+	out.WriteByte(']')
+}
+
+// linkID makes the id of the nth reference link. With footnotes, whose
+// names share the ids of links and are often numbers, the ids of links are
+// set apart.
+func (options *Formatter) linkID(n int) string {
+	if options.extensions&EXTENSION_FOOTNOTES != 0 {
+		return "link-" + strconv.Itoa(n)
+	}
+	return strconv.Itoa(n)
+}
+
+func (options *Formatter) RawHtmlTag(out Writer, text []byte) {
+	out.Write(text)
+}
+
+func (options *Formatter) FootnoteRef(out Writer, ref []byte, id int) {
+	options.notes[string(bytes.ToLower(ref))] = true
+	out.WriteString("[^")
+	out.Write(ref)
+	out.WriteByte(']')
+}
+
+// InlineNote writes an inline footnote back where it is referenced.
+func (options *Formatter) InlineNote(out Writer, text func() bool, id int) {
+	out.WriteString("^[")
+	text()
+	out.WriteByte(']')
+}
+
+// Abbreviation writes the abbreviation, and keeps what it stands for to
+// define it at the bottom.
+func (options *Formatter) Abbreviation(out Writer, abbr []byte, title []byte) {
+	if _, found := options.abbrs[string(abbr)]; !found {
+		options.abbrNames = append(options.abbrNames, string(abbr))
+		options.abbrs[string(abbr)] = string(title)
+	}
+	options.NormalText(out, abbr)
+}
+
+func (options *Formatter) Entity(out Writer, entity []byte) {
+	out.Write(entity)
+}
+
+func (options *Formatter) NormalText(out Writer, text []byte) {
+	for i, c := range text {
+		switch {
+		case c == '\\', c == '`', c == '*', c == '_', c == '[', c == ']', c == '<':
+			out.WriteByte('\\')
+		case c == '~' && options.extensions&EXTENSION_STRIKETHROUGH != 0,
+			c == '|' && options.extensions&EXTENSION_TABLES != 0,
+			c == '$' && options.extensions&EXTENSION_MATH != 0:
+			out.WriteByte('\\')
+		case c == '&' && isEntity(text[i:]):
+			out.WriteByte('\\')
+		case c == ':' && options.extensions&EXTENSION_AUTOLINK != 0 && bytes.HasPrefix(text[i+1:], []byte("//")):
+			out.WriteByte('\\')
+
+		// what would start a block at the start of a line
+		case c == '#', c == '>', c == '+', c == '-':
+			if lineStart(written(out), false) {
+				out.WriteByte('\\')
+			}
+		case c == '.':
+			if lineStart(written(out), true) {
+				out.WriteByte('\\')
+			}
+		}
+		out.WriteByte(c)
+	}
+	if len(text) > 0 && text[len(text)-1] == '\n' {
+		options.textOut, options.textEnd = out, len(written(out))
+	}
+}
+
+// lineStart tells if the line at the end of 'data' has nothing but spaces
+// in it so far, or if 'number' is set, nothing but spaces and a number.
+func lineStart(data []byte, number bool) bool {
+	i := len(data)
+	if number {
+		for i > 0 && data[i-1] >= '0' && data[i-1] <= '9' {
+			i--
+		}
+		if i == len(data) {
+			return false
+		}
+	}
+	for i > 0 && data[i-1] == ' ' {
+		i--
+	}
+	return i == 0 || data[i-1] == '\n'
+}
+
+// isEntity tells if 'data' starts with something that would be taken for an
+// entity.
+func isEntity(data []byte) bool {
+	end := 1
+	if end < len(data) && data[end] == '#' {
+		end++
+	}
+	for end < len(data) && isalnum(data[end]) {
+		end++
+	}
+	return end < len(data) && data[end] == ';'
+}
+
+func (options *Formatter) DocumentHeader(out Writer) {
+}
+
+func (options *Formatter) DocumentFooter(out Writer) {
+	if len(options.links) == 0 && len(options.abbrNames) == 0 {
+		return
+	}
+	options.startBlock(out)
+	for _, link := range options.links {
+		out.WriteByte('[')
+		out.WriteString(options.linkIDs[link])
+		out.WriteString("]: ")
+		for i := 0; i < len(link.link); i++ {
+			if c := link.link[i]; c == '\\' || i == 0 && c == '<' {
+				out.WriteByte('\\')
+			}
+			out.WriteByte(link.link[i])
+		}
+		if link.title != "" {
+			out.WriteString(` "`)
+			out.WriteString(link.title)
+			out.WriteByte('"')
+		}
+		out.WriteByte('\n')
+	}
+	for _, abbr := range options.abbrNames {
+		out.WriteString("*[")
+		out.WriteString(abbr)
+		out.WriteString("]:")
+		if title := options.abbrs[abbr]; title != "" {
+			out.WriteByte(' ')
+			out.WriteString(title)
+		}
+		out.WriteByte('\n')
+	}
+}
@@ -0,0 +1,210 @@
+//
+// Blackfriday Markdown Processor
+// Available at http://github.com/russross/blackfriday
+//
+// Copyright © 2011 Russ Ross <russ@russross.com>.
+// Distributed under the Simplified BSD License.
+// See README.md for details.
+//
+
+//
+// Unit tests for Markdown output
+//
+
+package blackfriday
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func runFormatter(input string, extensions Extensions) string {
+	output, err := MarkdownE([]byte(input), WithRenderer(MarkdownRenderer(extensions)),
+		WithExtensions(extensions))
+	if err != nil {
+		panic(err)
+	}
+	return string(output)
+}
+
+func doTestsFormatter(t *testing.T, tests []string, extensions Extensions) {
+	for i := 0; i+1 < len(tests); i += 2 {
+		input, expected := tests[i], tests[i+1]
+		if actual := runFormatter(input, extensions); actual != expected {
+			t.Errorf("\nInput   [%#v]\nExpected[%#v]\nActual  [%#v]",
+				input, expected, actual)
+		}
+	}
+}
+
+func TestFormatterBlocks(t *testing.T) {
+	var tests = []string{
+		"Header\n======\n\nSub\n---\n\n#### Small ####\n",
+		"# Header\n\n## Sub\n\n#### Small\n",
+
+		"+ one\n+ two\n+ three\n",
+		"* one\n* two\n* three\n",
+
+		"- one\n\n- two\n",
+		"* one\n\n* two\n",
+
+		"1) a\n\n3. b\n7. c\n",
+		"1) a\n\n1. b\n2. c\n",
+
+		"* a\n\n    para\n* b\n",
+		"* a\n\n    para\n\n* b\n",
+
+		"* a\n    * b\n    * c\n",
+		"* a\n    * b\n    * c\n",
+
+		"    code\n\n~~~ go\nfunc f() {}\n~~~\n",
+		"```\ncode\n```\n\n```go\nfunc f() {}\n```\n",
+
+		"> quote\n>\n> more\n",
+		"> quote\n>\n> more\n",
+
+		"---\n\n___\n",
+		"* * *\n\n* * *\n",
+
+		"a|b\n:---|---:\nlonger|c\n",
+		"| a      |   b |\n|:-------|----:|\n| longer |   c |\n",
+	}
+	doTestsFormatter(t, tests, commonExtensions)
+}
+
+func TestFormatterInline(t *testing.T) {
+	var tests = []string{
+		"*em* __strong__ ***both*** ~~gone~~\n",
+		"_em_ **strong** ***both*** ~~gone~~\n",
+
+		"`code` `` a`b `` `` `tick ``\n",
+		"`code` ``a`b`` `` `tick``\n",
+
+		"1\\. not a list, a \\* b, 2 \\< 3\n",
+		"1\\. not a list, a \\* b, 2 \\< 3\n",
+
+		"[inline](/url \"Title\") and [ref][x] and [again](/url \"Title\")\n\n[x]: /other\n",
+		"[inline][1] and [ref][2] and [again][1]\n\n[1]: /url \"Title\"\n[2]: /other\n",
+
+		"![alt](/img.png) and <http://example.com/>\n",
+		"![alt](/img.png) and <http://example.com/>\n",
+	}
+	doTestsFormatter(t, tests, commonExtensions)
+}
+
+func TestFormatterFootnotes(t *testing.T) {
+	var tests = []string{
+		"Text[^a] and [link](/url).\n\n[^a]: The note.\n",
+		"Text[^a] and [link][link-1].\n\n[^a]: The note.\n\n[link-1]: /url\n",
+
+		"Text[^1].\n\n[^1]: First paragraph.\n\n    Second paragraph.\n",
+		"Text[^1].\n\n[^1]: First paragraph.\n\n    Second paragraph.\n",
+
+		"Twice[^a], inline^[*note*], twice[^a].\n\n[^a]: The note.\n",
+		"Twice[^a], inline^[_note_], twice[^a].\n\n[^a]: The note.\n",
+
+		"Only^[inline ^[nested]] notes.\n",
+		"Only^[inline ^[nested]] notes.\n",
+	}
+	doTestsFormatter(t, tests, commonExtensions|EXTENSION_FOOTNOTES)
+}
+
+func TestFormatterInlineNotes(t *testing.T) {
+	var tests = []string{
+		"a^[one] b[^one]\n\n[^one]: two\n",
+		"Inline^[with [a link](/url)] and[^1] named^[^[nested]] notes.\n\n[^1]: named\n",
+	}
+	extensions := commonExtensions | EXTENSION_FOOTNOTES
+	html := HtmlRenderer(0, "", "")
+	for _, input := range tests {
+		expected := string(Markdown([]byte(input), WithRenderer(html), WithExtensions(extensions)))
+		formatted := runFormatter(input, extensions)
+		actual := string(Markdown([]byte(formatted), WithRenderer(html), WithExtensions(extensions)))
+		if actual != expected {
+			t.Errorf("\nInput   [%#v]\nFormatted[%#v]\nExpected[%#v]\nActual  [%#v]",
+				input, formatted, expected, actual)
+		}
+	}
+}
+
+func TestFormatterTaskList(t *testing.T) {
+	var tests = []string{
+		"- [ ] todo\n- [X] done\n- \\[ ] text\n",
+		"* [ ] todo\n* [x] done\n* \\[ \\] text\n",
+	}
+	doTestsFormatter(t, tests, commonExtensions|EXTENSION_TASK_LISTS)
+}
+
+func TestFormatterListStart(t *testing.T) {
+	var tests = []string{
+		"3. a\n7. b\n",
+		"3. a\n4. b\n",
+
+		"0) a\n",
+		"0. a\n",
+
+		"1. a\n2. b\n",
+		"1. a\n2. b\n",
+	}
+	doTestsFormatter(t, tests, EXTENSION_COMMONMARK)
+}
+
+func TestFormatterDefinitionList(t *testing.T) {
+	var tests = []string{
+		"Apple\n: Pomaceous\nfruit.\n\nOrange\nCitrus\n: The fruit.\n: A color.\n",
+		"Apple\n:   Pomaceous\n    fruit.\n\nOrange\nCitrus\n:   The fruit.\n:   A color.\n",
+
+		"Term\n\n: One.\n\n    Two.\n\nNext\n: *def*\n",
+		"Term\n\n:   One.\n\n    Two.\n\nNext\n:   _def_\n",
+	}
+	doTestsFormatter(t, tests, EXTENSION_DEFINITION_LISTS)
+}
+
+func TestFormatterAbbreviations(t *testing.T) {
+	var tests = []string{
+		"*[HTML]: Hyper Text Markup Language\n*[W3C]: World Wide Web Consortium\n*[X]: unused\n\nThe W3C makes HTML.\n",
+		"The W3C makes HTML.\n\n*[W3C]: World Wide Web Consortium\n*[HTML]: Hyper Text Markup Language\n",
+	}
+	doTestsFormatter(t, tests, EXTENSION_ABBREVIATIONS)
+}
+
+func TestFormatterMath(t *testing.T) {
+	var tests = []string{
+		"$$ a_1 $$\n\nLet $x_1 * y$ cost \\$5, not $5.\n",
+		"$$\na_1\n$$\n\nLet $x_1 * y$ cost \\$5, not \\$5.\n",
+
+		// display math in the text stays display math
+		"Then $$ a_1 $$ follows.\n",
+		"Then $$a_1$$ follows.\n",
+	}
+	doTestsFormatter(t, tests, EXTENSION_MATH)
+}
+
+func TestFormatterReference(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.text"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, extensions := range []Extensions{0, commonExtensions | EXTENSION_FOOTNOTES} {
+		for _, filename := range files {
+			input, err := ioutil.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			html := HtmlRenderer(0, "", "")
+			expected := string(Markdown(input, WithRenderer(html), WithExtensions(extensions)))
+
+			formatted := runFormatter(string(input), extensions)
+			actual := string(Markdown([]byte(formatted), WithRenderer(html), WithExtensions(extensions)))
+			if actual != expected {
+				t.Errorf("%s: formatted document renders differently\nExpected[%#v]\nActual  [%#v]",
+					filename, expected, actual)
+			}
+			if again := runFormatter(formatted, extensions); again != formatted {
+				t.Errorf("%s: formatting is not idempotent\nExpected[%#v]\nActual  [%#v]",
+					filename, formatted, again)
+			}
+		}
+	}
+}
@@ -23,25 +23,30 @@ import (
 	"strings"
 )
 
+// HtmlFlags is a set of HTML_* flags that control the output of the Html
+// renderer.
+type HtmlFlags int
+
 // Html renderer configuration options.
 const (
-	HTML_SKIP_HTML                 = 1 << iota // skip preformatted HTML blocks
-	HTML_SKIP_STYLE                            // skip embedded <style> elements
-	HTML_SKIP_IMAGES                           // skip embedded images
-	HTML_SKIP_LINKS                            // skip all links
-	HTML_SAFELINK                              // only link to trusted protocols
-	HTML_NOFOLLOW_LINKS                        // only link with rel="nofollow"
-	HTML_NOREFERRER_LINKS                      // only link with rel="noreferrer"
-	HTML_HREF_TARGET_BLANK                     // add a blank target
-	HTML_TOC                                   // generate a table of contents
-	HTML_OMIT_CONTENTS                         // skip the main contents (for a standalone table of contents)
-	HTML_COMPLETE_PAGE                         // generate a complete HTML page
-	HTML_USE_XHTML                             // generate XHTML output instead of HTML
-	HTML_USE_SMARTYPANTS                       // enable smart punctuation substitutions
-	HTML_SMARTYPANTS_FRACTIONS                 // enable smart fractions (with HTML_USE_SMARTYPANTS)
-	HTML_SMARTYPANTS_LATEX_DASHES              // enable LaTeX-style dashes (with HTML_USE_SMARTYPANTS)
-	HTML_SMARTYPANTS_ANGLED_QUOTES             // enable angled double quotes (with HTML_USE_SMARTYPANTS) for double quotes rendering
-	HTML_FOOTNOTE_RETURN_LINKS                 // generate a link at the end of a footnote to return to the source
+	HTML_SKIP_HTML                 HtmlFlags = 1 << iota // skip preformatted HTML blocks
+	HTML_SKIP_STYLE                                      // skip embedded <style> elements
+	HTML_SKIP_IMAGES                                     // skip embedded images
+	HTML_SKIP_LINKS                                      // skip all links
+	HTML_SAFELINK                                        // only link to trusted protocols
+	HTML_NOFOLLOW_LINKS                                  // only link with rel="nofollow"
+	HTML_NOREFERRER_LINKS                                // only link with rel="noreferrer"
+	HTML_HREF_TARGET_BLANK                               // add a blank target
+	HTML_TOC                                             // generate a table of contents
+	HTML_OMIT_CONTENTS                                   // skip the main contents (for a standalone table of contents)
+	HTML_COMPLETE_PAGE                                   // generate a complete HTML page
+	HTML_USE_XHTML                                       // generate XHTML output instead of HTML
+	HTML_USE_SMARTYPANTS                                 // enable smart punctuation substitutions
+	HTML_SMARTYPANTS_FRACTIONS                           // enable smart fractions (with HTML_USE_SMARTYPANTS)
+	HTML_SMARTYPANTS_LATEX_DASHES                        // enable LaTeX-style dashes (with HTML_USE_SMARTYPANTS)
+	HTML_SMARTYPANTS_ANGLED_QUOTES                       // enable angled double quotes (with HTML_USE_SMARTYPANTS) for double quotes rendering
+	HTML_FOOTNOTE_RETURN_LINKS                           // generate a link at the end of a footnote to return to the source
+	HTML_SOURCEPOS                                       // add data-sourcepos attributes with the input position to block elements
 )
 
 var (
@@ -69,19 +74,65 @@ type HtmlRendererParameters struct {
 	HeaderIDPrefix string
 	// If set, add this text to the back of each Header ID, to ensure uniqueness.
 	HeaderIDSuffix string
+	// Render the elements of these node types with these hooks instead.
+	Hooks map[NodeType]NodeHook
 }
 
 // Html is a type that implements the Renderer interface for HTML output.
 //
-// Do not create this directly, instead use the HtmlRenderer function.
+// Do not create this directly, instead use the HtmlRenderer or NewHtml
+// functions.
+//
+// To change how some elements are rendered, give hooks for their node types
+// in the Hooks of the HtmlRendererParameters; everything else, including the
+// table of contents and smartypants, works as before. Calling render renders
+// the element the usual way:
+//
+//	params := blackfriday.HtmlRendererParameters{
+//		Hooks: map[blackfriday.NodeType]blackfriday.NodeHook{
+//			blackfriday.Link: func(out blackfriday.Writer, node *blackfriday.Node, contents, render func()) {
+//				render()
+//				out.WriteString(" ↗")
+//			},
+//		},
+//	}
+//	renderer := blackfriday.HtmlRendererWithParameters(0, "", "", params)
+//
+// An *Html can also be embedded in a type of your own, which overrides some
+// of its methods:
+//
+//	type myRenderer struct {
+//		*blackfriday.Html
+//	}
+//
+//	func (r myRenderer) Link(out blackfriday.Writer, link, title, content []byte) {
+//		r.Html.Link(out, link, title, content)
+//		out.WriteString(" ↗")
+//	}
+//
+// Such a renderer needs a NewDocument method of its own, which wraps the one
+// of the embedded *Html; without it, rendering fails with a *RendererError:
+//
+//	func (r myRenderer) NewDocument() blackfriday.Renderer {
+//		return myRenderer{r.Html.NewDocument().(*blackfriday.Html)}
+//	}
 type Html struct {
-	flags    int    // HTML_* options
-	closeTag string // how to end singleton tags: either " />\n" or ">\n"
-	title    string // document title
-	css      string // optional css file url (used with HTML_COMPLETE_PAGE)
+	flags    HtmlFlags // HTML_* options
+	closeTag string    // how to end singleton tags: either " />\n" or ">\n"
+	title    string    // document title
+	css      string    // optional css file url (used with HTML_COMPLETE_PAGE)
 
 	parameters HtmlRendererParameters
 
+	smartypants *smartypantsRenderer
+
+	// what is left over from rendering the current document
+	*htmlState
+}
+
+// htmlState is what an Html renderer keeps track of while it renders a
+// document.
+type htmlState struct {
 	// table of contents data
 	tocMarker    int
 	headerCount  int
@@ -91,7 +142,15 @@ type Html struct {
 	// Track header IDs to prevent ID collision in a single generation.
 	headerIDs map[string]int
 
-	smartypants *smartypantsRenderer
+	// the block element being rendered, for HTML_SOURCEPOS
+	sourceNode *Node
+}
+
+func newHtmlState() *htmlState {
+	return &htmlState{
+		toc:       new(bytes.Buffer),
+		headerIDs: make(map[string]int),
+	}
 }
 
 const (
@@ -106,12 +165,18 @@ const (
 // title is the title of the document, and css is a URL for the document's
 // stylesheet.
 // title and css are only used when HTML_COMPLETE_PAGE is selected.
-func HtmlRenderer(flags int, title string, css string) Renderer {
+func HtmlRenderer(flags HtmlFlags, title string, css string) Renderer {
 	return HtmlRendererWithParameters(flags, title, css, HtmlRendererParameters{})
 }
 
-func HtmlRendererWithParameters(flags int, title string,
+func HtmlRendererWithParameters(flags HtmlFlags, title string,
 	css string, renderParameters HtmlRendererParameters) Renderer {
+	return NewHtml(flags, title, css, renderParameters)
+}
+
+// NewHtml is like HtmlRendererWithParameters, but it returns the *Html
+// itself, for embedding in a renderer that overrides some of its methods.
+func NewHtml(flags HtmlFlags, title string, css string, renderParameters HtmlRendererParameters) *Html {
 	// configure the rendering engine
 	closeTag := htmlClose
 	if flags&HTML_USE_XHTML != 0 {
@@ -129,16 +194,38 @@ func HtmlRendererWithParameters(flags int, title string,
 		css:        css,
 		parameters: renderParameters,
 
-		headerCount:  0,
-		currentLevel: 0,
-		toc:          new(bytes.Buffer),
-
-		headerIDs: make(map[string]int),
-
 		smartypants: smartypants(flags),
+
+		htmlState: newHtmlState(),
 	}
 }
 
+// NewDocument returns a renderer with the same configuration, to render a
+// single document with. Markdown, Render and RenderTree do this for every
+// document, so one Html renderer can be shared by many goroutines.
+func (options *Html) NewDocument() Renderer {
+	r := *options
+	r.Reset()
+	return &r
+}
+
+// NodeHook returns the hook in the parameters for the type of the node, if
+// there is one.
+func (options *Html) NodeHook(node *Node) NodeHook {
+	return options.parameters.Hooks[node.Type]
+}
+
+func (options *Html) base() Renderer {
+	return options
+}
+
+// Reset forgets about the documents rendered so far, like the header ids
+// already taken, so that the next document starts afresh. It is only needed
+// when calling the renderer directly.
+func (options *Html) Reset() {
+	options.htmlState = newHtmlState()
+}
+
 // Using if statements is a bit faster than a switch statement. As the compiler
 // improves, this should be unnecessary this is only worthwhile because
 // attrEscape is the single largest CPU user in normal use.
@@ -159,7 +246,7 @@ func escapeSingleChar(char byte) (string, bool) {
 	return "", false
 }
 
-func attrEscape(out *bytes.Buffer, src []byte) {
+func attrEscape(out Writer, src []byte) {
 	org := 0
 	for i, ch := range src {
 		if entity, ok := escapeSingleChar(ch); ok {
@@ -176,7 +263,7 @@ func attrEscape(out *bytes.Buffer, src []byte) {
 	}
 }
 
-func entityEscapeWithSkip(out *bytes.Buffer, src []byte, skipRanges [][]int) {
+func entityEscapeWithSkip(out Writer, src []byte, skipRanges [][]int) {
 	end := 0
 	for _, rang := range skipRanges {
 		attrEscape(out, src[end:rang[0]])
@@ -187,10 +274,59 @@ func entityEscapeWithSkip(out *bytes.Buffer, src []byte, skipRanges [][]int) {
 }
 
 func (options *Html) GetFlags() int {
-	return options.flags
+	return int(options.flags)
+}
+
+// SourcePos remembers the block element that is rendered by render, so that
+// its opening tag gets a data-sourcepos attribute with the HTML_SOURCEPOS
+// flag.
+func (options *Html) SourcePos(out Writer, node *Node, render func()) {
+	outer := options.sourceNode
+	options.sourceNode = node
+	render()
+	options.sourceNode = outer
 }
 
-func (options *Html) TitleBlock(out *bytes.Buffer, text []byte) {
+// sourcePos returns the data-sourcepos attribute for the opening tag of the
+// block element being rendered, if it gets one. The end column is that of
+// the last byte of the element, like in CommonMark.
+func (options *Html) sourcePos() string {
+	node := options.sourceNode
+	if options.flags&HTML_SOURCEPOS == 0 || node == nil || !hasSourcePos(node) {
+		return ""
+	}
+	// only the first tag of the element gets it
+	options.sourceNode = nil
+
+	endCol := node.End.Column
+	if endCol > 1 {
+		endCol--
+	}
+	return fmt.Sprintf(" data-sourcepos=\"%d:%d-%d:%d\"",
+		node.Start.Line, node.Start.Column, node.End.Line, endCol)
+}
+
+// hasSourcePos tells if the element rendered for a node gets a
+// data-sourcepos attribute.
+func hasSourcePos(node *Node) bool {
+	switch node.Type {
+	case Paragraph, Header, CodeBlock, MathBlock, BlockQuote, Table:
+		return true
+	case Item:
+		return node.Parent == nil || node.Parent.Type != Footnotes
+	}
+	return false
+}
+
+// MathBlock writes display math the way MathJax and KaTeX look for it.
+func (options *Html) MathBlock(out Writer, text []byte) {
+	doubleSpace(out)
+	out.WriteString("<p" + options.sourcePos() + "><span class=\"math display\">\\[")
+	attrEscape(out, text)
+	out.WriteString("\\]</span></p>\n")
+}
+
+func (options *Html) TitleBlock(out Writer, text []byte) {
 	text = bytes.TrimPrefix(text, []byte("% "))
 	text = bytes.Replace(text, []byte("\n% "), []byte("\n"), -1)
 	out.WriteString("<h1 class=\"title\">")
@@ -198,8 +334,8 @@ func (options *Html) TitleBlock(out *bytes.Buffer, text []byte) {
 	out.WriteString("\n</h1>")
 }
 
-func (options *Html) Header(out *bytes.Buffer, text func() bool, level int, id string) {
-	marker := out.Len()
+func (options *Html) Header(out Writer, text func() bool, level int, id string) {
+	marker := len(written(out))
 	doubleSpace(out)
 
 	if id == "" && options.flags&HTML_TOC != 0 {
@@ -217,26 +353,26 @@ func (options *Html) Header(out *bytes.Buffer, text func() bool, level int, id s
 			id = id + options.parameters.HeaderIDSuffix
 		}
 
-		out.WriteString(fmt.Sprintf("<h%d id=\"%s\">", level, id))
+		out.WriteString(fmt.Sprintf("<h%d id=\"%s\"%s>", level, id, options.sourcePos()))
 	} else {
-		out.WriteString(fmt.Sprintf("<h%d>", level))
+		out.WriteString(fmt.Sprintf("<h%d%s>", level, options.sourcePos()))
 	}
 
-	tocMarker := out.Len()
+	tocMarker := len(written(out))
 	if !text() {
-		out.Truncate(marker)
+		rollback(out, marker)
 		return
 	}
 
 	// are we building a table of contents?
 	if options.flags&HTML_TOC != 0 {
-		options.TocHeaderWithAnchor(out.Bytes()[tocMarker:], level, id)
+		options.TocHeaderWithAnchor(written(out)[tocMarker:], level, id)
 	}
 
 	out.WriteString(fmt.Sprintf("</h%d>\n", level))
 }
 
-func (options *Html) BlockHtml(out *bytes.Buffer, text []byte) {
+func (options *Html) BlockHtml(out Writer, text []byte) {
 	if options.flags&HTML_SKIP_HTML != 0 {
 		return
 	}
@@ -246,14 +382,15 @@ func (options *Html) BlockHtml(out *bytes.Buffer, text []byte) {
 	out.WriteByte('\n')
 }
 
-func (options *Html) HRule(out *bytes.Buffer) {
+func (options *Html) HRule(out Writer) {
 	doubleSpace(out)
 	out.WriteString("<hr")
 	out.WriteString(options.closeTag)
 }
 
-func (options *Html) BlockCode(out *bytes.Buffer, text []byte, lang string) {
+func (options *Html) BlockCode(out Writer, text []byte, lang string) {
 	doubleSpace(out)
+	pos := options.sourcePos()
 
 	// parse out the language names/classes
 	count := 0
@@ -265,7 +402,7 @@ func (options *Html) BlockCode(out *bytes.Buffer, text []byte, lang string) {
 			continue
 		}
 		if count == 0 {
-			out.WriteString("<pre><code class=\"language-")
+			out.WriteString("<pre" + pos + "><code class=\"language-")
 		} else {
 			out.WriteByte(' ')
 		}
@@ -274,7 +411,7 @@ func (options *Html) BlockCode(out *bytes.Buffer, text []byte, lang string) {
 	}
 
 	if count == 0 {
-		out.WriteString("<pre><code>")
+		out.WriteString("<pre" + pos + "><code>")
 	} else {
 		out.WriteString("\">")
 	}
@@ -283,30 +420,30 @@ func (options *Html) BlockCode(out *bytes.Buffer, text []byte, lang string) {
 	out.WriteString("</code></pre>\n")
 }
 
-func (options *Html) BlockQuote(out *bytes.Buffer, text []byte) {
+func (options *Html) BlockQuote(out Writer, text []byte) {
 	doubleSpace(out)
-	out.WriteString("<blockquote>\n")
+	out.WriteString("<blockquote" + options.sourcePos() + ">\n")
 	out.Write(text)
 	out.WriteString("</blockquote>\n")
 }
 
-func (options *Html) Table(out *bytes.Buffer, header []byte, body []byte, columnData []int) {
+func (options *Html) Table(out Writer, header []byte, body []byte, columnData []int) {
 	doubleSpace(out)
-	out.WriteString("<table>\n<thead>\n")
+	out.WriteString("<table" + options.sourcePos() + ">\n<thead>\n")
 	out.Write(header)
 	out.WriteString("</thead>\n\n<tbody>\n")
 	out.Write(body)
 	out.WriteString("</tbody>\n</table>\n")
 }
 
-func (options *Html) TableRow(out *bytes.Buffer, text []byte) {
+func (options *Html) TableRow(out Writer, text []byte) {
 	doubleSpace(out)
 	out.WriteString("<tr>\n")
 	out.Write(text)
 	out.WriteString("\n</tr>\n")
 }
 
-func (options *Html) TableHeaderCell(out *bytes.Buffer, text []byte, align int) {
+func (options *Html) TableHeaderCell(out Writer, text []byte, align int) {
 	doubleSpace(out)
 	switch align {
 	case TABLE_ALIGNMENT_LEFT:
@@ -323,7 +460,7 @@ func (options *Html) TableHeaderCell(out *bytes.Buffer, text []byte, align int)
 	out.WriteString("</th>")
 }
 
-func (options *Html) TableCell(out *bytes.Buffer, text []byte, align int) {
+func (options *Html) TableCell(out Writer, text []byte, align int) {
 	doubleSpace(out)
 	switch align {
 	case TABLE_ALIGNMENT_LEFT:
@@ -340,14 +477,14 @@ func (options *Html) TableCell(out *bytes.Buffer, text []byte, align int) {
 	out.WriteString("</td>")
 }
 
-func (options *Html) Footnotes(out *bytes.Buffer, text func() bool) {
+func (options *Html) Footnotes(out Writer, text func() bool) {
 	out.WriteString("<div class=\"footnotes\">\n")
 	options.HRule(out)
 	options.List(out, text, LIST_TYPE_ORDERED)
 	out.WriteString("</div>\n")
 }
 
-func (options *Html) FootnoteItem(out *bytes.Buffer, name, text []byte, flags int) {
+func (options *Html) FootnoteItem(out Writer, name, text []byte, flags int) {
 	if flags&LIST_ITEM_CONTAINS_BLOCK != 0 || flags&LIST_ITEM_BEGINNING_OF_LIST != 0 {
 		doubleSpace(out)
 	}
@@ -370,17 +507,28 @@ func (options *Html) FootnoteItem(out *bytes.Buffer, name, text []byte, flags in
 	out.WriteString("</li>\n")
 }
 
-func (options *Html) List(out *bytes.Buffer, text func() bool, flags int) {
-	marker := out.Len()
+func (options *Html) List(out Writer, text func() bool, flags int) {
+	options.ListStart(out, text, flags&^LIST_START, 1)
+}
+
+// ListStart writes an ordered list that doesn't start at 1 with a start
+// attribute.
+func (options *Html) ListStart(out Writer, text func() bool, flags int, start int) {
+	marker := len(written(out))
 	doubleSpace(out)
 
-	if flags&LIST_TYPE_ORDERED != 0 {
-		out.WriteString("<ol>")
-	} else {
+	switch {
+	case flags&LIST_TYPE_ORDERED == 0:
 		out.WriteString("<ul>")
+	case flags&LIST_START != 0:
+		out.WriteString(`<ol start="`)
+		out.WriteString(strconv.Itoa(start))
+		out.WriteString(`">`)
+	default:
+		out.WriteString("<ol>")
 	}
 	if !text() {
-		out.Truncate(marker)
+		rollback(out, marker)
 		return
 	}
 	if flags&LIST_TYPE_ORDERED != 0 {
@@ -390,28 +538,71 @@ func (options *Html) List(out *bytes.Buffer, text func() bool, flags int) {
 	}
 }
 
-func (options *Html) ListItem(out *bytes.Buffer, text []byte, flags int) {
+func (options *Html) ListItem(out Writer, text []byte, flags int) {
 	if flags&LIST_ITEM_CONTAINS_BLOCK != 0 || flags&LIST_ITEM_BEGINNING_OF_LIST != 0 {
 		doubleSpace(out)
 	}
-	out.WriteString("<li>")
+	out.WriteString("<li" + options.sourcePos() + ">")
+	if flags&LIST_ITEM_TASK != 0 {
+		options.taskCheckbox(out, flags)
+	}
 	out.Write(text)
 	out.WriteString("</li>\n")
 }
 
-func (options *Html) Paragraph(out *bytes.Buffer, text func() bool) {
-	marker := out.Len()
+func (options *Html) DefinitionList(out Writer, text func() bool, flags int) {
+	marker := len(written(out))
 	doubleSpace(out)
 
-	out.WriteString("<p>")
+	out.WriteString("<dl>\n")
 	if !text() {
-		out.Truncate(marker)
+		rollback(out, marker)
+		return
+	}
+	out.WriteString("</dl>\n")
+}
+
+func (options *Html) DefinitionTerm(out Writer, text []byte, flags int) {
+	out.WriteString("<dt" + options.sourcePos() + ">")
+	out.Write(text)
+	out.WriteString("</dt>\n")
+}
+
+func (options *Html) DefinitionData(out Writer, text []byte, flags int) {
+	if flags&LIST_ITEM_CONTAINS_BLOCK != 0 {
+		doubleSpace(out)
+	}
+	out.WriteString("<dd" + options.sourcePos() + ">")
+	out.Write(text)
+	out.WriteString("</dd>\n")
+}
+
+// taskCheckbox writes the disabled checkbox of a task list item.
+func (options *Html) taskCheckbox(out Writer, flags int) {
+	out.WriteString(`<input type="checkbox" disabled=""`)
+	if flags&LIST_ITEM_CHECKED != 0 {
+		out.WriteString(` checked=""`)
+	}
+	if options.flags&HTML_USE_XHTML != 0 {
+		out.WriteString(" /> ")
+	} else {
+		out.WriteString("> ")
+	}
+}
+
+func (options *Html) Paragraph(out Writer, text func() bool) {
+	marker := len(written(out))
+	doubleSpace(out)
+
+	out.WriteString("<p" + options.sourcePos() + ">")
+	if !text() {
+		rollback(out, marker)
 		return
 	}
 	out.WriteString("</p>\n")
 }
 
-func (options *Html) AutoLink(out *bytes.Buffer, link []byte, kind int) {
+func (options *Html) AutoLink(out Writer, link []byte, kind int) {
 	skipRanges := htmlEntity.FindAllIndex(link, -1)
 	if options.flags&HTML_SAFELINK != 0 && !isSafeLink(link) && kind != LINK_TYPE_EMAIL {
 		// mark it but don't link it if it is not a safe link: no smartypants
@@ -463,19 +654,31 @@ func (options *Html) AutoLink(out *bytes.Buffer, link []byte, kind int) {
 	out.WriteString("</a>")
 }
 
-func (options *Html) CodeSpan(out *bytes.Buffer, text []byte) {
+func (options *Html) CodeSpan(out Writer, text []byte) {
 	out.WriteString("<code>")
 	attrEscape(out, text)
 	out.WriteString("</code>")
 }
 
-func (options *Html) DoubleEmphasis(out *bytes.Buffer, text []byte) {
+func (options *Html) MathSpan(out Writer, text []byte, display bool) {
+	if display {
+		out.WriteString("<span class=\"math display\">\\[")
+		attrEscape(out, text)
+		out.WriteString("\\]</span>")
+		return
+	}
+	out.WriteString("<span class=\"math inline\">\\(")
+	attrEscape(out, text)
+	out.WriteString("\\)</span>")
+}
+
+func (options *Html) DoubleEmphasis(out Writer, text []byte) {
 	out.WriteString("<strong>")
 	out.Write(text)
 	out.WriteString("</strong>")
 }
 
-func (options *Html) Emphasis(out *bytes.Buffer, text []byte) {
+func (options *Html) Emphasis(out Writer, text []byte) {
 	if len(text) == 0 {
 		return
 	}
@@ -484,7 +687,7 @@ func (options *Html) Emphasis(out *bytes.Buffer, text []byte) {
 	out.WriteString("</em>")
 }
 
-func (options *Html) maybeWriteAbsolutePrefix(out *bytes.Buffer, link []byte) {
+func (options *Html) maybeWriteAbsolutePrefix(out Writer, link []byte) {
 	if options.parameters.AbsolutePrefix != "" && isRelativeLink(link) {
 		out.WriteString(options.parameters.AbsolutePrefix)
 		if link[0] != '/' {
@@ -493,7 +696,7 @@ func (options *Html) maybeWriteAbsolutePrefix(out *bytes.Buffer, link []byte) {
 	}
 }
 
-func (options *Html) Image(out *bytes.Buffer, link []byte, title []byte, alt []byte) {
+func (options *Html) Image(out Writer, link []byte, title []byte, alt []byte) {
 	if options.flags&HTML_SKIP_IMAGES != 0 {
 		return
 	}
@@ -515,12 +718,12 @@ func (options *Html) Image(out *bytes.Buffer, link []byte, title []byte, alt []b
 	return
 }
 
-func (options *Html) LineBreak(out *bytes.Buffer) {
+func (options *Html) LineBreak(out Writer) {
 	out.WriteString("<br")
 	out.WriteString(options.closeTag)
 }
 
-func (options *Html) Link(out *bytes.Buffer, link []byte, title []byte, content []byte) {
+func (options *Html) Link(out Writer, link []byte, title []byte, content []byte) {
 	if options.flags&HTML_SKIP_LINKS != 0 {
 		// write the link text out but don't link it, just mark it with typewriter font
 		out.WriteString("<tt>")
@@ -566,7 +769,7 @@ func (options *Html) Link(out *bytes.Buffer, link []byte, title []byte, content
 	return
 }
 
-func (options *Html) RawHtmlTag(out *bytes.Buffer, text []byte) {
+func (options *Html) RawHtmlTag(out Writer, text []byte) {
 	if options.flags&HTML_SKIP_HTML != 0 {
 		return
 	}
@@ -582,19 +785,19 @@ func (options *Html) RawHtmlTag(out *bytes.Buffer, text []byte) {
 	out.Write(text)
 }
 
-func (options *Html) TripleEmphasis(out *bytes.Buffer, text []byte) {
+func (options *Html) TripleEmphasis(out Writer, text []byte) {
 	out.WriteString("<strong><em>")
 	out.Write(text)
 	out.WriteString("</em></strong>")
 }
 
-func (options *Html) StrikeThrough(out *bytes.Buffer, text []byte) {
+func (options *Html) StrikeThrough(out Writer, text []byte) {
 	out.WriteString("<del>")
 	out.Write(text)
 	out.WriteString("</del>")
 }
 
-func (options *Html) FootnoteRef(out *bytes.Buffer, ref []byte, id int) {
+func (options *Html) FootnoteRef(out Writer, ref []byte, id int) {
 	slug := slugify(ref)
 	out.WriteString(`<sup class="footnote-ref" id="`)
 	out.WriteString(`fnref:`)
@@ -609,11 +812,23 @@ func (options *Html) FootnoteRef(out *bytes.Buffer, ref []byte, id int) {
 	out.WriteString(`</a></sup>`)
 }
 
-func (options *Html) Entity(out *bytes.Buffer, entity []byte) {
+func (options *Html) Abbreviation(out Writer, abbr []byte, title []byte) {
+	out.WriteString("<abbr")
+	if len(title) > 0 {
+		out.WriteString(` title="`)
+		attrEscape(out, title)
+		out.WriteString(`"`)
+	}
+	out.WriteString(">")
+	attrEscape(out, abbr)
+	out.WriteString("</abbr>")
+}
+
+func (options *Html) Entity(out Writer, entity []byte) {
 	out.Write(entity)
 }
 
-func (options *Html) NormalText(out *bytes.Buffer, text []byte) {
+func (options *Html) NormalText(out Writer, text []byte) {
 	if options.flags&HTML_USE_SMARTYPANTS != 0 {
 		options.Smartypants(out, text)
 	} else {
@@ -621,7 +836,7 @@ func (options *Html) NormalText(out *bytes.Buffer, text []byte) {
 	}
 }
 
-func (options *Html) Smartypants(out *bytes.Buffer, text []byte) {
+func (options *Html) Smartypants(out Writer, text []byte) {
 	smrt := smartypantsData{false, false}
 
 	// first do normal entity escaping
@@ -650,7 +865,7 @@ func (options *Html) Smartypants(out *bytes.Buffer, text []byte) {
 	}
 }
 
-func (options *Html) DocumentHeader(out *bytes.Buffer) {
+func (options *Html) DocumentHeader(out Writer) {
 	if options.flags&HTML_COMPLETE_PAGE == 0 {
 		return
 	}
@@ -687,10 +902,10 @@ func (options *Html) DocumentHeader(out *bytes.Buffer) {
 	out.WriteString("</head>\n")
 	out.WriteString("<body>\n")
 
-	options.tocMarker = out.Len()
+	options.tocMarker = len(written(out))
 }
 
-func (options *Html) DocumentFooter(out *bytes.Buffer) {
+func (options *Html) DocumentFooter(out Writer) {
 	// finalize and insert the table of contents
 	if options.flags&HTML_TOC != 0 {
 		options.TocFinalize()
@@ -699,10 +914,10 @@ func (options *Html) DocumentFooter(out *bytes.Buffer) {
 		var temp bytes.Buffer
 
 		// start by making a copy of everything after the document header
-		temp.Write(out.Bytes()[options.tocMarker:])
+		temp.Write(written(out)[options.tocMarker:])
 
 		// now clear the copied material from the main output buffer
-		out.Truncate(options.tocMarker)
+		rollback(out, options.tocMarker)
 
 		// corner case spacing issue
 		if options.flags&HTML_COMPLETE_PAGE != 0 {
@@ -867,8 +1082,8 @@ func skipSpace(tag []byte, i int) int {
 	return i
 }
 
-func doubleSpace(out *bytes.Buffer) {
-	if out.Len() > 0 {
+func doubleSpace(out Writer) {
+	if len(written(out)) > 0 {
 		out.WriteByte('\n')
 	}
 }
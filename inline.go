@@ -15,8 +15,12 @@ package blackfriday
 
 import (
 	"bytes"
+	"fmt"
+	"html"
 	"regexp"
 	"strconv"
+	"unicode"
+	"unicode/utf8"
 )
 
 var (
@@ -29,21 +33,26 @@ var (
 // data is the complete block being rendered
 // offset is the number of valid chars before the current cursor
 
-func (p *parser) inline(out *bytes.Buffer, data []byte) {
+func (p *parser) inline(out *Node, data []byte) {
 	// this is called recursively: enforce a maximum depth
 	if p.nesting >= p.maxNesting {
+		p.tooDeep(out, data, false)
 		return
 	}
 	p.nesting++
 
+	// the delimiters of the span are worked out when first needed
+	p.pushSpan(data)
+
 	i, end := 0, 0
 	for i < len(data) {
 		// copy inactive chars into the output
 		for end < len(data) && p.inlineCallback[data[end]] == nil {
 			end++
 		}
+		p.spend(end - i + 1)
 
-		p.r.NormalText(out, data[i:end])
+		out.addText(data[i:end])
 
 		if end >= len(data) {
 			break
@@ -52,21 +61,46 @@ func (p *parser) inline(out *bytes.Buffer, data []byte) {
 
 		// call the trigger
 		handler := p.inlineCallback[data[end]]
+		last := out.LastChild
 		if consumed := handler(p, out, data, i); consumed == 0 {
 			// no action from the callback; buffer the byte for later
 			end = i + 1
 		} else {
 			// skip past whatever the callback used
+			setSource(out, last, data[i:i+consumed])
 			i += consumed
 			end = i
 		}
 	}
 
+	if d := p.spans[len(p.spans)-1]; d.runs != nil {
+		d.matchRuns()
+	}
+	p.popSpan()
 	p.nesting--
 }
 
+// customInline runs a parser added with WithInlineParser, falling back on
+// the built-in one for the same character.
+func customInline(c byte, custom InlineParser, builtin inlineParser) inlineParser {
+	return func(p *parser, out *Node, data []byte, offset int) int {
+		consumed := custom(out, data, offset)
+		switch {
+		case consumed > len(data)-offset:
+			p.fail(fmt.Sprintf("inline parser for %q used %d bytes, only %d were left",
+				c, consumed, len(data)-offset))
+			return len(data) - offset
+		case consumed > 0:
+			return consumed
+		case builtin != nil:
+			return builtin(p, out, data, offset)
+		}
+		return 0
+	}
+}
+
 // single and double emphasis parsing
-func emphasis(p *parser, out *bytes.Buffer, data []byte, offset int) int {
+func emphasis(p *parser, out *Node, data []byte, offset int) int {
 	data = data[offset:]
 	c := data[0]
 	ret := 0
@@ -109,14 +143,68 @@ func emphasis(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 	return 0
 }
 
-func codeSpan(p *parser, out *bytes.Buffer, data []byte, offset int) int {
+// '*' and '_' when following CommonMark: the run of them is kept as text,
+// and whether it can open or close emphasis is noted, for the runs to be
+// matched once the whole span has been parsed
+func delimiterRun(p *parser, out *Node, data []byte, offset int) int {
+	c := data[offset]
+	n := 1
+	for offset+n < len(data) && data[offset+n] == c {
+		n++
+	}
+	p.spend(n)
+
+	// the start and the end of the span count as whitespace
+	before, after := ' ', ' '
+	if offset > 0 {
+		before, _ = utf8.DecodeLastRune(data[:offset])
+	}
+	if offset+n < len(data) {
+		after, _ = utf8.DecodeRune(data[offset+n:])
+	}
+	leftFlanking := !unicode.IsSpace(after) &&
+		(!isPunctRune(after) || unicode.IsSpace(before) || isPunctRune(before))
+	rightFlanking := !unicode.IsSpace(before) &&
+		(!isPunctRune(before) || unicode.IsSpace(after) || isPunctRune(after))
+
+	// underscores don't make emphasis inside words
+	canOpen, canClose := leftFlanking, rightFlanking
+	if c == '_' || p.flags&EXTENSION_NO_INTRA_EMPHASIS != 0 {
+		canOpen = leftFlanking && (!rightFlanking || isPunctRune(before))
+		canClose = rightFlanking && (!leftFlanking || isPunctRune(after))
+	}
+
+	out.addText(data[offset : offset+n])
+	if canOpen || canClose {
+		d, at := p.delimitersFor(data)
+		d.pushRun(&delimRun{
+			node:      out.LastChild,
+			c:         c,
+			at:        at + offset,
+			count:     n,
+			origCount: n,
+			canOpen:   canOpen,
+			canClose:  canClose,
+		})
+	}
+	return n
+}
+
+func codeSpan(p *parser, out *Node, data []byte, offset int) int {
 	data = data[offset:]
 
-	nb := 0
+	// count the number of backticks in the delimiter, and rule out a
+	// closer with a look at the runs of backticks of the span
+	d, at := p.delimitersFor(data)
+	nb := d.tickRun(at)
 
-	// count the number of backticks in the delimiter
-	for nb < len(data) && data[nb] == '`' {
-		nb++
+	if p.flags&EXTENSION_COMMONMARK != 0 {
+		return codeSpanCommonMark(p, out, data, nb, d.closeTicks(at)-at)
+	}
+
+	// no matching delimiter?
+	if d.longestTicks(at+nb) < nb {
+		return 0
 	}
 
 	// find the next delimiter
@@ -128,11 +216,7 @@ func codeSpan(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 			i = 0
 		}
 	}
-
-	// no matching delimiter?
-	if i < nb && end >= len(data) {
-		return 0
-	}
+	p.spend(end - nb)
 
 	// trim outside whitespace
 	fBegin := nb
@@ -147,24 +231,39 @@ func codeSpan(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 
 	// render the code span
 	if fBegin != fEnd {
-		p.r.CodeSpan(out, data[fBegin:fEnd])
+		out.add(CodeSpan).Literal = data[fBegin:fEnd]
 	}
 
 	return end
 
 }
 
+// a code span as CommonMark has it: it ends with a run of exactly as many
+// backticks, the one at 'close', newlines in it become spaces, and one space
+// is taken off each end if there is one on both. A run of backticks that
+// isn't closed is text.
+func codeSpanCommonMark(p *parser, out *Node, data []byte, nb, close int) int {
+	if close >= len(data) {
+		out.addText(data[:nb])
+		return nb
+	}
+	end := close + nb
+	p.spend(end)
+
+	code := bytes.Replace(data[nb:end-nb], []byte("\n"), []byte(" "), -1)
+	if len(code) >= 2 && code[0] == ' ' && code[len(code)-1] == ' ' &&
+		len(bytes.Trim(code, " ")) > 0 {
+		code = code[1 : len(code)-1]
+	}
+	out.add(CodeSpan).Literal = code
+	return end
+}
+
 // newline preceded by two spaces becomes <br>
 // newline without two spaces works when EXTENSION_HARD_LINE_BREAK is enabled
-func lineBreak(p *parser, out *bytes.Buffer, data []byte, offset int) int {
+func lineBreak(p *parser, out *Node, data []byte, offset int) int {
 	// remove trailing spaces from out
-	outBytes := out.Bytes()
-	end := len(outBytes)
-	eol := end
-	for eol > 0 && outBytes[eol-1] == ' ' {
-		eol--
-	}
-	out.Truncate(eol)
+	out.trimTrailingSpace()
 
 	precededByTwoSpaces := offset >= 2 && data[offset-2] == ' ' && data[offset-1] == ' '
 
@@ -173,7 +272,7 @@ func lineBreak(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 		return 0
 	}
 
-	p.r.LineBreak(out)
+	out.add(LineBreak)
 	return 1
 }
 
@@ -187,7 +286,7 @@ const (
 )
 
 // '[': parse a link or an image or a footnote
-func link(p *parser, out *bytes.Buffer, data []byte, offset int) int {
+func link(p *parser, out *Node, data []byte, offset int) int {
 	// no links allowed inside regular links, footnote, and deferred footnotes
 	if p.insideLink && (offset > 0 && data[offset-1] == '[' || len(data)-1 > offset && data[offset+1] == '^') {
 		return 0
@@ -198,7 +297,7 @@ func link(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 	// ^[text] == inline footnote
 	// [^refId] == deferred footnote
 	var t linkType
-	if offset > 0 && data[offset-1] == '!' {
+	if offset > 0 && data[offset-1] == '!' && !isImageEscaped(p, data, offset) {
 		t = linkImg
 	} else if p.flags&EXTENSION_FOOTNOTES != 0 {
 		if offset > 0 && data[offset-1] == '^' {
@@ -207,56 +306,65 @@ func link(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 			t = linkDeferredFootnote
 		}
 	}
+	if p.insideLink && t == linkInlineFootnote {
+		return 0
+	}
 
+	// images and inline footnotes start with the character before the '['
+	source := data
+	d, at := p.delimitersFor(source)
+	at += offset
 	data = data[offset:]
 
 	var (
-		i           = 1
 		noteId      int
 		title, link []byte
-		textHasNl   = false
 	)
 
-	if t == linkDeferredFootnote {
-		i++
-	}
-
 	// look for the matching closing bracket
-	for level := 1; level > 0 && i < len(data); i++ {
-		switch {
-		case data[i] == '\n':
-			textHasNl = true
-
-		case data[i-1] == '\\':
-			continue
-
-		case data[i] == '[':
-			level++
-
-		case data[i] == ']':
-			level--
-			if level <= 0 {
-				i-- // compensate for extra i++ in for loop
-			}
-		}
+	i := d.closeBracket(at) - at
+	if i >= len(data) {
+		return 0
 	}
 
-	if i >= len(data) {
+	// with CommonMark, the innermost of links within each other wins, and
+	// whether these brackets make one has been worked out with the others
+	if t == linkNormal && p.flags&EXTENSION_COMMONMARK != 0 && !d.makesLink(at) {
 		return 0
 	}
+	textHasNl := d.nextByte('\n', at+1) < at+i
+
+	// A reference id can't hold a ']', so a text with brackets in it is
+	// never one. Not looking it up matters: crafting the id takes time in
+	// proportion to the text, for every level of nested brackets.
+	textHasBracket := d.nextByte(']', at+1) < at+i
 
 	txtE := i
 	i++
 
 	// skip any amount of whitespace or newline
 	// (this is much more lax than original markdown syntax)
-	for i < len(data) && isspace(data[i]) {
+	for i < len(data) && isspace(data[i]) && p.flags&EXTENSION_COMMONMARK == 0 {
 		i++
 	}
+	p.spend(i - txtE)
+
+	// footnotes never take a destination, so whatever follows is plain text
+	isNote := t == linkDeferredFootnote || t == linkInlineFootnote
+
+	// CommonMark has rules of its own for the destination and title, and
+	// takes the text for a reference when they don't follow them
+	tail := 0
+	if !isNote && i < len(data) && data[i] == '(' && p.flags&EXTENSION_COMMONMARK != 0 {
+		tail, link, title = linkTailCommonMark(p, d, at+i, data[i:])
+	}
 
-	// inline style link
 	switch {
-	case i < len(data) && data[i] == '(':
+	case tail > 0:
+		i += tail
+
+	// inline style link
+	case !isNote && i < len(data) && data[i] == '(' && p.flags&EXTENSION_COMMONMARK == 0:
 		// skip initial whitespace
 		i++
 
@@ -267,20 +375,7 @@ func link(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 		linkB := i
 
 		// look for link end: ' " )
-	findlinkend:
-		for i < len(data) {
-			switch {
-			case data[i] == '\\':
-				i += 2
-
-			case data[i] == ')' || data[i] == '\'' || data[i] == '"':
-				break findlinkend
-
-			default:
-				i++
-			}
-		}
-
+		i = d.scan(")'\"", at+i) - at
 		if i >= len(data) {
 			return 0
 		}
@@ -292,20 +387,7 @@ func link(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 			i++
 			titleB = i
 
-		findtitleend:
-			for i < len(data) {
-				switch {
-				case data[i] == '\\':
-					i += 2
-
-				case data[i] == ')':
-					break findtitleend
-
-				default:
-					i++
-				}
-			}
-
+			i = d.scan(")", at+i) - at
 			if i >= len(data) {
 				return 0
 			}
@@ -348,15 +430,13 @@ func link(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 		i++
 
 	// reference style link
-	case i < len(data)-1 && data[i] == '[' && data[i+1] != '^':
+	case !isNote && i < len(data)-1 && data[i] == '[' && data[i+1] != '^':
 		var id []byte
 
 		// look for the id
 		i++
 		linkB := i
-		for i < len(data) && data[i] != ']' {
-			i++
-		}
+		i = d.nextByte(']', at+i) - at
 		if i >= len(data) {
 			return 0
 		}
@@ -364,27 +444,16 @@ func link(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 
 		// find the reference
 		if linkB == linkE {
-			if textHasNl {
-				var b bytes.Buffer
-
-				for j := 1; j < txtE; j++ {
-					switch {
-					case data[j] != '\n':
-						b.WriteByte(data[j])
-					case data[j-1] != ' ':
-						b.WriteByte(' ')
-					}
-				}
-
-				id = b.Bytes()
-			} else {
-				id = data[1:txtE]
+			if textHasBracket {
+				return 0
 			}
+			id = refId(data[1:txtE], textHasNl)
 		} else {
 			id = data[linkB:linkE]
 		}
 
 		// find the reference with matching id (ids are case-insensitive)
+		p.spend(len(id))
 		key := string(bytes.ToLower(id))
 		lr, ok := p.refs[key]
 		if !ok {
@@ -401,53 +470,29 @@ func link(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 	default:
 		var id []byte
 
-		// craft the id
-		if textHasNl {
-			var b bytes.Buffer
-
-			for j := 1; j < txtE; j++ {
-				switch {
-				case data[j] != '\n':
-					b.WriteByte(data[j])
-				case data[j-1] != ' ':
-					b.WriteByte(' ')
-				}
-			}
-
-			id = b.Bytes()
-		} else {
-			if t == linkDeferredFootnote {
-				id = data[2:txtE] // get rid of the ^
-			} else {
-				id = data[1:txtE]
-			}
+		if textHasBracket && t != linkInlineFootnote {
+			return 0
 		}
 
+		// craft the id; a deferred footnote keeps its ^, as the
+		// definitions of notes do
+		id = refId(data[1:txtE], textHasNl)
+
+		p.spend(len(id))
 		key := string(bytes.ToLower(id))
 		if t == linkInlineFootnote {
 			// create a new reference
 			noteId = len(p.notes) + 1
 
-			var fragment []byte
-			if len(id) > 0 {
-				if len(id) < 16 {
-					fragment = make([]byte, len(id))
-				} else {
-					fragment = make([]byte, 16)
-				}
-				copy(fragment, slugify(id))
-			} else {
-				fragment = append([]byte("footnote-"), []byte(strconv.Itoa(noteId))...)
-			}
-
 			ref := &reference{
 				noteId:   noteId,
 				hasBlock: false,
-				link:     fragment,
-				title:    id,
+				isInline: true,
+				link:     noteFragment(p, noteId),
+				title:    data[1:txtE],
 			}
 
-			p.notes = append(p.notes, ref)
+			p.addNote(ref)
 
 			link = ref.link
 			title = ref.title
@@ -458,9 +503,10 @@ func link(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 				return 0
 			}
 
-			if t == linkDeferredFootnote {
+			// a note is numbered and listed only the first time it is referenced
+			if t == linkDeferredFootnote && lr.noteId < 0 {
 				lr.noteId = len(p.notes) + 1
-				p.notes = append(p.notes, lr)
+				p.addNote(lr)
 			}
 
 			// keep link and title from reference
@@ -474,59 +520,77 @@ func link(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 		i = txtE + 1
 	}
 
-	// build content: img alt is escaped, link content is parsed
-	var content bytes.Buffer
-	if txtE > 1 {
-		if t == linkImg {
-			content.Write(data[1:txtE])
-		} else {
+	// build content: img alt is escaped, link content is parsed, and footnote
+	// contents are parsed when the notes are listed
+	var content *Node
+	if t == linkImg {
+		content = NewNode(Image)
+		if txtE > 1 && p.flags&EXTENSION_COMMONMARK != 0 {
+			// CommonMark takes the text the markup of the alt stands for
+			alt := NewNode(Paragraph)
+			p.inline(alt, data[1:txtE])
+			content.Literal = plainText(alt)
+		} else if txtE > 1 {
+			content.Literal = data[1:txtE]
+		}
+	} else if t == linkNormal {
+		content = NewNode(Link)
+		if txtE > 1 {
 			// links cannot contain other links, so turn off link parsing temporarily
 			insideLink := p.insideLink
 			p.insideLink = true
-			p.inline(&content, data[1:txtE])
+			p.inline(content, data[1:txtE])
 			p.insideLink = insideLink
 		}
 	}
 
 	var uLink []byte
 	if t == linkNormal || t == linkImg {
-		if len(link) > 0 {
+		if p.flags&EXTENSION_COMMONMARK != 0 {
+			uLink = escapeURL(unescapeCommonMark(link))
+			title = unescapeCommonMark(title)
+		} else if len(link) > 0 {
 			var uLinkBuf bytes.Buffer
 			unescapeText(&uLinkBuf, link)
 			uLink = uLinkBuf.Bytes()
 		}
 
-		// links need something to click on and somewhere to go
-		if len(uLink) == 0 || (t == linkNormal && content.Len() == 0) {
+		// links need something to click on and somewhere to go, unless
+		// CommonMark says otherwise
+		if (len(uLink) == 0 || t == linkNormal && content.FirstChild == nil) &&
+			p.flags&EXTENSION_COMMONMARK == 0 {
 			return 0
 		}
 	}
 
-	// call the relevant rendering function
+	// attach the relevant node
 	switch t {
 	case linkNormal:
-		p.r.Link(out, uLink, title, content.Bytes())
+		content.Destination = uLink
+		content.Title = title
+		out.AppendChild(content)
 
 	case linkImg:
-		outSize := out.Len()
-		outBytes := out.Bytes()
-		if outSize > 0 && outBytes[outSize-1] == '!' {
-			out.Truncate(outSize - 1)
-		}
+		out.trimTrailingText([]byte("!"))
 
-		p.r.Image(out, uLink, title, content.Bytes())
+		content.Destination = uLink
+		content.Title = title
+		content.source = source[offset-1 : offset+i]
+		out.AppendChild(content)
 
 	case linkInlineFootnote:
-		outSize := out.Len()
-		outBytes := out.Bytes()
-		if outSize > 0 && outBytes[outSize-1] == '^' {
-			out.Truncate(outSize - 1)
-		}
+		out.trimTrailingText([]byte("^"))
 
-		p.r.FootnoteRef(out, link, noteId)
+		ref := out.add(FootnoteRef)
+		ref.source = source[offset-1 : offset+i]
+		ref.Destination = link
+		ref.NoteID = noteId
+		ref.IsInlineNote = true
 
 	case linkDeferredFootnote:
-		p.r.FootnoteRef(out, link, noteId)
+		ref := out.add(FootnoteRef)
+		ref.Destination = link
+		ref.NoteID = noteId
 
 	default:
 		return 0
@@ -535,44 +599,291 @@ func link(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 	return i
 }
 
+// plainText is the text of the inline nodes under 'n', without their markup.
+func plainText(n *Node) []byte {
+	var b bytes.Buffer
+	Walk(n, func(c *Node, entering bool) WalkStatus {
+		switch {
+		case !entering:
+		case c.Type == Text || c.Type == CodeSpan || c.Type == HtmlSpan || c.Type == Image:
+			b.Write(c.Literal)
+		case c.Type == AutoLink:
+			b.Write(c.Destination)
+		case c.Type == LineBreak:
+			b.WriteByte(' ')
+		}
+		return GoToNext
+	})
+	return b.Bytes()
+}
+
+// refId crafts the id of a reference from the text of a link, where line
+// breaks count as spaces.
+func refId(text []byte, hasNl bool) []byte {
+	if !hasNl {
+		return text
+	}
+	var b bytes.Buffer
+	for j := 0; j < len(text); j++ {
+		switch {
+		case text[j] != '\n':
+			b.WriteByte(text[j])
+		case j == 0 || text[j-1] != ' ':
+			b.WriteByte(' ')
+		}
+	}
+	return b.Bytes()
+}
+
+// isLinkCommonMark tells if the brackets from k to end, in the span of 'd',
+// make a link by the rules of CommonMark, leaving aside the links they hold:
+// they have to be followed by a destination, or stand for a reference, the
+// same way link works it out.
+func isLinkCommonMark(p *parser, d *delimiters, k, end int) bool {
+	data := d.data[:d.end]
+	footnotes := p.flags&EXTENSION_FOOTNOTES != 0
+	if k > 0 && (data[k-1] == '!' && !isImageEscaped(p, data, k) || data[k-1] == '^' && footnotes) ||
+		footnotes && k+1 < len(data) && data[k+1] == '^' {
+		return false
+	}
+
+	i := end + 1
+	if i < len(data) && data[i] == '(' {
+		if tail, _, _ := linkTailCommonMark(p, d, i, data[i:]); tail > 0 {
+			return true
+		}
+	}
+	var id []byte
+	if i < len(data)-1 && data[i] == '[' && data[i+1] != '^' {
+		labelEnd := d.nextByte(']', i+1)
+		if labelEnd >= len(data) {
+			return false
+		}
+		id = data[i+1 : labelEnd]
+	}
+
+	// without a label of its own, the text is the id, and a reference id
+	// can't hold a ']'
+	if len(id) == 0 {
+		if d.nextByte(']', k+1) < end {
+			return false
+		}
+		id = refId(data[k+1:end], d.nextByte('\n', k+1) < end)
+	}
+	p.spend(len(id))
+	_, ok := p.refs[string(bytes.ToLower(id))]
+	return ok
+}
+
+// isImageEscaped tells if the '!' before the '[' at k is escaped, which with
+// CommonMark keeps the brackets from making an image.
+func isImageEscaped(p *parser, data []byte, k int) bool {
+	return p.flags&EXTENSION_COMMONMARK != 0 && isBackslashEscaped(data, k-1)
+}
+
+// linkTailCommonMark parses what follows the text of an inline link by the
+// rules of CommonMark: a destination and an optional title, in parentheses.
+// 'data' starts at the '(', which is at 'at' in the span of 'd'. It returns
+// the bytes used, or 0 if they don't make a link.
+func linkTailCommonMark(p *parser, d *delimiters, at int, data []byte) (int, []byte, []byte) {
+	var link, title []byte
+	i := skipLinkSpace(p, data, 1)
+	if i >= len(data) {
+		return 0, nil, nil
+	}
+
+	// a destination between angle brackets can hold anything but line
+	// breaks and unescaped brackets; one without them can't hold spaces or
+	// control chars, and parentheses in it have to be balanced. The ends
+	// are looked up in tables of the span, so that a lot of links that
+	// don't end don't each search to the end of it.
+	switch {
+	case data[i] == '<':
+		end := d.scan("<>\n", at+i+1) - at
+		if end >= len(data) || data[end] != '>' {
+			return 0, nil, nil
+		}
+		link = data[i+1 : end]
+		i = end + 1
+	case data[i] != ')':
+		start, depth := i, 0
+		for {
+			end := d.nextControl(at + i)
+			k := d.scan("()", at+i)
+			p.spend(1)
+			if k >= end {
+				if depth > 0 {
+					return 0, nil, nil
+				}
+				i = end - at
+				break
+			}
+			i = k - at + 1
+			if data[i-1] == '(' {
+				// the nesting is limited, like in the reference
+				// implementation
+				if depth++; depth > 32 {
+					return 0, nil, nil
+				}
+			} else if depth--; depth < 0 {
+				i--
+				break
+			}
+		}
+		link = data[start:i]
+	}
+
+	// a title has to be set apart by whitespace, and ends with the first
+	// unescaped quote it started with, or ')' if it started with '('
+	j := skipLinkSpace(p, data, i)
+	if j > i && j < len(data) && (data[j] == '"' || data[j] == '\'' || data[j] == '(') {
+		set := data[j : j+1]
+		if data[j] == '(' {
+			set = []byte("()")
+		}
+		end := d.scan(string(set), at+j+1) - at
+		if end >= len(data) || data[j] == '(' && data[end] != ')' {
+			return 0, nil, nil
+		}
+		title = data[j+1 : end]
+		j = skipLinkSpace(p, data, end+1)
+	}
+	if j >= len(data) || data[j] != ')' {
+		return 0, nil, nil
+	}
+	return j + 1, link, title
+}
+
+// skipLinkSpace skips the spaces and tabs from i in a link, and one line
+// break among them.
+func skipLinkSpace(p *parser, data []byte, i int) int {
+	j, lines := i, 0
+	for j < len(data) && (data[j] == ' ' || data[j] == '\t' || data[j] == '\n' && lines == 0) {
+		if data[j] == '\n' {
+			lines++
+		}
+		j++
+	}
+	p.spend(j - i)
+	return j
+}
+
+// noteFragment picks the anchor of an inline footnote: its number, unless a
+// note defined in the document already goes by that name.
+func noteFragment(p *parser, noteId int) []byte {
+	fragment := strconv.Itoa(noteId)
+	for k := 1; p.refs["^"+fragment] != nil; k++ {
+		fragment = strconv.Itoa(noteId) + "-" + strconv.Itoa(k)
+	}
+	return []byte(fragment)
+}
+
 // '<' when tags or autolinks are allowed
-func leftAngle(p *parser, out *bytes.Buffer, data []byte, offset int) int {
+func leftAngle(p *parser, out *Node, data []byte, offset int) int {
 	data = data[offset:]
+	if p.flags&EXTENSION_COMMONMARK != 0 {
+		return leftAngleCommonMark(p, out, data)
+	}
 	altype := LINK_TYPE_NOT_AUTOLINK
-	end := tagLength(data, &altype)
+	end := tagLength(p, data, &altype)
 
 	if end > 2 {
 		if altype != LINK_TYPE_NOT_AUTOLINK {
 			var uLink bytes.Buffer
 			unescapeText(&uLink, data[1:end+1-2])
 			if uLink.Len() > 0 {
-				p.r.AutoLink(out, uLink.Bytes(), altype)
+				autoLink := out.add(AutoLink)
+				autoLink.Destination = uLink.Bytes()
+				autoLink.LinkType = altype
 			}
 		} else {
-			p.r.RawHtmlTag(out, data[:end])
+			out.add(HtmlSpan).Literal = data[:end]
 		}
 	}
 
 	return end
 }
 
+// leftAngleCommonMark parses an autolink or raw HTML by the rules of
+// CommonMark. The destination of an autolink is taken as it is written, as
+// escapes don't work in there.
+func leftAngleCommonMark(p *parser, out *Node, data []byte) int {
+	if end, kind := autoLinkCommonMark(p, data); end > 0 {
+		autoLink := out.add(AutoLink)
+		autoLink.Destination = data[1 : end-1]
+		autoLink.LinkType = kind
+		return end
+	}
+	if end := htmlTagCommonMark(p, data); end > 0 {
+		out.add(HtmlSpan).Literal = data[:end]
+		return end
+	}
+	return 0
+}
+
 // '\\' backslash escape
 var escapeChars = []byte("\\`*_{}[]()#+-.!:|&<>~")
 
-func escape(p *parser, out *bytes.Buffer, data []byte, offset int) int {
+func escape(p *parser, out *Node, data []byte, offset int) int {
 	data = data[offset:]
 
 	if len(data) > 1 {
-		if bytes.IndexByte(escapeChars, data[1]) < 0 {
+		if p.flags&EXTENSION_COMMONMARK != 0 {
+			// CommonMark escapes all ASCII punctuation, and a backslash at
+			// the end of a line makes a hard line break
+			if data[1] == '\n' && len(data) > 2 {
+				out.add(LineBreak)
+				return 2
+			}
+			if !ispunct(data[1]) {
+				return 0
+			}
+		} else if bytes.IndexByte(escapeChars, data[1]) < 0 &&
+			(data[1] != '$' || p.flags&EXTENSION_MATH == 0) {
 			return 0
 		}
 
-		p.r.NormalText(out, data[1:2])
+		out.addText(data[1:2])
+	} else if p.flags&EXTENSION_COMMONMARK != 0 {
+		// a backslash at the end is just that
+		return 0
 	}
 
 	return 2
 }
 
+// '$' parses TeX math: $inline math$, or $$display math$$, which Pandoc
+// takes for display math even in the middle of a paragraph. What is between
+// the dollars is taken as it is, without emphasis or escapes. Like in Pandoc,
+// the opening dollar has to be followed by something other than a space and
+// the closing one preceded by it, and a digit can't follow the closing one,
+// so that prices are left alone.
+func math(p *parser, out *Node, data []byte, offset int) int {
+	data = data[offset:]
+	n := 1
+	if len(data) > 1 && data[1] == '$' {
+		n = 2
+	}
+	if n >= len(data) || n == 1 && isspace(data[n]) || data[n] == '$' {
+		return 0
+	}
+
+	// the closers are looked up in a table of the span, so that a lot of
+	// dollars that don't close don't each search to its end
+	d, at := p.delimitersFor(data)
+	end := d.closeMath(n, at+n) - at
+	if end >= len(data) {
+		return 0
+	}
+	span := out.add(MathSpan)
+	span.Literal = data[n:end]
+	if n == 2 {
+		span.Literal = bytes.TrimSpace(span.Literal)
+		span.IsDisplay = true
+	}
+	return end + n
+}
+
 func unescapeText(ob *bytes.Buffer, src []byte) {
 	i := 0
 	for i < len(src) {
@@ -594,11 +905,106 @@ func unescapeText(ob *bytes.Buffer, src []byte) {
 	}
 }
 
+// unescapeCommonMark resolves the backslash escapes and the entities of
+// 'src', which CommonMark does in link destinations and titles and in the
+// info strings of fenced code.
+func unescapeCommonMark(src []byte) []byte {
+	var out bytes.Buffer
+	for i := 0; i < len(src); i++ {
+		switch {
+		case src[i] == '\\' && i+1 < len(src) && ispunct(src[i+1]):
+			i++
+			out.WriteByte(src[i])
+		case src[i] == '&':
+			text, n := decodeEntity(src[i:])
+			if n == 0 {
+				out.WriteByte('&')
+				break
+			}
+			out.WriteString(text)
+			i += n - 1
+		default:
+			out.WriteByte(src[i])
+		}
+	}
+	return out.Bytes()
+}
+
+// decodeEntity decodes the entity or numeric character reference at the
+// start of 'data', returning what it stands for and its length, or 0 if
+// there isn't a valid one. Like in CommonMark, a named one has to be one of
+// HTML5, and a numeric one has at most 7 decimal or 6 hexadecimal digits;
+// the code points that can't be in a document become U+FFFD.
+func decodeEntity(data []byte) (string, int) {
+	i, base, maxLen := 1, 0, 32
+	if i < len(data) && data[i] == '#' {
+		i, base, maxLen = 2, 10, 7
+		if i < len(data) && (data[i] == 'x' || data[i] == 'X') {
+			i, base, maxLen = 3, 16, 6
+		}
+	}
+	start := i
+	for i < len(data) && i-start < maxLen && isalnum(data[i]) {
+		i++
+	}
+	if i == start || i >= len(data) || data[i] != ';' {
+		return "", 0
+	}
+	name := data[start:i]
+
+	if base == 0 {
+		// an unknown name comes back as it is, or with only the start of it
+		// decoded, which keeps the semicolon
+		entity := string(data[:i+1])
+		text := html.UnescapeString(entity)
+		if text == entity || len(text) > 1 && text[len(text)-1] == ';' || !isletter(name[0]) {
+			return "", 0
+		}
+		return text, i + 1
+	}
+
+	code, err := strconv.ParseUint(string(name), base, 32)
+	if err != nil {
+		return "", 0
+	}
+	if code == 0 || code > unicode.MaxRune || code >= 0xd800 && code <= 0xdfff {
+		code = unicode.ReplacementChar
+	}
+	return string(rune(code)), i + 1
+}
+
+// escapeURL percent-encodes the bytes of a link destination that can't be in
+// a URL as they are, like CommonMark implementations do: spaces, quotes and
+// the like, and what isn't ASCII. A '%' is left alone, so what is encoded
+// already stays the same.
+func escapeURL(link []byte) []byte {
+	const safe = "!#$%&'()*+,-./:;=?@_~"
+	var out bytes.Buffer
+	for _, c := range link {
+		if isalnum(c) || indexByte(safe, c) {
+			out.WriteByte(c)
+		} else {
+			fmt.Fprintf(&out, "%%%02X", c)
+		}
+	}
+	return out.Bytes()
+}
+
 // '&' escaped when it doesn't belong to an entity
 // valid entities are assumed to be anything matching &#?[A-Za-z0-9]+;
-func entity(p *parser, out *bytes.Buffer, data []byte, offset int) int {
+// With CommonMark, valid ones are decoded into text, and the rest is text.
+func entity(p *parser, out *Node, data []byte, offset int) int {
 	data = data[offset:]
 
+	if p.flags&EXTENSION_COMMONMARK != 0 {
+		text, end := decodeEntity(data)
+		p.spend(end + 1)
+		if end > 0 {
+			out.add(Text).Literal = []byte(text)
+		}
+		return end
+	}
+
 	end := 1
 
 	if end < len(data) && data[end] == '#' {
@@ -608,6 +1014,7 @@ func entity(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 	for end < len(data) && isalnum(data[end]) {
 		end++
 	}
+	p.spend(end)
 
 	if end < len(data) && data[end] == ';' {
 		end++ // real entity
@@ -615,7 +1022,7 @@ func entity(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 		return 0 // lone '&'
 	}
 
-	p.r.Entity(out, data[:end])
+	out.add(Entity).Literal = data[:end]
 
 	return end
 }
@@ -628,7 +1035,7 @@ func linkEndsWithEntity(data []byte, linkEnd int) bool {
 	return false
 }
 
-func autoLink(p *parser, out *bytes.Buffer, data []byte, offset int) int {
+func autoLink(p *parser, out *Node, data []byte, offset int) int {
 	// quick check to rule out most false hits on ':'
 	if p.insideLink || len(data) < offset+3 || data[offset+1] != '/' || data[offset+2] != '/' {
 		return 0
@@ -641,10 +1048,11 @@ func autoLink(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 		anchorStart--
 		offsetFromAnchor++
 	}
+	p.spend(offsetFromAnchor)
 
 	anchorStr := anchorRe.Find(data[anchorStart:])
 	if anchorStr != nil {
-		out.Write(anchorStr[offsetFromAnchor:])
+		out.add(HtmlSpan).Literal = anchorStr[offsetFromAnchor:]
 		return len(anchorStr) - offsetFromAnchor
 	}
 
@@ -668,6 +1076,14 @@ func autoLink(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 	for linkEnd < len(data) && !isEndOfLink(data[linkEnd]) {
 		linkEnd++
 	}
+	p.spend(linkEnd)
+
+	if p.flags&EXTENSION_EXTENDED_AUTOLINK != 0 {
+		linkEnd = extendedLinkEnd(data, linkEnd)
+		out.trimTrailingText(data[:rewind])
+		p.addAutoLink(out, data[:linkEnd])
+		return linkEnd - rewind
+	}
 
 	// Skip punctuation at the end of the link
 	if (data[linkEnd-1] == '.' || data[linkEnd-1] == ',') && data[linkEnd-2] != '\\' {
@@ -675,8 +1091,11 @@ func autoLink(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 	}
 
 	// But don't skip semicolon if it's a part of escaped entity:
-	if data[linkEnd-1] == ';' && data[linkEnd-2] != '\\' && !linkEndsWithEntity(data, linkEnd) {
-		linkEnd--
+	if data[linkEnd-1] == ';' && data[linkEnd-2] != '\\' {
+		p.spend(linkEnd)
+		if !linkEndsWithEntity(data, linkEnd) {
+			linkEnd--
+		}
 	}
 
 	// See if the link finishes with a punctuation sign that can be closed.
@@ -731,6 +1150,7 @@ func autoLink(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 			}
 
 			bufEnd--
+			p.spend(1)
 		}
 
 		if openDelim == 0 {
@@ -739,18 +1159,24 @@ func autoLink(p *parser, out *bytes.Buffer, data []byte, offset int) int {
 	}
 
 	// we were triggered on the ':', so we need to rewind the output a bit
-	if out.Len() >= rewind {
-		out.Truncate(len(out.Bytes()) - rewind)
-	}
+	out.trimTrailingText(data[:rewind])
+
+	p.addAutoLink(out, data[:linkEnd])
+
+	return linkEnd - rewind
+}
 
+// addAutoLink adds an autolink to the URL 'link', minus its backslashes.
+func (p *parser) addAutoLink(out *Node, link []byte) {
 	var uLink bytes.Buffer
-	unescapeText(&uLink, data[:linkEnd])
+	unescapeText(&uLink, link)
 
 	if uLink.Len() > 0 {
-		p.r.AutoLink(out, uLink.Bytes(), LINK_TYPE_NORMAL)
+		autoLink := out.add(AutoLink)
+		autoLink.Destination = uLink.Bytes()
+		autoLink.LinkType = LINK_TYPE_NORMAL
+		autoLink.source = link
 	}
-
-	return linkEnd - rewind
 }
 
 func isEndOfLink(char byte) bool {
@@ -771,8 +1197,217 @@ func isSafeLink(link []byte) bool {
 	return false
 }
 
+// With EXTENSION_EXTENDED_AUTOLINK, links are found the way GitHub finds
+// them: besides URLs with a scheme, domains that start with "www." and email
+// addresses are linked, and what is left off the end of a link follows
+// GitHub's rules.
+
+// 'w', when it starts "www." at the start of a word
+func wwwLink(p *parser, out *Node, data []byte, offset int) int {
+	if p.insideLink || offset > 0 && !isspace(data[offset-1]) && bytes.IndexByte([]byte("*_~("), data[offset-1]) < 0 {
+		return 0
+	}
+	data = data[offset:]
+	if !bytes.HasPrefix(data, []byte("www.")) || hostChar(data[4:]) == 0 {
+		return 0
+	}
+	if checkDomain(p, data, false) == 0 {
+		return 0
+	}
+
+	end := 0
+	for end < len(data) && !isEndOfLink(data[end]) {
+		end++
+	}
+	p.spend(end)
+	end = extendedLinkEnd(data, end)
+
+	var text bytes.Buffer
+	unescapeText(&text, data[:end])
+
+	// the link has no scheme, so it is not an AutoLink, whose text is its
+	// destination
+	link := out.add(Link)
+	link.Destination = append([]byte("http://"), text.Bytes()...)
+	child := link.add(Text)
+	child.Literal = text.Bytes()
+	child.source = data[:end]
+	return end
+}
+
+// '@' of an email address
+func emailLink(p *parser, out *Node, data []byte, offset int) int {
+	if p.insideLink {
+		return 0
+	}
+
+	// the user name has been added as text already, split up wherever an
+	// inline callback took a look at it; runs of emphasis chars that are
+	// still waiting for a match are not part of it. The text in front of
+	// it is looked at too, as far as a "mailto:" would go.
+	d, _ := p.delimitersFor(data)
+	start, text := offset, offset
+	for n := out.LastChild; n != nil && n.Type == Text && start-text < len("mailto:"); n = n.Prev {
+		k := len(n.Literal)
+		if k == 0 || k > text || &n.Literal[k-1] != &data[text-1] ||
+			d.lastRun != nil && d.lastRun.node == n {
+			break
+		}
+		if text == start {
+			j := k
+			for j > 0 && (isalnum(n.Literal[j-1]) || bytes.IndexByte([]byte(".+-_"), n.Literal[j-1]) >= 0) {
+				j--
+			}
+			start -= k - j
+			p.spend(k - j + 1)
+		}
+		text -= k
+	}
+	if start == offset || endsInWord(data[:start]) {
+		return 0
+	}
+
+	// like with GitHub, a mailto: in front goes with it
+	prefix := 0
+	if start-text >= len("mailto:") && bytes.HasSuffix(data[:start], []byte("mailto:")) &&
+		!endsInWord(data[:start-len("mailto:")]) {
+		prefix = len("mailto:")
+	}
+
+	// the domain needs a dot and has to end in a letter, but a dot at the
+	// end is not part of it
+	end := offset + 1
+	dots := 0
+	for end < len(data) {
+		if n := hostChar(data[end:]); n > 0 {
+			end += n
+		} else if data[end] == '.' && end+1 < len(data) && hostChar(data[end+1:]) > 0 {
+			dots++
+			end++
+		} else {
+			break
+		}
+	}
+	p.spend(end - offset)
+	if dots == 0 || data[end-1] == '-' || data[end-1] == '_' || isdigit(data[end-1]) {
+		return 0
+	}
+
+	// take the user name off the text
+	for rest := offset - start + prefix; rest > 0; {
+		last := out.LastChild
+		if k := len(last.Literal); k <= rest {
+			rest -= k
+			last.Unlink()
+		} else {
+			out.trimTrailingText(last.Literal[k-rest:])
+			rest = 0
+		}
+	}
+
+	autoLink := out.add(AutoLink)
+	autoLink.Destination = data[start:end]
+	autoLink.LinkType = LINK_TYPE_EMAIL
+	autoLink.source = data[start-prefix : end]
+	return end - offset
+}
+
+// endsInWord tells if the text in 'data' ends with a letter, a digit or '_',
+// escaped or not, which an email address can't start right after.
+func endsInWord(data []byte) bool {
+	if n := len(data); n > 0 && data[n-1] == '\\' {
+		// the escape of what follows
+		data = data[:n-1]
+	}
+	r, _ := utf8.DecodeLastRune(data)
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// hostChar returns the size of the letter, digit, '-' or '_' at the start of
+// 'data', which can be a Unicode letter for internationalized domain names,
+// or 0 if there isn't one.
+func hostChar(data []byte) int {
+	if len(data) == 0 {
+		return 0
+	}
+	if c := data[0]; c < utf8.RuneSelf {
+		if isalnum(c) || c == '-' || c == '_' {
+			return 1
+		}
+		return 0
+	}
+	r, size := utf8.DecodeRune(data)
+	if unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsMark(r) {
+		return size
+	}
+	return 0
+}
+
+// checkDomain returns the length of the domain name at the start of 'data',
+// or 0 if there isn't a valid one: one made of parts separated by dots, the
+// last two of which have no '_' in them. Unless 'short' is set, there must be
+// a dot in it.
+func checkDomain(p *parser, data []byte, short bool) int {
+	i, dots := 0, 0
+	underscores, lastUnderscores := 0, 0
+	for i < len(data) {
+		if data[i] == '.' {
+			if i == 0 || data[i-1] == '.' {
+				break
+			}
+			lastUnderscores, underscores = underscores, 0
+			dots++
+			i++
+			continue
+		}
+		n := hostChar(data[i:])
+		if n == 0 {
+			break
+		}
+		if data[i] == '_' {
+			underscores++
+		}
+		i += n
+	}
+	p.spend(i)
+	if i == 0 || underscores > 0 || lastUnderscores > 0 || !short && dots == 0 {
+		return 0
+	}
+	return i
+}
+
+// extendedLinkEnd takes what GitHub leaves out off the end of the link that
+// ends at 'end': punctuation, closing parentheses that have no match within
+// the link, and an entity reference.
+func extendedLinkEnd(data []byte, end int) int {
+	opening := bytes.Count(data[:end], []byte("("))
+	closing := bytes.Count(data[:end], []byte(")"))
+	for end > 0 {
+		switch c := data[end-1]; {
+		case bytes.IndexByte([]byte("?!.,:*_~'\""), c) >= 0:
+			end--
+		case c == ';':
+			i := end - 2
+			for i > 0 && isalnum(data[i]) {
+				i--
+			}
+			if i < end-2 && data[i] == '&' {
+				end = i
+			} else {
+				end--
+			}
+		case c == ')' && closing > opening:
+			closing--
+			end--
+		default:
+			return end
+		}
+	}
+	return end
+}
+
 // return the length of the given tag, or 0 is it's not valid
-func tagLength(data []byte, autolink *int) int {
+func tagLength(p *parser, data []byte, autolink *int) int {
 	var i, j int
 
 	// a valid tag can't be shorter than 3 chars
@@ -801,9 +1436,10 @@ func tagLength(data []byte, autolink *int) int {
 	for i < len(data) && (isalnum(data[i]) || data[i] == '.' || data[i] == '+' || data[i] == '-') {
 		i++
 	}
+	p.spend(i)
 
 	if i > 1 && i < len(data) && data[i] == '@' {
-		if j = isMailtoAutoLink(data[i:]); j != 0 {
+		if j = isMailtoAutoLink(p, data[i:]); j != 0 {
 			*autolink = LINK_TYPE_EMAIL
 			return i + j
 		}
@@ -814,24 +1450,17 @@ func tagLength(data []byte, autolink *int) int {
 		i++
 	}
 
+	// the rest is looked up in tables of the span, so that a lot of '<'
+	// that don't end don't each search to its end
+	d, at := p.delimitersFor(data)
+
 	// complete autolink test: no whitespace or ' or "
 	switch {
 	case i >= len(data):
 		*autolink = LINK_TYPE_NOT_AUTOLINK
 	case *autolink != 0:
 		j = i
-
-		for i < len(data) {
-			if data[i] == '\\' {
-				i += 2
-			} else if data[i] == '>' || data[i] == '\'' || data[i] == '"' || isspace(data[i]) {
-				break
-			} else {
-				i++
-			}
-
-		}
-
+		i = d.scan(">'\" \t\n\r\f\v", at+i) - at
 		if i >= len(data) {
 			return 0
 		}
@@ -844,22 +1473,200 @@ func tagLength(data []byte, autolink *int) int {
 	}
 
 	// look for something looking like a tag end
-	for i < len(data) && data[i] != '>' {
-		i++
-	}
+	i = d.nextByte('>', at+i) - at
 	if i >= len(data) {
 		return 0
 	}
 	return i + 1
 }
 
+// autoLinkCommonMark returns the length of the autolink at the start of
+// 'data' by the rules of CommonMark, and its kind: an absolute URI or an
+// email address between '<' and '>'. It returns 0 if there is none.
+func autoLinkCommonMark(p *parser, data []byte) (int, int) {
+	// a scheme is 2 to 32 letters, digits and "+.-", starting with a letter
+	i := 1
+	for i < len(data) && i <= 33 && (isalnum(data[i]) || indexByte("+.-", data[i])) {
+		i++
+	}
+	if i >= 3 && i <= 33 && isletter(data[1]) && i < len(data) && data[i] == ':' {
+		// the rest is looked up in a table of the span, so that a lot of
+		// '<' that don't end don't each search to its end
+		d, at := p.delimitersFor(data)
+		end := min(d.nextControl(at+i), d.nextByte('<', at+i), d.nextByte('>', at+i)) - at
+		if end < len(data) && data[end] == '>' {
+			return end + 1, LINK_TYPE_NORMAL
+		}
+		return 0, 0
+	}
+
+	// an address has a local part, and a domain of labels of up to 63
+	// letters, digits and hyphens, set apart by dots
+	for i < len(data) && (isalnum(data[i]) || indexByte(".!#$%&'*+/=?^_`{|}~-", data[i])) {
+		i++
+	}
+	p.spend(i)
+	if i == 1 || i >= len(data) || data[i] != '@' {
+		return 0, 0
+	}
+	for {
+		i++
+		j := i
+		for j < len(data) && j-i < 63 && (isalnum(data[j]) || data[j] == '-') {
+			j++
+		}
+		p.spend(j - i + 1)
+		if j == i || j >= len(data) || data[i] == '-' || data[j-1] == '-' {
+			return 0, 0
+		}
+		i = j
+		switch data[i] {
+		case '>':
+			return i + 1, LINK_TYPE_EMAIL
+		case '.':
+		default:
+			return 0, 0
+		}
+	}
+}
+
+// htmlTagCommonMark returns the length of the raw HTML at the start of 'data'
+// by the rules of CommonMark: an open or closing tag, a comment, a processing
+// instruction, a declaration or a CDATA section. It returns 0 if there is
+// none.
+func htmlTagCommonMark(p *parser, data []byte) int {
+	if len(data) < 3 || data[0] != '<' {
+		return 0
+	}
+
+	// the ones that can hold anything end with the first marker after them,
+	// looked up in a table of the span, so that a lot of them that don't end
+	// don't each search to its end
+	endsWith := func(marker string, from int) int {
+		d, at := p.delimitersFor(data)
+		end := d.nextString(marker, at+from) - at
+		if end >= len(data) {
+			return 0
+		}
+		return end + len(marker)
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte("<!-->")):
+		return 5
+	case bytes.HasPrefix(data, []byte("<!--->")):
+		return 6
+	case bytes.HasPrefix(data, []byte("<!--")):
+		return endsWith("-->", 4)
+	case data[1] == '?':
+		return endsWith("?>", 2)
+	case bytes.HasPrefix(data, []byte("<![CDATA[")):
+		return endsWith("]]>", 9)
+	case data[1] == '!' && isletter(data[2]):
+		return endsWith(">", 3)
+	}
+	return elementTagCommonMark(p, data)
+}
+
+// elementTagCommonMark returns the length of the open or closing tag at the
+// start of 'data' by the rules of CommonMark, or 0 if there is none.
+func elementTagCommonMark(p *parser, data []byte) int {
+	if len(data) < 3 || data[0] != '<' {
+		return 0
+	}
+	i := 1
+	closing := data[i] == '/'
+	if closing {
+		i++
+	}
+
+	// a tag name is a letter followed by letters, digits and hyphens
+	if i >= len(data) || !isletter(data[i]) {
+		return 0
+	}
+	for i < len(data) && (isalnum(data[i]) || data[i] == '-') {
+		i++
+	}
+	if closing {
+		i = skipTagSpace(p, data, i)
+		if i < len(data) && data[i] == '>' {
+			return i + 1
+		}
+		return 0
+	}
+
+	for {
+		j := skipTagSpace(p, data, i)
+		switch {
+		case j >= len(data):
+			return 0
+		case data[j] == '>':
+			return j + 1
+		case data[j] == '/':
+			if j+1 < len(data) && data[j+1] == '>' {
+				return j + 2
+			}
+			return 0
+		}
+
+		// an attribute is set apart by whitespace, and its name starts with
+		// a letter, '_' or ':'
+		if j == i || !isletter(data[j]) && data[j] != '_' && data[j] != ':' {
+			return 0
+		}
+		i = j
+		for i < len(data) && (isalnum(data[i]) || indexByte("_.:-", data[i])) {
+			i++
+		}
+		p.spend(i - j)
+
+		// it can have a value, quoted or not
+		j = skipTagSpace(p, data, i)
+		if j >= len(data) || data[j] != '=' {
+			continue
+		}
+		j = skipTagSpace(p, data, j+1)
+		if j >= len(data) {
+			return 0
+		}
+		if c := data[j]; c == '"' || c == '\'' {
+			end := bytes.IndexByte(data[j+1:], c)
+			if end < 0 {
+				p.spend(len(data) - j)
+				return 0
+			}
+			p.spend(end + 1)
+			i = j + end + 2
+			continue
+		}
+		i = j
+		for i < len(data) && !isspace(data[i]) && !indexByte("\"'=<>`", data[i]) {
+			i++
+		}
+		p.spend(i - j)
+		if i == j {
+			return 0
+		}
+	}
+}
+
+// skipTagSpace skips the spaces, tabs and newlines in a tag from i.
+func skipTagSpace(p *parser, data []byte, i int) int {
+	j := i
+	for j < len(data) && (data[j] == ' ' || data[j] == '\t' || data[j] == '\n') {
+		j++
+	}
+	p.spend(j - i)
+	return j
+}
+
 // look for the address part of a mail autolink and '>'
 // this is less strict than the original markdown e-mail address matching
-func isMailtoAutoLink(data []byte) int {
+func isMailtoAutoLink(p *parser, data []byte) int {
 	nb := 0
 
 	// address is assumed to be: [-@._a-zA-Z0-9]+ with exactly one '@'
 	for i := 0; i < len(data); i++ {
+		p.spend(1)
 		if isalnum(data[i]) {
 			continue
 		}
@@ -885,83 +1692,8 @@ func isMailtoAutoLink(data []byte) int {
 	return 0
 }
 
-// look for the next emph char, skipping other constructs
-func helperFindEmphChar(data []byte, c byte) int {
-	i := 1
-
-	for i < len(data) {
-		for i < len(data) && data[i] != c && data[i] != '`' && data[i] != '[' {
-			i++
-		}
-		if i >= len(data) {
-			return 0
-		}
-		if data[i] == c {
-			return i
-		}
-
-		// do not count escaped chars
-		if i != 0 && data[i-1] == '\\' {
-			i++
-			continue
-		}
-
-		if data[i] == '`' {
-			// skip a code span
-			tmpI := 0
-			i++
-			for i < len(data) && data[i] != '`' {
-				if tmpI == 0 && data[i] == c {
-					tmpI = i
-				}
-				i++
-			}
-			if i >= len(data) {
-				return tmpI
-			}
-			i++
-		} else if data[i] == '[' {
-			// skip a link
-			tmpI := 0
-			i++
-			for i < len(data) && data[i] != ']' {
-				if tmpI == 0 && data[i] == c {
-					tmpI = i
-				}
-				i++
-			}
-			i++
-			for i < len(data) && (data[i] == ' ' || data[i] == '\n') {
-				i++
-			}
-			if i >= len(data) {
-				return tmpI
-			}
-			if data[i] != '[' && data[i] != '(' { // not a link
-				if tmpI > 0 {
-					return tmpI
-				} else {
-					continue
-				}
-			}
-			cc := data[i]
-			i++
-			for i < len(data) && data[i] != cc {
-				if tmpI == 0 && data[i] == c {
-					return i
-				}
-				i++
-			}
-			if i >= len(data) {
-				return tmpI
-			}
-			i++
-		}
-	}
-	return 0
-}
-
-func helperEmphasis(p *parser, out *bytes.Buffer, data []byte, c byte) int {
+func helperEmphasis(p *parser, out *Node, data []byte, c byte) int {
+	d, at := p.delimitersFor(data)
 	i := 0
 
 	// skip one symbol if coming from emph3
@@ -969,112 +1701,62 @@ func helperEmphasis(p *parser, out *bytes.Buffer, data []byte, c byte) int {
 		i = 1
 	}
 
-	for i < len(data) {
-		length := helperFindEmphChar(data[i:], c)
-		if length == 0 {
-			return 0
-		}
-		i += length
-		if i >= len(data) {
-			return 0
-		}
-
-		if i+1 < len(data) && data[i+1] == c {
-			i++
-			continue
-		}
-
-		if data[i] == c && !isspace(data[i-1]) {
-
-			if p.flags&EXTENSION_NO_INTRA_EMPHASIS != 0 {
-				if !(i+1 == len(data) || isspace(data[i+1]) || ispunct(data[i+1])) {
-					continue
-				}
-			}
-
-			var work bytes.Buffer
-			p.inline(&work, data[:i])
-			p.r.Emphasis(out, work.Bytes())
-			return i + 1
-		}
+	i = d.closeEmph(c, 1, at+i) - at
+	if i >= len(data) {
+		return 0
 	}
 
-	return 0
+	p.inline(out.add(Emphasis), data[:i])
+	return i + 1
 }
 
-func helperDoubleEmphasis(p *parser, out *bytes.Buffer, data []byte, c byte) int {
-	i := 0
-
-	for i < len(data) {
-		length := helperFindEmphChar(data[i:], c)
-		if length == 0 {
-			return 0
-		}
-		i += length
+func helperDoubleEmphasis(p *parser, out *Node, data []byte, c byte) int {
+	d, at := p.delimitersFor(data)
 
-		if i+1 < len(data) && data[i] == c && data[i+1] == c && i > 0 && !isspace(data[i-1]) {
-			var work bytes.Buffer
-			p.inline(&work, data[:i])
+	i := d.closeEmph(c, 2, at) - at
+	if i >= len(data) {
+		return 0
+	}
 
-			if work.Len() > 0 {
-				// pick the right renderer
-				if c == '~' {
-					p.r.StrikeThrough(out, work.Bytes())
-				} else {
-					p.r.DoubleEmphasis(out, work.Bytes())
-				}
-			}
-			return i + 2
-		}
-		i++
+	// pick the right node type
+	typ := DoubleEmphasis
+	if c == '~' {
+		typ = StrikeThrough
 	}
-	return 0
+	p.inline(out.add(typ), data[:i])
+	return i + 2
 }
 
-func helperTripleEmphasis(p *parser, out *bytes.Buffer, data []byte, offset int, c byte) int {
-	i := 0
+func helperTripleEmphasis(p *parser, out *Node, data []byte, offset int, c byte) int {
+	d, at := p.delimitersFor(data)
 	origData := data
 	data = data[offset:]
 
-	for i < len(data) {
-		length := helperFindEmphChar(data[i:], c)
+	i := d.closeEmph(c, 3, at+offset) - at - offset
+	if i >= len(data) {
+		return 0
+	}
+
+	switch {
+	case i+2 < len(data) && data[i+1] == c && data[i+2] == c:
+		// triple symbol found
+		p.inline(out.add(TripleEmphasis), data[:i])
+		return i + 3
+	case (i+1 < len(data) && data[i+1] == c):
+		// double symbol found, hand over to emph1
+		length := helperEmphasis(p, out, origData[offset-2:], c)
 		if length == 0 {
 			return 0
+		} else {
+			return length - 2
 		}
-		i += length
-
-		// skip whitespace preceded symbols
-		if data[i] != c || isspace(data[i-1]) {
-			continue
-		}
-
-		switch {
-		case i+2 < len(data) && data[i+1] == c && data[i+2] == c:
-			// triple symbol found
-			var work bytes.Buffer
-
-			p.inline(&work, data[:i])
-			if work.Len() > 0 {
-				p.r.TripleEmphasis(out, work.Bytes())
-			}
-			return i + 3
-		case (i+1 < len(data) && data[i+1] == c):
-			// double symbol found, hand over to emph1
-			length = helperEmphasis(p, out, origData[offset-2:], c)
-			if length == 0 {
-				return 0
-			} else {
-				return length - 2
-			}
-		default:
-			// single symbol found, hand over to emph2
-			length = helperDoubleEmphasis(p, out, origData[offset-1:], c)
-			if length == 0 {
-				return 0
-			} else {
-				return length - 1
-			}
+	default:
+		// single symbol found, hand over to emph2
+		length := helperDoubleEmphasis(p, out, origData[offset-1:], c)
+		if length == 0 {
+			return 0
+		} else {
+			return length - 1
 		}
 	}
-	return 0
 }
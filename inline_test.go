@@ -14,13 +14,15 @@
 package blackfriday
 
 import (
+	"bytes"
 	"regexp"
+	"strconv"
 	"testing"
 
 	"strings"
 )
 
-func runMarkdownInline(input string, extensions, htmlFlags int, params HtmlRendererParameters) string {
+func runMarkdownInline(input string, extensions Extensions, htmlFlags HtmlFlags, params HtmlRendererParameters) string {
 	extensions |= EXTENSION_AUTOLINK
 	extensions |= EXTENSION_STRIKETHROUGH
 
@@ -28,7 +30,7 @@ func runMarkdownInline(input string, extensions, htmlFlags int, params HtmlRende
 
 	renderer := HtmlRendererWithParameters(htmlFlags, "", "", params)
 
-	return string(Markdown([]byte(input), renderer, extensions))
+	return string(Markdown([]byte(input), WithRenderer(renderer), WithExtensions(extensions)))
 }
 
 func doTestsInline(t *testing.T, tests []string) {
@@ -56,7 +58,7 @@ func doSafeTestsInline(t *testing.T, tests []string) {
 	doTestsInlineParam(t, transformTests, 0, HTML_SAFELINK, params)
 }
 
-func doTestsInlineParam(t *testing.T, tests []string, extensions, htmlFlags int,
+func doTestsInlineParam(t *testing.T, tests []string, extensions Extensions, htmlFlags HtmlFlags,
 	params HtmlRendererParameters) {
 	// catch and report panics
 	var candidate string
@@ -541,10 +543,36 @@ func TestReferenceLink(t *testing.T) {
 
 		"[ref]\n   [ref]: /url/ \"title\"\n",
 		"<p><a href=\"/url/\" title=\"title\">ref</a></p>\n",
+
+		// an angle bracket at the end of the input
+		"[ref]\n[ref]: <",
+		"<p>[ref]</p>\n",
 	}
 	doLinkTestsInline(t, tests)
 }
 
+func TestReferenceIdWithBrackets(t *testing.T) {
+	// ids can't hold brackets, so neither can the text that stands for one
+	var tests = []string{
+		"[a [b] c][]\n\n[a [b] c]: /url\n",
+		"<p>[a [b] c][]</p>\n\n<p>[a [b] c]: /url</p>\n",
+
+		"[a [b] c]\n\n[a [b] c]: /url\n",
+		"<p>[a [b] c]</p>\n\n<p>[a [b] c]: /url</p>\n",
+
+		"[a [b]\nc][]\n",
+		"<p>[a [b]\nc][]</p>\n",
+
+		"[a [b] c][ref]\n\n[ref]: /url\n",
+		"<p><a href=\"/url\">a [b] c</a></p>\n",
+
+		"x[^a [b]] y[^a]\n\n[^a]: note\n",
+		"<p>x[^a [b]] y<sup class=\"footnote-ref\" id=\"fnref:a\"><a rel=\"footnote\" href=\"#fn:a\">1</a></sup></p>\n" +
+			"<div class=\"footnotes\">\n\n<hr />\n\n<ol>\n<li id=\"fn:a\">note\n</li>\n</ol>\n</div>\n",
+	}
+	doTestsInlineParam(t, tests, EXTENSION_FOOTNOTES, 0, HtmlRendererParameters{})
+}
+
 func TestTags(t *testing.T) {
 	var tests = []string{
 		"a <span>tag</span>\n",
@@ -672,6 +700,136 @@ func TestAutoLink(t *testing.T) {
 	doLinkTestsInline(t, tests)
 }
 
+func TestAbbreviations(t *testing.T) {
+	var tests = []string{
+		"The HTML specification\nis maintained by the W3C.\n\n*[HTML]: Hyper Text Markup Language\n*[W3C]:  World Wide Web Consortium\n",
+		"<p>The <abbr title=\"Hyper Text Markup Language\">HTML</abbr> specification\n" +
+			"is maintained by the <abbr title=\"World Wide Web Consortium\">W3C</abbr>.</p>\n",
+
+		// only whole words, and only in text
+		"HTML5, XHTML and *HTML* `HTML` [HTML](/h).\n\n*[HTML]: Hyper Text\n",
+		"<p>HTML5, XHTML and <em><abbr title=\"Hyper Text\">HTML</abbr></em> <code>HTML</code> " +
+			"<a href=\"/h\"><abbr title=\"Hyper Text\">HTML</abbr></a>.</p>\n",
+
+		// the longest one wins, and the case matters
+		"*[Tab]: Tabulator\n*[Tab Key]: The key\n\nTab Key and tab and Tab.\n",
+		"<p><abbr title=\"The key\">Tab Key</abbr> and tab and <abbr title=\"Tabulator\">Tab</abbr>.</p>\n",
+
+		"C++ is \"x\"\n\n*[C++]: A <language>\n*[x]:\n",
+		"<p><abbr title=\"A &lt;language&gt;\">C++</abbr> is &quot;<abbr>x</abbr>&quot;</p>\n",
+
+		// a match that is not a word of its own doesn't hide one inside it
+		"xA B\n\n*[A B]: ab\n*[B]: b\n",
+		"<p>xA <abbr title=\"b\">B</abbr></p>\n",
+
+		"Tab Keys\n\n*[Tab]: Tabulator\n*[Tab Key]: The key\n",
+		"<p><abbr title=\"Tabulator\">Tab</abbr> Keys</p>\n",
+
+		// escaped chars and entities are part of the text
+		"A&B, A&amp;B and A\\&B, not A&amp;Bs.\n\n*[A&B]: and\n",
+		"<p><abbr title=\"and\">A&amp;B</abbr>, <abbr title=\"and\">A&amp;B</abbr> and " +
+			"<abbr title=\"and\">A&amp;B</abbr>, not A&amp;Bs.</p>\n",
+
+		"R\\*D &copy;\n\n*[R*D]: research\n*[&]: and\n*[a]: a\n",
+		"<p><abbr title=\"research\">R*D</abbr> &copy;</p>\n",
+
+		// not a definition
+		"*[]: empty\n\n* [HTML]: list\n",
+		"<p>*[]: empty</p>\n\n<ul>\n<li>[HTML]: list</li>\n</ul>\n",
+	}
+	doTestsInlineParam(t, tests, EXTENSION_ABBREVIATIONS, 0, HtmlRendererParameters{})
+}
+
+func TestMath(t *testing.T) {
+	var tests = []string{
+		"Let $a_1 < b_2$ and $x * y * z$.\n",
+		"<p>Let <span class=\"math inline\">\\(a_1 &lt; b_2\\)</span> and " +
+			"<span class=\"math inline\">\\(x * y * z\\)</span>.</p>\n",
+
+		// no smartypants or escapes in math
+		"$a -- \"b\" \\$ c$ -- \"d\"\n",
+		"<p><span class=\"math inline\">\\(a -- &quot;b&quot; \\$ c\\)</span> &mdash; &ldquo;d&rdquo;</p>\n",
+
+		"$$ \\int_0^1 f $$ in a paragraph\n",
+		"<p><span class=\"math display\">\\[\\int_0^1 f\\]</span> in a paragraph</p>\n",
+
+		// prices are not math
+		"It costs $20 to $30, or \\$5.\n\nNor $ a$ or $a $.\n",
+		"<p>It costs $20 to $30, or $5.</p>\n\n<p>Nor $ a$ or $a $.</p>\n",
+
+		"`$x$` and $`x`$\n",
+		"<p><code>$x$</code> and <span class=\"math inline\">\\(`x`\\)</span></p>\n",
+	}
+	doTestsInlineParam(t, tests, EXTENSION_MATH, HTML_USE_SMARTYPANTS, HtmlRendererParameters{})
+}
+
+func TestExtendedAutoLink(t *testing.T) {
+	var tests = []string{
+		"Visit www.commonmark.org/help for more.\n",
+		"<p>Visit <a href=\"http://www.commonmark.org/help\">www.commonmark.org/help</a> for more.</p>\n",
+
+		"Visit www.commonmark.org.\n\nVisit www.commonmark.org/a.b.\n",
+		"<p>Visit <a href=\"http://www.commonmark.org\">www.commonmark.org</a>.</p>\n\n" +
+			"<p>Visit <a href=\"http://www.commonmark.org/a.b\">www.commonmark.org/a.b</a>.</p>\n",
+
+		"www.google.com/search?q=Markup+(business)\n\nwww.google.com/search?q=Markup+(business)))\n",
+		"<p><a href=\"http://www.google.com/search?q=Markup+(business)\">www.google.com/search?q=Markup+(business)</a></p>\n\n" +
+			"<p><a href=\"http://www.google.com/search?q=Markup+(business)\">www.google.com/search?q=Markup+(business)</a>))</p>\n",
+
+		"(www.google.com/search?q=Markup+(business))\n",
+		"<p>(<a href=\"http://www.google.com/search?q=Markup+(business)\">www.google.com/search?q=Markup+(business)</a>)</p>\n",
+
+		"www.google.com/search?q=commonmark&hl=en\n\nwww.google.com/search?q=commonmark&hl;\n",
+		"<p><a href=\"http://www.google.com/search?q=commonmark&amp;hl=en\">www.google.com/search?q=commonmark&amp;hl=en</a></p>\n\n" +
+			"<p><a href=\"http://www.google.com/search?q=commonmark\">www.google.com/search?q=commonmark</a>&hl;</p>\n",
+
+		"www.commonmark.org/he<lp\n",
+		"<p><a href=\"http://www.commonmark.org/he\">www.commonmark.org/he</a>&lt;lp</p>\n",
+
+		"http://commonmark.org/help(foo)). and https://x.org/?a=b.\n",
+		"<p><a href=\"http://commonmark.org/help(foo)\">http://commonmark.org/help(foo)</a>). and " +
+			"<a href=\"https://x.org/?a=b\">https://x.org/?a=b</a>.</p>\n",
+
+		// not at the start of a word, or not a domain
+		"awww.example.com www. www.a_b.c_d www.\n",
+		"<p>awww.example.com www. www.a_b.c_d www.</p>\n",
+
+		"*www.example.com* and ~~www.example.com~~\n",
+		"<p><em><a href=\"http://www.example.com\">www.example.com</a></em> and " +
+			"<del><a href=\"http://www.example.com\">www.example.com</a></del></p>\n",
+
+		"www.münchen.de/straße, bitte\n",
+		"<p><a href=\"http://www.münchen.de/straße\">www.münchen.de/straße</a>, bitte</p>\n",
+
+		"foo@bar.baz\n",
+		"<p><a href=\"mailto:foo@bar.baz\">foo@bar.baz</a></p>\n",
+
+		"hello@mail+xyz.example isn't valid, but hello+xyz@mail.example is.\n",
+		"<p>hello@mail+xyz.example isn't valid, but <a href=\"mailto:hello+xyz@mail.example\">hello+xyz@mail.example</a> is.</p>\n",
+
+		"a.b-c_d@a.b\n\na.b-c_d@a.b.\n\na.b-c_d@a.b-\n",
+		"<p><a href=\"mailto:a.b-c_d@a.b\">a.b-c_d@a.b</a></p>\n\n" +
+			"<p><a href=\"mailto:a.b-c_d@a.b\">a.b-c_d@a.b</a>.</p>\n\n" +
+			"<p>a.b-c_d@a.b-</p>\n",
+
+		"user@müller.de and @home and user@localhost\n",
+		"<p><a href=\"mailto:user@müller.de\">user@müller.de</a> and @home and user@localhost</p>\n",
+
+		// not within a word
+		"ünïcode@例え.jp and a\\_b@example.com, but \\_b@example.com\n",
+		"<p>ünïcode@例え.jp and a_b@example.com, but <a href=\"mailto:_b@example.com\">_b@example.com</a></p>\n",
+
+		"mailto:foo@bar.com and xmailto:foo@bar.com\n",
+		"<p><a href=\"mailto:foo@bar.com\">foo@bar.com</a> and xmailto:<a href=\"mailto:foo@bar.com\">foo@bar.com</a></p>\n",
+
+		// links are not linked again
+		"[www.example.com](/url) and [me@example.com](/url)\n",
+		"<p><a href=\"/url\">www.example.com</a> and <a href=\"/url\">me@example.com</a></p>\n",
+	}
+	doTestsInlineParam(t, tests, EXTENSION_EXTENDED_AUTOLINK|EXTENSION_NO_INTRA_EMPHASIS, 0,
+		HtmlRendererParameters{})
+}
+
 var footnoteTests = []string{
 	"testing footnotes.[^a]\n\n[^a]: This is the note\n",
 	`<p>testing footnotes.<sup class="footnote-ref" id="fnref:a"><a rel="footnote" href="#fn:a">1</a></sup></p>
@@ -753,19 +911,19 @@ what happens here
 `,
 
 	"testing inline^[this is the note] notes.\n",
-	`<p>testing inline<sup class="footnote-ref" id="fnref:this-is-the-note"><a rel="footnote" href="#fn:this-is-the-note">1</a></sup> notes.</p>
+	`<p>testing inline<sup class="footnote-ref" id="fnref:1"><a rel="footnote" href="#fn:1">1</a></sup> notes.</p>
 <div class="footnotes">
 
 <hr />
 
 <ol>
-<li id="fn:this-is-the-note">this is the note</li>
+<li id="fn:1">this is the note</li>
 </ol>
 </div>
 `,
 
 	"testing multiple[^1] types^[inline note] of notes[^2]\n\n[^2]: the second deferred note\n[^1]: the first deferred note\n\n\twhich happens to be a block\n",
-	`<p>testing multiple<sup class="footnote-ref" id="fnref:1"><a rel="footnote" href="#fn:1">1</a></sup> types<sup class="footnote-ref" id="fnref:inline-note"><a rel="footnote" href="#fn:inline-note">2</a></sup> of notes<sup class="footnote-ref" id="fnref:2"><a rel="footnote" href="#fn:2">3</a></sup></p>
+	`<p>testing multiple<sup class="footnote-ref" id="fnref:1"><a rel="footnote" href="#fn:1">1</a></sup> types<sup class="footnote-ref" id="fnref:2-1"><a rel="footnote" href="#fn:2-1">2</a></sup> of notes<sup class="footnote-ref" id="fnref:2"><a rel="footnote" href="#fn:2">3</a></sup></p>
 <div class="footnotes">
 
 <hr />
@@ -775,7 +933,7 @@ what happens here
 
 <p>which happens to be a block</p>
 </li>
-<li id="fn:inline-note">inline note</li>
+<li id="fn:2-1">inline note</li>
 <li id="fn:2">the second deferred note
 </li>
 </ol>
@@ -788,7 +946,7 @@ what happens here
 
     may be multiple paragraphs.
 `,
-	`<p>This is a footnote<sup class="footnote-ref" id="fnref:1"><a rel="footnote" href="#fn:1">1</a></sup><sup class="footnote-ref" id="fnref:and-this-is-an-i"><a rel="footnote" href="#fn:and-this-is-an-i">2</a></sup></p>
+	`<p>This is a footnote<sup class="footnote-ref" id="fnref:1"><a rel="footnote" href="#fn:1">1</a></sup><sup class="footnote-ref" id="fnref:2"><a rel="footnote" href="#fn:2">2</a></sup></p>
 <div class="footnotes">
 
 <hr />
@@ -798,7 +956,7 @@ what happens here
 
 <p>may be multiple paragraphs.</p>
 </li>
-<li id="fn:and-this-is-an-i">and this is an inline footnote</li>
+<li id="fn:2">and this is an inline footnote</li>
 </ol>
 </div>
 `,
@@ -811,6 +969,89 @@ what happens here
 
 	"Some text.[^note1][^note2]\n\n[^note1]: fn1\n[^note2]: fn2\n",
 	"<p>Some text.<sup class=\"footnote-ref\" id=\"fnref:note1\"><a rel=\"footnote\" href=\"#fn:note1\">1</a></sup><sup class=\"footnote-ref\" id=\"fnref:note2\"><a rel=\"footnote\" href=\"#fn:note2\">2</a></sup></p>\n<div class=\"footnotes\">\n\n<hr />\n\n<ol>\n<li id=\"fn:note1\">fn1\n</li>\n<li id=\"fn:note2\">fn2\n</li>\n</ol>\n</div>\n",
+
+	"A[^a] and again[^a].\n\n[^a]: The note.\n",
+	`<p>A<sup class="footnote-ref" id="fnref:a"><a rel="footnote" href="#fn:a">1</a></sup> and again<sup class="footnote-ref" id="fnref:a"><a rel="footnote" href="#fn:a">1</a></sup>.</p>
+<div class="footnotes">
+
+<hr />
+
+<ol>
+<li id="fn:a">The note.
+</li>
+</ol>
+</div>
+`,
+
+	"Inline^[with *emphasis* and [a link](/url)] notes.\n",
+	`<p>Inline<sup class="footnote-ref" id="fnref:1"><a rel="footnote" href="#fn:1">1</a></sup> notes.</p>
+<div class="footnotes">
+
+<hr />
+
+<ol>
+<li id="fn:1">with <em>emphasis</em> and <a href="/url">a link</a></li>
+</ol>
+</div>
+`,
+
+	"Nested^[outer ^[inner] note] notes.\n",
+	`<p>Nested<sup class="footnote-ref" id="fnref:1"><a rel="footnote" href="#fn:1">1</a></sup> notes.</p>
+<div class="footnotes">
+
+<hr />
+
+<ol>
+<li id="fn:1">outer <sup class="footnote-ref" id="fnref:2"><a rel="footnote" href="#fn:2">2</a></sup> note</li>
+<li id="fn:2">inner</li>
+</ol>
+</div>
+`,
+
+	"Same^[note] start^[note] and^[] empty.\n",
+	`<p>Same<sup class="footnote-ref" id="fnref:1"><a rel="footnote" href="#fn:1">1</a></sup> start<sup class="footnote-ref" id="fnref:2"><a rel="footnote" href="#fn:2">2</a></sup> and<sup class="footnote-ref" id="fnref:3"><a rel="footnote" href="#fn:3">3</a></sup> empty.</p>
+<div class="footnotes">
+
+<hr />
+
+<ol>
+<li id="fn:1">note</li>
+<li id="fn:2">note</li>
+<li id="fn:3"></li>
+</ol>
+</div>
+`,
+
+	"Not a link^[note](/url) or reference^[note] [ref].\n\n[ref]: /ref\n",
+	`<p>Not a link<sup class="footnote-ref" id="fnref:1"><a rel="footnote" href="#fn:1">1</a></sup>(/url) or reference<sup class="footnote-ref" id="fnref:2"><a rel="footnote" href="#fn:2">2</a></sup> <a href="/ref">ref</a>.</p>
+<div class="footnotes">
+
+<hr />
+
+<ol>
+<li id="fn:1">note</li>
+<li id="fn:2">note</li>
+</ol>
+</div>
+`,
+
+	"Notes[^one] and links [two] keep apart.\n\n[one]: /url\n[^two]: note\n",
+	"<p>Notes[^one] and links [two] keep apart.</p>\n",
+
+	"Inline^[first] and named[^1] notes^[third].\n\n[^1]: second\n",
+	`<p>Inline<sup class="footnote-ref" id="fnref:1-1"><a rel="footnote" href="#fn:1-1">1</a></sup> and named<sup class="footnote-ref" id="fnref:1"><a rel="footnote" href="#fn:1">2</a></sup> notes<sup class="footnote-ref" id="fnref:3"><a rel="footnote" href="#fn:3">3</a></sup>.</p>
+<div class="footnotes">
+
+<hr />
+
+<ol>
+<li id="fn:1-1">first</li>
+<li id="fn:1">second
+</li>
+<li id="fn:3">third</li>
+</ol>
+</div>
+`,
 }
 
 func TestFootnotes(t *testing.T) {
@@ -883,3 +1124,144 @@ func TestSmartFractions(t *testing.T) {
 
 	doTestsInlineParam(t, tests, 0, HTML_USE_SMARTYPANTS|HTML_SMARTYPANTS_FRACTIONS, HtmlRendererParameters{})
 }
+
+// mention turns @name into a link to the profile of the user.
+func mention(out *Node, data []byte, offset int) int {
+	if offset > 0 && isalnum(data[offset-1]) {
+		return 0
+	}
+	end := offset + 1
+	for end < len(data) && isalnum(data[end]) {
+		end++
+	}
+	if end == offset+1 {
+		return 0
+	}
+	link := NewNode(Link)
+	link.Destination = append([]byte("/users/"), data[offset+1:end]...)
+	link.AppendChild(NewNode(Text))
+	link.FirstChild.Literal = data[offset:end]
+	out.AppendChild(link)
+	return end - offset
+}
+
+// emoji turns :name: into a custom span.
+func emoji(out *Node, data []byte, offset int) int {
+	end := bytes.IndexByte(data[offset+1:], ':')
+	if end <= 0 || bytes.IndexByte(data[offset+1:offset+1+end], ' ') >= 0 {
+		return 0
+	}
+	name := string(data[offset+1 : offset+1+end])
+	span := NewNode(CustomSpan)
+	span.Value = name
+	span.Render = func(r Renderer, out Writer, text []byte) {
+		r.RawHtmlTag(out, []byte(`<img class="emoji" alt="`+name+`" />`))
+	}
+	out.AppendChild(span)
+	return end + 2
+}
+
+func TestInlineParser(t *testing.T) {
+	var tests = []string{
+		"hi @bob and @alice!\n",
+		"<p>hi <a href=\"/users/bob\">@bob</a> and <a href=\"/users/alice\">@alice</a>!</p>\n",
+
+		"mail me at bob@example.com or @ here\n",
+		"<p>mail me at bob@example.com or @ here</p>\n",
+
+		"*@bob* is here\n",
+		"<p><em><a href=\"/users/bob\">@bob</a></em> is here</p>\n",
+
+		"I :heart: it\n",
+		"<p>I <img class=\"emoji\" alt=\"heart\" /> it</p>\n",
+
+		// autolinks still get their turn when the emoji parser passes
+		"see http://example.com/ :)\n",
+		"<p>see <a href=\"http://example.com/\">http://example.com/</a> :)</p>\n",
+	}
+	for i := 0; i < len(tests); i += 2 {
+		output, err := MarkdownE([]byte(tests[i]),
+			WithRenderer(HtmlRenderer(0, "", "")),
+			WithExtensions(EXTENSION_AUTOLINK),
+			WithInlineParser('@', mention),
+			WithInlineParser(':', emoji))
+		if err != nil || string(output) != tests[i+1] {
+			t.Errorf("Input %q:\nExpected[%#v]\nActual  [%#v] %v", tests[i], tests[i+1], string(output), err)
+		}
+	}
+
+	// the custom span is in the tree
+	doc := Parse([]byte("I :heart: it\n"), WithInlineParser(':', emoji))
+	span := doc.FirstChild.FirstChild.Next
+	if span.Type != CustomSpan || span.Value != "heart" || span.Start.Column != 3 || span.End.Column != 10 {
+		t.Errorf("unexpected custom span %v from %v to %v", span, span.Start, span.End)
+	}
+
+	// parsers that go past the end get caught
+	greedy := func(out *Node, data []byte, offset int) int { return len(data) }
+	_, err := MarkdownE([]byte("a %b\n"), WithInlineParser('%', greedy))
+	if _, ok := err.(*InvariantError); !ok {
+		t.Errorf("expected an *InvariantError, got %v", err)
+	}
+}
+
+// Inputs that used to take quadratic time, as a function of their size.
+var pathologicalInputs = []struct {
+	name  string
+	input func(n int) string
+}{
+	{"UnclosedEmphasis", func(n int) string { return strings.Repeat("*a ", n) }},
+	{"UnclosedStrong", func(n int) string { return strings.Repeat("**a ", n) }},
+	{"UnclosedTriple", func(n int) string { return strings.Repeat("***a ", n) }},
+	{"UnclosedBrackets", func(n int) string { return strings.Repeat("[", n) }},
+	{"NestedBrackets", func(n int) string { return strings.Repeat("[", n) + strings.Repeat("]", n) }},
+	{"NestedBracketsOverLines", func(n int) string { return strings.Repeat("[a\n", n) + strings.Repeat("]", n) }},
+	{"NestedFootnotes", func(n int) string { return strings.Repeat("[^a", n) + strings.Repeat("]", n) }},
+	{"UnclosedLinks", func(n int) string { return strings.Repeat("[a](", n) }},
+	{"EmphasisInBrackets", func(n int) string { return strings.Repeat("[*a ", n) }},
+	{"UnclosedMath", func(n int) string { return strings.Repeat("$a ", n) }},
+	{"UnclosedCodeSpan", func(n int) string { return strings.Repeat("`", n) }},
+	{"UnclosedTags", func(n int) string { return strings.Repeat("a <b", n) }},
+	{"UnclosedAutoLinks", func(n int) string { return strings.Repeat("<a:b", n) }},
+	{"UnclosedComments", func(n int) string { return strings.Repeat("<!-- <? <![CDATA[ <!a ", n) }},
+	{"UnclosedAttributes", func(n int) string { return strings.Repeat("<a b='", n) }},
+	{"UnclosedLinkDestinations", func(n int) string { return strings.Repeat("[a](<b [a](b(c [a](d 'e ", n) }},
+	{"NestedLinks", func(n int) string { return strings.Repeat("[a ![b ", n) + strings.Repeat("](c)", 2*n) }},
+	{"LongAbbreviation", func(n int) string {
+		return "*[" + strings.Repeat("ab ", n/2) + "a]: x\n\n" + strings.Repeat("ab ", n)
+	}},
+	{"ParagraphAfterDefinition", func(n int) string { return "Term\n: def\n" + strings.Repeat("x\n", n) }},
+}
+
+const pathologicalExtensions = commonExtensions | EXTENSION_ABBREVIATIONS | EXTENSION_MATH |
+	EXTENSION_DEFINITION_LISTS
+
+func TestPathologicalInputs(t *testing.T) {
+	for _, test := range pathologicalInputs {
+		input := []byte(test.input(20000) + "\n")
+
+		// the work spent has to stay in proportion to the size of the input;
+		// every inline parser counts the bytes it looks at
+		limits := Limits{MaxInlineWork: 20 * len(input)}
+		for _, extensions := range []Extensions{pathologicalExtensions, pathologicalExtensions | EXTENSION_COMMONMARK} {
+			_, err := MarkdownE(input, WithExtensions(extensions), WithLimits(limits))
+			if err != nil {
+				t.Errorf("%s (extensions %#x): %v", test.name, extensions, err)
+			}
+		}
+	}
+}
+
+func BenchmarkPathologicalInputs(b *testing.B) {
+	for _, test := range pathologicalInputs {
+		for _, n := range []int{1000, 10000, 100000} {
+			input := []byte(test.input(n) + "\n")
+			b.Run(test.name+"/"+strconv.Itoa(n), func(b *testing.B) {
+				b.SetBytes(int64(len(input)))
+				for i := 0; i < b.N; i++ {
+					Markdown(input, WithExtensions(pathologicalExtensions))
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,165 @@
+//
+// Blackfriday Markdown Processor
+// Available at http://github.com/russross/blackfriday
+//
+// Copyright © 2011 Russ Ross <russ@russross.com>.
+// Distributed under the Simplified BSD License.
+// See README.md for details.
+//
+
+//
+//
+// JSON encoding of the document tree
+//
+//
+
+package blackfriday
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// jsonNode is how a Node looks in JSON. The fields come out in this order,
+// and the ones a node doesn't use are left out, so that the same tree always
+// gives the same bytes.
+type jsonNode struct {
+	Type         string      `json:"type"`
+	Literal      string      `json:"literal,omitempty"`
+	Level        int         `json:"level,omitempty"`
+	HeaderID     string      `json:"headerID,omitempty"`
+	ListFlags    int         `json:"listFlags,omitempty"`
+	ListStart    int         `json:"listStart,omitempty"`
+	RefLink      string      `json:"refLink,omitempty"`
+	Lang         string      `json:"lang,omitempty"`
+	Destination  string      `json:"destination,omitempty"`
+	Title        string      `json:"title,omitempty"`
+	LinkType     int         `json:"linkType,omitempty"`
+	NoteID       int         `json:"noteID,omitempty"`
+	IsInlineNote bool        `json:"isInlineNote,omitempty"`
+	Columns      []int       `json:"columns,omitempty"`
+	Align        int         `json:"align,omitempty"`
+	IsHeader     bool        `json:"isHeader,omitempty"`
+	IsDisplay    bool        `json:"isDisplay,omitempty"`
+	Value        interface{} `json:"value,omitempty"`
+	Start        *Position   `json:"start,omitempty"`
+	End          *Position   `json:"end,omitempty"`
+	Children     []*jsonNode `json:"children,omitempty"`
+}
+
+// MarshalJSON encodes the tree rooted at 'n' as JSON. Every node becomes an
+// object with its type, the fields of the node that are set, and its children:
+//
+//	{"type":"Header","level":1,"start":{...},"end":{...},"children":[
+//	    {"type":"Text","literal":"Title","start":{...},"end":{...}}]}
+//
+// The Render function of a custom node is left out, and its Value is encoded
+// like any other value.
+func (n *Node) MarshalJSON() ([]byte, error) {
+	return json.Marshal(n.toJSON())
+}
+
+func (n *Node) toJSON() *jsonNode {
+	j := &jsonNode{
+		Type:         n.Type.String(),
+		Literal:      string(n.Literal),
+		Level:        n.Level,
+		HeaderID:     n.HeaderID,
+		ListFlags:    n.ListFlags,
+		ListStart:    n.ListStart,
+		RefLink:      string(n.RefLink),
+		Lang:         n.Lang,
+		Destination:  string(n.Destination),
+		Title:        string(n.Title),
+		LinkType:     n.LinkType,
+		NoteID:       n.NoteID,
+		IsInlineNote: n.IsInlineNote,
+		Columns:      n.Columns,
+		Align:        n.Align,
+		IsHeader:     n.IsHeader,
+		IsDisplay:    n.IsDisplay,
+		Value:        n.Value,
+	}
+	if n.Start != (Position{}) || n.End != (Position{}) {
+		start, end := n.Start, n.End
+		j.Start, j.End = &start, &end
+	}
+	for c := n.FirstChild; c != nil; c = c.Next {
+		j.Children = append(j.Children, c.toJSON())
+	}
+	return j
+}
+
+// UnmarshalJSON replaces 'n' with the tree encoded by MarshalJSON. The tree
+// can then be rendered with RenderTree like a parsed one.
+func (n *Node) UnmarshalJSON(data []byte) error {
+	var j jsonNode
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	node, err := j.toNode()
+	if err != nil {
+		return err
+	}
+	*n = *node
+	for c := n.FirstChild; c != nil; c = c.Next {
+		c.Parent = n
+	}
+	return nil
+}
+
+func (j *jsonNode) toNode() (*Node, error) {
+	typ := NodeType(-1)
+	for t, name := range nodeTypeNames {
+		if name == j.Type {
+			typ = NodeType(t)
+		}
+	}
+	if typ < 0 {
+		return nil, fmt.Errorf("blackfriday: unknown node type %q", j.Type)
+	}
+
+	n := NewNode(typ)
+	if len(j.Children) > 0 && !n.IsContainer() {
+		return nil, fmt.Errorf("blackfriday: %s node with children", typ)
+	}
+	if j.Literal != "" {
+		n.Literal = []byte(j.Literal)
+	}
+	n.Level = j.Level
+	n.HeaderID = j.HeaderID
+	n.ListFlags = j.ListFlags
+	n.ListStart = j.ListStart
+	if j.RefLink != "" {
+		n.RefLink = []byte(j.RefLink)
+	}
+	n.Lang = j.Lang
+	if j.Destination != "" {
+		n.Destination = []byte(j.Destination)
+	}
+	if j.Title != "" {
+		n.Title = []byte(j.Title)
+	}
+	n.LinkType = j.LinkType
+	n.NoteID = j.NoteID
+	n.IsInlineNote = j.IsInlineNote
+	n.Columns = j.Columns
+	n.Align = j.Align
+	n.IsHeader = j.IsHeader
+	n.IsDisplay = j.IsDisplay
+	n.Value = j.Value
+	if j.Start != nil {
+		n.Start = *j.Start
+	}
+	if j.End != nil {
+		n.End = *j.End
+	}
+	for _, c := range j.Children {
+		child, err := c.toNode()
+		if err != nil {
+			return nil, err
+		}
+		n.AppendChild(child)
+	}
+	return n, nil
+}
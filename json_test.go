@@ -0,0 +1,145 @@
+//
+// Blackfriday Markdown Processor
+// Available at http://github.com/russross/blackfriday
+//
+// Copyright © 2011 Russ Ross <russ@russross.com>.
+// Distributed under the Simplified BSD License.
+// See README.md for details.
+//
+
+//
+// Unit tests for the JSON encoding of the document tree
+//
+
+package blackfriday
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestNodeJSON(t *testing.T) {
+	input := "## Title {#id}\n\n```go\ncode\n```\n\n* [link](/url \"Title\")\n"
+	doc := Parse([]byte(input), WithExtensions(commonExtensions|EXTENSION_HEADER_IDS))
+	Walk(doc, func(node *Node, entering bool) WalkStatus {
+		node.Start, node.End = Position{}, Position{}
+		return GoToNext
+	})
+	actual, err := json.MarshalIndent(doc, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{
+	"type": "Document",
+	"children": [
+		{
+			"type": "Header",
+			"level": 2,
+			"headerID": "id",
+			"children": [
+				{
+					"type": "Text",
+					"literal": "Title"
+				}
+			]
+		},
+		{
+			"type": "CodeBlock",
+			"literal": "code\n",
+			"lang": "go"
+		},
+		{
+			"type": "List",
+			"listFlags": 4,
+			"children": [
+				{
+					"type": "Item",
+					"listFlags": 4,
+					"children": [
+						{
+							"type": "Link",
+							"destination": "/url",
+							"title": "Title",
+							"children": [
+								{
+									"type": "Text",
+									"literal": "link"
+								}
+							]
+						},
+						{
+							"type": "Text",
+							"literal": "\n"
+						}
+					]
+				}
+			]
+		}
+	]
+}`
+	if string(actual) != expected {
+		t.Errorf("\nExpected[%s]\nActual  [%s]", expected, actual)
+	}
+}
+
+func TestNodeJSONRoundTrip(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.text"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	extensions := commonExtensions | EXTENSION_FOOTNOTES | EXTENSION_TITLEBLOCK
+	for _, filename := range files {
+		input, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc := Parse(input, WithExtensions(extensions))
+		data, err := json.Marshal(doc)
+		if err != nil {
+			t.Errorf("%s: %v", filename, err)
+			continue
+		}
+
+		var decoded Node
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Errorf("%s: %v", filename, err)
+			continue
+		}
+		again, err := json.Marshal(&decoded)
+		if err != nil {
+			t.Errorf("%s: %v", filename, err)
+			continue
+		}
+		if !bytes.Equal(again, data) {
+			t.Errorf("%s: the decoded tree encodes differently\nExpected[%s]\nActual  [%s]",
+				filename, data, again)
+		}
+
+		expected := RenderTree(doc, HtmlRenderer(HTML_TOC, "", ""))
+		actual := RenderTree(&decoded, HtmlRenderer(HTML_TOC, "", ""))
+		if !bytes.Equal(actual, expected) {
+			t.Errorf("%s: the decoded tree renders differently\nExpected[%s]\nActual  [%s]",
+				filename, expected, actual)
+		}
+	}
+}
+
+func TestNodeJSONErrors(t *testing.T) {
+	var tests = []string{
+		`{"type":"Paragraf"}`,
+		"blackfriday: unknown node type \"Paragraf\"",
+
+		`{"type":"Paragraph","children":[{"type":"Text","children":[{"type":"Text"}]}]}`,
+		"blackfriday: Text node with children",
+	}
+	for i := 0; i+1 < len(tests); i += 2 {
+		var n Node
+		err := json.Unmarshal([]byte(tests[i]), &n)
+		if err == nil || err.Error() != tests[i+1] {
+			t.Errorf("\nInput   [%s]\nExpected[%s]\nActual  [%v]", tests[i], tests[i+1], err)
+		}
+	}
+}
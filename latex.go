@@ -23,6 +23,7 @@ import (
 //
 // Do not create this directly, instead use the LatexRenderer function.
 type Latex struct {
+	spelledOut map[string]bool // the abbreviations expanded so far
 }
 
 // LatexRenderer creates and configures a Latex object, which
@@ -34,12 +35,27 @@ func LatexRenderer(flags int) Renderer {
 	return &Latex{}
 }
 
+// NewDocument returns a renderer with the same configuration, to render a
+// single document with.
+func (options *Latex) NewDocument() Renderer {
+	return &Latex{}
+}
+
+func (options *Latex) base() Renderer {
+	return options
+}
+
+// Reset forgets about the document rendered so far.
+func (options *Latex) Reset() {
+	options.spelledOut = nil
+}
+
 func (options *Latex) GetFlags() int {
 	return 0
 }
 
 // render code chunks using verbatim, or listings if we have a language
-func (options *Latex) BlockCode(out *bytes.Buffer, text []byte, lang string) {
+func (options *Latex) BlockCode(out Writer, text []byte, lang string) {
 	if lang == "" {
 		out.WriteString("\n\\begin{verbatim}\n")
 	} else {
@@ -55,25 +71,32 @@ func (options *Latex) BlockCode(out *bytes.Buffer, text []byte, lang string) {
 	}
 }
 
-func (options *Latex) TitleBlock(out *bytes.Buffer, text []byte) {
+// MathBlock writes display math as it is, without escaping it.
+func (options *Latex) MathBlock(out Writer, text []byte) {
+	out.WriteString("\n\\[\n")
+	out.Write(text)
+	out.WriteString("\n\\]\n")
+}
+
+func (options *Latex) TitleBlock(out Writer, text []byte) {
 
 }
 
-func (options *Latex) BlockQuote(out *bytes.Buffer, text []byte) {
+func (options *Latex) BlockQuote(out Writer, text []byte) {
 	out.WriteString("\n\\begin{quotation}\n")
 	out.Write(text)
 	out.WriteString("\n\\end{quotation}\n")
 }
 
-func (options *Latex) BlockHtml(out *bytes.Buffer, text []byte) {
+func (options *Latex) BlockHtml(out Writer, text []byte) {
 	// a pretty lame thing to do...
 	out.WriteString("\n\\begin{verbatim}\n")
 	out.Write(text)
 	out.WriteString("\n\\end{verbatim}\n")
 }
 
-func (options *Latex) Header(out *bytes.Buffer, text func() bool, level int, id string) {
-	marker := out.Len()
+func (options *Latex) Header(out Writer, text func() bool, level int, id string) {
+	marker := len(written(out))
 
 	switch level {
 	case 1:
@@ -90,25 +113,25 @@ func (options *Latex) Header(out *bytes.Buffer, text func() bool, level int, id
 		out.WriteString("\n\\textbf{")
 	}
 	if !text() {
-		out.Truncate(marker)
+		rollback(out, marker)
 		return
 	}
 	out.WriteString("}\n")
 }
 
-func (options *Latex) HRule(out *bytes.Buffer) {
+func (options *Latex) HRule(out Writer) {
 	out.WriteString("\n\\HRule\n")
 }
 
-func (options *Latex) List(out *bytes.Buffer, text func() bool, flags int) {
-	marker := out.Len()
+func (options *Latex) List(out Writer, text func() bool, flags int) {
+	marker := len(written(out))
 	if flags&LIST_TYPE_ORDERED != 0 {
 		out.WriteString("\n\\begin{enumerate}\n")
 	} else {
 		out.WriteString("\n\\begin{itemize}\n")
 	}
 	if !text() {
-		out.Truncate(marker)
+		rollback(out, marker)
 		return
 	}
 	if flags&LIST_TYPE_ORDERED != 0 {
@@ -118,22 +141,55 @@ func (options *Latex) List(out *bytes.Buffer, text func() bool, flags int) {
 	}
 }
 
-func (options *Latex) ListItem(out *bytes.Buffer, text []byte, flags int) {
-	out.WriteString("\n\\item ")
+func (options *Latex) ListItem(out Writer, text []byte, flags int) {
+	switch {
+	case flags&LIST_ITEM_CHECKED != 0:
+		out.WriteString("\n\\item[$\\boxtimes$] ")
+	case flags&LIST_ITEM_TASK != 0:
+		out.WriteString("\n\\item[$\\square$] ")
+	default:
+		out.WriteString("\n\\item ")
+	}
+	out.Write(text)
+}
+
+func (options *Latex) DefinitionList(out Writer, text func() bool, flags int) {
+	marker := len(written(out))
+	out.WriteString("\n\\begin{description}\n")
+	if !text() {
+		rollback(out, marker)
+		return
+	}
+	out.WriteString("\n\\end{description}\n")
+}
+
+func (options *Latex) DefinitionTerm(out Writer, text []byte, flags int) {
+	out.WriteString("\n\\item[{")
 	out.Write(text)
+	out.WriteString("}]")
 }
 
-func (options *Latex) Paragraph(out *bytes.Buffer, text func() bool) {
-	marker := out.Len()
+func (options *Latex) DefinitionData(out Writer, text []byte, flags int) {
+	// a definition after the first one of a term starts a paragraph of its own
+	if bytes.HasSuffix(written(out), []byte("}]")) {
+		out.WriteString(" ")
+	} else {
+		out.WriteString("\n\n")
+	}
+	out.Write(text)
+}
+
+func (options *Latex) Paragraph(out Writer, text func() bool) {
+	marker := len(written(out))
 	out.WriteString("\n")
 	if !text() {
-		out.Truncate(marker)
+		rollback(out, marker)
 		return
 	}
 	out.WriteString("\n")
 }
 
-func (options *Latex) Table(out *bytes.Buffer, header []byte, body []byte, columnData []int) {
+func (options *Latex) Table(out Writer, header []byte, body []byte, columnData []int) {
 	out.WriteString("\n\\begin{tabular}{")
 	for _, elt := range columnData {
 		switch elt {
@@ -152,37 +208,37 @@ func (options *Latex) Table(out *bytes.Buffer, header []byte, body []byte, colum
 	out.WriteString("\n\\end{tabular}\n")
 }
 
-func (options *Latex) TableRow(out *bytes.Buffer, text []byte) {
-	if out.Len() > 0 {
+func (options *Latex) TableRow(out Writer, text []byte) {
+	if len(written(out)) > 0 {
 		out.WriteString(" \\\\\n")
 	}
 	out.Write(text)
 }
 
-func (options *Latex) TableHeaderCell(out *bytes.Buffer, text []byte, align int) {
-	if out.Len() > 0 {
+func (options *Latex) TableHeaderCell(out Writer, text []byte, align int) {
+	if len(written(out)) > 0 {
 		out.WriteString(" & ")
 	}
 	out.Write(text)
 }
 
-func (options *Latex) TableCell(out *bytes.Buffer, text []byte, align int) {
-	if out.Len() > 0 {
+func (options *Latex) TableCell(out Writer, text []byte, align int) {
+	if len(written(out)) > 0 {
 		out.WriteString(" & ")
 	}
 	out.Write(text)
 }
 
 // TODO: this
-func (options *Latex) Footnotes(out *bytes.Buffer, text func() bool) {
+func (options *Latex) Footnotes(out Writer, text func() bool) {
 
 }
 
-func (options *Latex) FootnoteItem(out *bytes.Buffer, name, text []byte, flags int) {
+func (options *Latex) FootnoteItem(out Writer, name, text []byte, flags int) {
 
 }
 
-func (options *Latex) AutoLink(out *bytes.Buffer, link []byte, kind int) {
+func (options *Latex) AutoLink(out Writer, link []byte, kind int) {
 	out.WriteString("\\href{")
 	if kind == LINK_TYPE_EMAIL {
 		out.WriteString("mailto:")
@@ -193,25 +249,37 @@ func (options *Latex) AutoLink(out *bytes.Buffer, link []byte, kind int) {
 	out.WriteString("}")
 }
 
-func (options *Latex) CodeSpan(out *bytes.Buffer, text []byte) {
+func (options *Latex) CodeSpan(out Writer, text []byte) {
 	out.WriteString("\\texttt{")
 	escapeSpecialChars(out, text)
 	out.WriteString("}")
 }
 
-func (options *Latex) DoubleEmphasis(out *bytes.Buffer, text []byte) {
+func (options *Latex) MathSpan(out Writer, text []byte, display bool) {
+	if display {
+		out.WriteString("\\[")
+		out.Write(text)
+		out.WriteString("\\]")
+		return
+	}
+	out.WriteString("$")
+	out.Write(text)
+	out.WriteString("$")
+}
+
+func (options *Latex) DoubleEmphasis(out Writer, text []byte) {
 	out.WriteString("\\textbf{")
 	out.Write(text)
 	out.WriteString("}")
 }
 
-func (options *Latex) Emphasis(out *bytes.Buffer, text []byte) {
+func (options *Latex) Emphasis(out Writer, text []byte) {
 	out.WriteString("\\textit{")
 	out.Write(text)
 	out.WriteString("}")
 }
 
-func (options *Latex) Image(out *bytes.Buffer, link []byte, title []byte, alt []byte) {
+func (options *Latex) Image(out Writer, link []byte, title []byte, alt []byte) {
 	if bytes.HasPrefix(link, []byte("http://")) || bytes.HasPrefix(link, []byte("https://")) {
 		// treat it like a link
 		out.WriteString("\\href{")
@@ -226,11 +294,11 @@ func (options *Latex) Image(out *bytes.Buffer, link []byte, title []byte, alt []
 	}
 }
 
-func (options *Latex) LineBreak(out *bytes.Buffer) {
+func (options *Latex) LineBreak(out Writer) {
 	out.WriteString(" \\\\\n")
 }
 
-func (options *Latex) Link(out *bytes.Buffer, link []byte, title []byte, content []byte) {
+func (options *Latex) Link(out Writer, link []byte, title []byte, content []byte) {
 	out.WriteString("\\href{")
 	out.Write(link)
 	out.WriteString("}{")
@@ -238,24 +306,41 @@ func (options *Latex) Link(out *bytes.Buffer, link []byte, title []byte, content
 	out.WriteString("}")
 }
 
-func (options *Latex) RawHtmlTag(out *bytes.Buffer, tag []byte) {
+func (options *Latex) RawHtmlTag(out Writer, tag []byte) {
 }
 
-func (options *Latex) TripleEmphasis(out *bytes.Buffer, text []byte) {
+func (options *Latex) TripleEmphasis(out Writer, text []byte) {
 	out.WriteString("\\textbf{\\textit{")
 	out.Write(text)
 	out.WriteString("}}")
 }
 
-func (options *Latex) StrikeThrough(out *bytes.Buffer, text []byte) {
+func (options *Latex) StrikeThrough(out Writer, text []byte) {
 	out.WriteString("\\sout{")
 	out.Write(text)
 	out.WriteString("}")
 }
 
 // TODO: this
-func (options *Latex) FootnoteRef(out *bytes.Buffer, ref []byte, id int) {
+func (options *Latex) FootnoteRef(out Writer, ref []byte, id int) {
+
+}
 
+// Abbreviation spells out what an abbreviation stands for the first time it
+// is used, and writes the abbreviation on its own after that.
+func (options *Latex) Abbreviation(out Writer, abbr []byte, title []byte) {
+	if options.spelledOut == nil {
+		options.spelledOut = make(map[string]bool)
+	}
+	if len(title) == 0 || options.spelledOut[string(abbr)] {
+		escapeSpecialChars(out, abbr)
+		return
+	}
+	options.spelledOut[string(abbr)] = true
+	escapeSpecialChars(out, title)
+	out.WriteString(" (")
+	escapeSpecialChars(out, abbr)
+	out.WriteString(")")
 }
 
 func needsBackslash(c byte) bool {
@@ -267,7 +352,7 @@ func needsBackslash(c byte) bool {
 	return false
 }
 
-func escapeSpecialChars(out *bytes.Buffer, text []byte) {
+func escapeSpecialChars(out Writer, text []byte) {
 	for i := 0; i < len(text); i++ {
 		// directly copy normal characters
 		org := i
@@ -288,19 +373,20 @@ func escapeSpecialChars(out *bytes.Buffer, text []byte) {
 	}
 }
 
-func (options *Latex) Entity(out *bytes.Buffer, entity []byte) {
+func (options *Latex) Entity(out Writer, entity []byte) {
 	// TODO: convert this into a unicode character or something
 	out.Write(entity)
 }
 
-func (options *Latex) NormalText(out *bytes.Buffer, text []byte) {
+func (options *Latex) NormalText(out Writer, text []byte) {
 	escapeSpecialChars(out, text)
 }
 
 // header and footer
-func (options *Latex) DocumentHeader(out *bytes.Buffer) {
+func (options *Latex) DocumentHeader(out Writer) {
 	out.WriteString("\\documentclass{article}\n")
 	out.WriteString("\n")
+	out.WriteString("\\usepackage{amssymb}\n")
 	out.WriteString("\\usepackage{graphicx}\n")
 	out.WriteString("\\usepackage{listings}\n")
 	out.WriteString("\\usepackage[margin=1in]{geometry}\n")
@@ -327,6 +413,6 @@ func (options *Latex) DocumentHeader(out *bytes.Buffer) {
 	out.WriteString("\\begin{document}\n")
 }
 
-func (options *Latex) DocumentFooter(out *bytes.Buffer) {
+func (options *Latex) DocumentFooter(out Writer) {
 	out.WriteString("\n\\end{document}\n")
 }
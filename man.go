@@ -0,0 +1,478 @@
+//
+// Blackfriday Markdown Processor
+// Available at http://github.com/russross/blackfriday
+//
+// Copyright © 2011 Russ Ross <russ@russross.com>.
+// Distributed under the Simplified BSD License.
+// See README.md for details.
+//
+
+//
+//
+// Man page rendering backend
+//
+//
+
+package blackfriday
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strconv"
+)
+
+// Man is a type that implements the Renderer interface for man(7) roff
+// output, the format of Unix manual pages.
+//
+// The title block, enabled with EXTENSION_TITLEBLOCK, gives the .TH line:
+//
+//	% mytool(1)
+//	% Jane Doe
+//	% January 2015
+//
+// Level 1 headers start sections and level 2 headers subsections. The terms
+// of a definition list, enabled with EXTENSION_DEFINITION_LISTS, become
+// tagged paragraphs, the usual way of describing an option:
+//
+//	`-v`, `--verbose`
+//	:   Say more about what is going on.
+//
+// Do not create this directly, instead use the ManRenderer function.
+type Man struct {
+	// what is left over from rendering the current document
+	*manState
+}
+
+// manState is what a Man keeps track of while it renders a document.
+type manState struct {
+	authors []byte          // from the title block, for the AUTHORS section
+	lists   []formatterList // the enclosing lists
+	notes   int             // number of footnotes so far
+}
+
+// ManRenderer creates and configures a Man object, which satisfies the
+// Renderer interface.
+func ManRenderer() Renderer {
+	return &Man{&manState{}}
+}
+
+// NewDocument returns a renderer with the same configuration, to render a
+// single document with.
+func (options *Man) NewDocument() Renderer {
+	r := *options
+	r.Reset()
+	return &r
+}
+
+func (options *Man) base() Renderer {
+	return options
+}
+
+// Reset forgets about the document rendered so far.
+func (options *Man) Reset() {
+	options.manState = &manState{}
+}
+
+func (options *Man) GetFlags() int {
+	return 0
+}
+
+// escapeRoff writes 'text' with the characters that mean something to roff
+// escaped. In filled text ('fill' set), spaces at the start of a line, which
+// would break it, are left out.
+func escapeRoff(out Writer, text []byte, fill bool) {
+	start := atLineStart(out)
+	for _, c := range text {
+		switch {
+		case c == '\\':
+			out.WriteString("\\e")
+			start = false
+			continue
+		case c == '-':
+			// a hyphen, not a minus sign, otherwise
+			out.WriteByte('\\')
+		case start && c == ' ' && fill:
+			continue
+		case start && (c == '.' || c == '\''):
+			// control lines start with these
+			out.WriteString("\\&")
+		}
+		out.WriteByte(c)
+		start = c == '\n'
+	}
+}
+
+// manArgument writes 'text' as a quoted argument of a macro.
+func manArgument(out Writer, text []byte) {
+	out.WriteString(" \"")
+	for _, c := range text {
+		switch c {
+		case '"':
+			out.WriteString("\\(dq")
+		case '\\':
+			out.WriteString("\\e")
+		case '-':
+			out.WriteString("\\-")
+		default:
+			out.WriteByte(c)
+		}
+	}
+	out.WriteByte('"')
+}
+
+// startLine makes sure that what comes next starts a line, as control lines
+// have to.
+func startLine(out Writer) {
+	if !atLineStart(out) {
+		out.WriteByte('\n')
+	}
+}
+
+// atLineStart tells if what is written to out next starts a line.
+func atLineStart(out Writer) bool {
+	data := written(out)
+	return len(data) == 0 || data[len(data)-1] == '\n'
+}
+
+func (options *Man) BlockCode(out Writer, text []byte, lang string) {
+	startLine(out)
+	out.WriteString(".PP\n.RS\n.nf\n")
+	escapeRoff(out, bytes.TrimRight(text, "\n"), false)
+	out.WriteString("\n.fi\n.RE\n")
+}
+
+func (options *Man) MathBlock(out Writer, text []byte) {
+	options.BlockCode(out, text, "")
+}
+
+// manTitle matches the title of a man page, which is followed by its
+// section in parentheses.
+var manTitle = regexp.MustCompile(`^(.*?)\s*\(([0-9a-zA-Z]+)\)$`)
+
+// TitleBlock writes the .TH line from the title of the page, with its
+// section, and the date. The authors are listed at the end of the page.
+func (options *Man) TitleBlock(out Writer, text []byte) {
+	var lines [3][]byte
+	for i, line := range bytes.SplitN(text, []byte("\n"), len(lines)) {
+		lines[i] = bytes.TrimSpace(bytes.TrimPrefix(line, []byte("%")))
+	}
+	title, section := lines[0], []byte("1")
+	if m := manTitle.FindSubmatch(title); m != nil {
+		title, section = m[1], m[2]
+	}
+	options.authors = lines[1]
+
+	startLine(out)
+	out.WriteString(".TH")
+	manArgument(out, title)
+	manArgument(out, section)
+	manArgument(out, lines[2])
+	out.WriteByte('\n')
+}
+
+func (options *Man) BlockQuote(out Writer, text []byte) {
+	startLine(out)
+	out.WriteString(".RS\n")
+	out.Write(text)
+	startLine(out)
+	out.WriteString(".RE\n")
+}
+
+// BlockHtml drops blocks of HTML, which roff can do nothing with.
+func (options *Man) BlockHtml(out Writer, text []byte) {
+}
+
+func (options *Man) Header(out Writer, text func() bool, level int, id string) {
+	marker := len(written(out))
+	startLine(out)
+
+	switch level {
+	case 1:
+		out.WriteString(".SH ")
+	case 2:
+		out.WriteString(".SS ")
+	default:
+		out.WriteString(".PP\n\\fB")
+	}
+	if !text() {
+		rollback(out, marker)
+		return
+	}
+	if level > 2 {
+		out.WriteString("\\fR")
+	}
+	startLine(out)
+}
+
+func (options *Man) HRule(out Writer) {
+	startLine(out)
+	out.WriteString(".PP\n.ce\n* * *\n")
+}
+
+func (options *Man) List(out Writer, text func() bool, flags int) {
+	marker := len(written(out))
+	startLine(out)
+
+	// lists in lists are indented further
+	nested := len(options.lists) > 0
+	if nested {
+		out.WriteString(".RS\n")
+	}
+	options.lists = append(options.lists, formatterList{})
+	if !text() {
+		rollback(out, marker)
+	}
+	options.lists = options.lists[:len(options.lists)-1]
+	if nested {
+		startLine(out)
+		out.WriteString(".RE\n")
+	}
+}
+
+func (options *Man) ListItem(out Writer, text []byte, flags int) {
+	list := &options.lists[len(options.lists)-1]
+	list.items++
+	startLine(out)
+
+	// the tag of a task is its checkbox, quoted for the space in it
+	if flags&LIST_ITEM_TASK != 0 {
+		tag := `"[ ]"`
+		if flags&LIST_ITEM_CHECKED != 0 {
+			tag = `"[x]"`
+		}
+		options.item(out, text, tag, "4")
+		return
+	}
+	if flags&LIST_TYPE_ORDERED != 0 {
+		options.item(out, text, strconv.Itoa(list.items)+".", "4")
+		return
+	}
+
+	options.item(out, text, "\\(bu", "2")
+}
+
+func (options *Man) DefinitionList(out Writer, text func() bool, flags int) {
+	options.List(out, text, flags)
+}
+
+func (options *Man) DefinitionTerm(out Writer, text []byte, flags int) {
+	list := &options.lists[len(options.lists)-1]
+	list.items++
+	startLine(out)
+
+	// the terms after the first one of a definition go below it
+	if list.term {
+		out.WriteString(".TQ\n")
+	} else {
+		out.WriteString(".TP\n")
+	}
+	list.term = true
+	out.Write(text)
+	startLine(out)
+}
+
+func (options *Man) DefinitionData(out Writer, text []byte, flags int) {
+	list := &options.lists[len(options.lists)-1]
+	list.items++
+	startLine(out)
+
+	// a definition after the first one of a term is a paragraph of its own
+	if !list.term {
+		out.WriteString(".IP\n")
+	}
+	list.term = false
+	out.Write(indentParagraphs(bytes.TrimPrefix(text, []byte(".PP\n"))))
+	startLine(out)
+}
+
+// item writes an indented paragraph with 'tag' hanging in front of it.
+func (options *Man) item(out Writer, text []byte, tag, indent string) {
+	out.WriteString(".IP ")
+	out.WriteString(tag)
+	out.WriteByte(' ')
+	out.WriteString(indent)
+	out.WriteByte('\n')
+	out.Write(indentParagraphs(bytes.TrimPrefix(text, []byte(".PP\n"))))
+	startLine(out)
+}
+
+// indentParagraphs keeps the paragraphs in 'text' at the indentation of the
+// item they are in.
+func indentParagraphs(text []byte) []byte {
+	if bytes.HasPrefix(text, []byte(".PP\n")) {
+		text = append([]byte(".IP\n"), text[len(".PP\n"):]...)
+	}
+	return bytes.Replace(text, []byte("\n.PP\n"), []byte("\n.IP\n"), -1)
+}
+
+func (options *Man) Paragraph(out Writer, text func() bool) {
+	marker := len(written(out))
+	startLine(out)
+	out.WriteString(".PP\n")
+	if !text() {
+		rollback(out, marker)
+		return
+	}
+	startLine(out)
+}
+
+func (options *Man) Table(out Writer, header []byte, body []byte, columnData []int) {
+	startLine(out)
+	out.WriteString(".PP\n.TS\ntab(\t);\n")
+	for i, align := range columnData {
+		if i > 0 {
+			out.WriteByte(' ')
+		}
+		switch align {
+		case TABLE_ALIGNMENT_RIGHT:
+			out.WriteByte('r')
+		case TABLE_ALIGNMENT_CENTER:
+			out.WriteByte('c')
+		default:
+			out.WriteByte('l')
+		}
+	}
+	out.WriteString(".\n")
+	out.Write(header)
+	if len(header) > 0 {
+		out.WriteString("_\n")
+	}
+	out.Write(body)
+	out.WriteString(".TE\n")
+}
+
+func (options *Man) TableRow(out Writer, text []byte) {
+	out.Write(text)
+	out.WriteByte('\n')
+}
+
+func (options *Man) TableHeaderCell(out Writer, text []byte, align int) {
+	if len(written(out)) > 0 {
+		out.WriteByte('\t')
+	}
+	out.WriteString("\\fB")
+	out.Write(bytes.Replace(text, []byte("\t"), []byte(" "), -1))
+	out.WriteString("\\fR")
+}
+
+func (options *Man) TableCell(out Writer, text []byte, align int) {
+	if len(written(out)) > 0 {
+		out.WriteByte('\t')
+	}
+	out.Write(bytes.Replace(text, []byte("\t"), []byte(" "), -1))
+}
+
+func (options *Man) Footnotes(out Writer, text func() bool) {
+	marker := len(written(out))
+	startLine(out)
+	out.WriteString(".SH NOTES\n")
+	if !text() {
+		rollback(out, marker)
+	}
+}
+
+func (options *Man) FootnoteItem(out Writer, name, text []byte, flags int) {
+	options.notes++
+	startLine(out)
+	options.item(out, bytes.TrimRight(text, "\n"), "["+strconv.Itoa(options.notes)+"]", "4")
+}
+
+func (options *Man) AutoLink(out Writer, link []byte, kind int) {
+	out.WriteString("\\fI")
+	escapeRoff(out, link, true)
+	out.WriteString("\\fR")
+}
+
+func (options *Man) CodeSpan(out Writer, text []byte) {
+	out.WriteString("\\fB")
+	escapeRoff(out, bytes.Replace(text, []byte("\n"), []byte(" "), -1), true)
+	out.WriteString("\\fR")
+}
+
+func (options *Man) MathSpan(out Writer, text []byte, display bool) {
+	escapeRoff(out, bytes.Replace(text, []byte("\n"), []byte(" "), -1), true)
+}
+
+func (options *Man) DoubleEmphasis(out Writer, text []byte) {
+	out.WriteString("\\fB")
+	out.Write(text)
+	out.WriteString("\\fR")
+}
+
+func (options *Man) Emphasis(out Writer, text []byte) {
+	out.WriteString("\\fI")
+	out.Write(text)
+	out.WriteString("\\fR")
+}
+
+func (options *Man) TripleEmphasis(out Writer, text []byte) {
+	out.WriteString("\\f(BI")
+	out.Write(text)
+	out.WriteString("\\fR")
+}
+
+func (options *Man) StrikeThrough(out Writer, text []byte) {
+	out.Write(text)
+}
+
+// Image writes the alternate text of an image.
+func (options *Man) Image(out Writer, link []byte, title []byte, alt []byte) {
+	escapeRoff(out, alt, true)
+}
+
+func (options *Man) LineBreak(out Writer) {
+	out.WriteString("\n.br\n")
+}
+
+// Link writes the text of a link followed by where it goes, unless that is
+// the text already.
+func (options *Man) Link(out Writer, link []byte, title []byte, content []byte) {
+	out.Write(content)
+	if len(link) == 0 || bytes.Equal(link, content) ||
+		bytes.HasPrefix(link, []byte("http://")) && bytes.Equal(link[len("http://"):], content) {
+		return
+	}
+	if len(content) > 0 {
+		out.WriteByte(' ')
+	}
+	out.WriteString("(\\fI")
+	escapeRoff(out, link, true)
+	out.WriteString("\\fR)")
+}
+
+// RawHtmlTag drops inline HTML tags, but not the text between them.
+func (options *Man) RawHtmlTag(out Writer, text []byte) {
+}
+
+func (options *Man) FootnoteRef(out Writer, ref []byte, id int) {
+	out.WriteByte('[')
+	out.WriteString(strconv.Itoa(id))
+	out.WriteByte(']')
+}
+
+func (options *Man) Abbreviation(out Writer, abbr []byte, title []byte) {
+	options.NormalText(out, abbr)
+}
+
+// Entity writes the character an entity stands for.
+func (options *Man) Entity(out Writer, entity []byte) {
+	escapeRoff(out, []byte(html.UnescapeString(string(entity))), true)
+}
+
+func (options *Man) NormalText(out Writer, text []byte) {
+	escapeRoff(out, text, true)
+}
+
+func (options *Man) DocumentHeader(out Writer) {
+}
+
+func (options *Man) DocumentFooter(out Writer) {
+	if len(options.authors) == 0 {
+		return
+	}
+	startLine(out)
+	out.WriteString(".SH AUTHORS\n")
+	escapeRoff(out, options.authors, true)
+	out.WriteByte('\n')
+}
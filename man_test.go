@@ -0,0 +1,110 @@
+//
+// Blackfriday Markdown Processor
+// Available at http://github.com/russross/blackfriday
+//
+// Copyright © 2011 Russ Ross <russ@russross.com>.
+// Distributed under the Simplified BSD License.
+// See README.md for details.
+//
+
+//
+// Man page output tests
+//
+
+package blackfriday
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func runMan(input string, extensions Extensions) string {
+	output, err := MarkdownE([]byte(input), WithRenderer(ManRenderer()), WithExtensions(extensions))
+	if err != nil {
+		panic(err)
+	}
+	return string(output)
+}
+
+func doTestsMan(t *testing.T, files []string, extensions Extensions) {
+	for _, basename := range files {
+		filename := filepath.Join("testdata", basename+".text")
+		inputBytes, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Errorf("Couldn't open '%s', error: %v\n", filename, err)
+			continue
+		}
+		input := string(inputBytes)
+
+		filename = filepath.Join("testdata", basename+".man")
+		expectedBytes, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Errorf("Couldn't open '%s', error: %v\n", filename, err)
+			continue
+		}
+		expected := string(expectedBytes)
+
+		actual := runMan(input, extensions)
+		if actual != expected {
+			t.Errorf("\n    [%#v]\nExpected[%#v]\nActual  [%#v]",
+				basename+".text", expected, actual)
+		}
+	}
+}
+
+func TestMan(t *testing.T) {
+	files := []string{
+		"Man page",
+	}
+	doTestsMan(t, files, commonExtensions|EXTENSION_FOOTNOTES|EXTENSION_TITLEBLOCK|EXTENSION_DEFINITION_LISTS)
+}
+
+func TestManInline(t *testing.T) {
+	var tests = []string{
+		"Some *em*, **strong**, ***both*** and `code`.\n",
+		".PP\nSome \\fIem\\fR, \\fBstrong\\fR, \\f(BIboth\\fR and \\fBcode\\fR.\n",
+
+		"A - B \\\\ C\n.D\n'E\n",
+		".PP\nA \\- B \\e C\n\\&.D\n\\&'E\n",
+
+		"Hard  \n   break\n",
+		".PP\nHard\n.br\nbreak\n",
+
+		"&amp; &copy; <b>tag</b>\n",
+		".PP\n& © tag\n",
+
+		"[text](http://x.org/) and [http://y.org/](http://y.org/)\n",
+		".PP\ntext (\\fIhttp://x.org/\\fR) and http://y.org/\n",
+	}
+	for i := 0; i+1 < len(tests); i += 2 {
+		input, expected := tests[i], tests[i+1]
+		if actual := runMan(input, commonExtensions); actual != expected {
+			t.Errorf("\nInput   [%#v]\nExpected[%#v]\nActual  [%#v]",
+				input, expected, actual)
+		}
+	}
+}
+
+func TestManList(t *testing.T) {
+	var tests = []string{
+		// a loose item stays a bullet, even when it starts with a line of
+		// its own
+		"* y\n\n    more\n",
+		".IP \\(bu 2\ny\n.IP\nmore\n",
+
+		"* a\n* b\n",
+		".IP \\(bu 2\na\n.IP \\(bu 2\nb\n",
+
+		// only definition lists are tagged paragraphs
+		"`-f`\n:   Force.\n",
+		".TP\n\\fB\\-f\\fR\nForce.\n",
+	}
+	for i := 0; i+1 < len(tests); i += 2 {
+		input, expected := tests[i], tests[i+1]
+		if actual := runMan(input, commonExtensions|EXTENSION_DEFINITION_LISTS); actual != expected {
+			t.Errorf("\nInput   [%#v]\nExpected[%#v]\nActual  [%#v]",
+				input, expected, actual)
+		}
+	}
+}
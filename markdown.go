@@ -20,28 +20,46 @@ package blackfriday
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"runtime/debug"
+	"sort"
+	"unicode"
 	"unicode/utf8"
 )
 
 const VERSION = "1.1"
 
+// Extensions is a set of EXTENSION_* flags that enable non-standard markdown
+// syntax in the parser.
+type Extensions int
+
 // These are the supported markdown parsing extensions.
 // OR these values together to select multiple extensions.
 const (
-	EXTENSION_NO_INTRA_EMPHASIS          = 1 << iota // ignore emphasis markers inside words
-	EXTENSION_TABLES                                 // render tables
-	EXTENSION_FENCED_CODE                            // render fenced code blocks
-	EXTENSION_AUTOLINK                               // detect embedded URLs that are not explicitly marked
-	EXTENSION_STRIKETHROUGH                          // strikethrough text using ~~test~~
-	EXTENSION_LAX_HTML_BLOCKS                        // loosen up HTML block parsing rules
-	EXTENSION_SPACE_HEADERS                          // be strict about prefix header rules
-	EXTENSION_HARD_LINE_BREAK                        // translate newlines into line breaks
-	EXTENSION_TAB_SIZE_EIGHT                         // expand tabs to eight spaces instead of four
-	EXTENSION_FOOTNOTES                              // Pandoc-style footnotes
-	EXTENSION_NO_EMPTY_LINE_BEFORE_BLOCK             // No need to insert an empty line to start a (code, quote, order list, unorder list)block
-	EXTENSION_HEADER_IDS                             // specify header IDs  with {#id}
-	EXTENSION_TITLEBLOCK                             // Titleblock ala pandoc
-	EXTENSION_AUTO_HEADER_IDS                        // Create the header ID from the text
+	EXTENSION_NO_INTRA_EMPHASIS          Extensions = 1 << iota // ignore emphasis markers inside words
+	EXTENSION_TABLES                                            // render tables
+	EXTENSION_FENCED_CODE                                       // render fenced code blocks
+	EXTENSION_AUTOLINK                                          // detect embedded URLs that are not explicitly marked
+	EXTENSION_STRIKETHROUGH                                     // strikethrough text using ~~test~~
+	EXTENSION_LAX_HTML_BLOCKS                                   // loosen up HTML block parsing rules
+	EXTENSION_SPACE_HEADERS                                     // be strict about prefix header rules
+	EXTENSION_HARD_LINE_BREAK                                   // translate newlines into line breaks
+	EXTENSION_TAB_SIZE_EIGHT                                    // expand tabs to eight spaces instead of four
+	EXTENSION_FOOTNOTES                                         // Pandoc-style footnotes
+	EXTENSION_NO_EMPTY_LINE_BEFORE_BLOCK                        // No need to insert an empty line to start a (code, quote, order list, unorder list)block
+	EXTENSION_HEADER_IDS                                        // specify header IDs  with {#id}
+	EXTENSION_TITLEBLOCK                                        // Titleblock ala pandoc
+	EXTENSION_AUTO_HEADER_IDS                                   // Create the header ID from the text
+	EXTENSION_COMMONMARK                                        // follow the CommonMark spec where it differs from Markdown.pl
+	EXTENSION_TASK_LISTS                                        // GitHub-style task list items: - [ ] and - [x]
+	EXTENSION_EXTENDED_AUTOLINK                                 // also link www. domains and email addresses, and end links the way GitHub does
+	EXTENSION_DEFINITION_LISTS                                  // PHP Markdown Extra style definition lists: a term, then : definition
+	EXTENSION_ABBREVIATIONS                                     // PHP Markdown Extra style abbreviations: *[HTML]: Hyper Text Markup Language
+	EXTENSION_MATH                                              // TeX math between dollars: $inline$ and $$display$$
 
 	commonHtmlFlags = 0 |
 		HTML_USE_XHTML |
@@ -76,6 +94,12 @@ const (
 	LIST_ITEM_CONTAINS_BLOCK
 	LIST_ITEM_BEGINNING_OF_LIST
 	LIST_ITEM_END_OF_LIST
+	LIST_ITEM_TASK        // the item starts with a task checkbox, [ ] or [x]
+	LIST_ITEM_CHECKED     // the checkbox of the task is checked
+	LIST_TYPE_DEFINITION  // a definition list, or a term or definition in one
+	LIST_TYPE_TERM        // the item is a term of a definition list
+	LIST_ITEM_INLINE_NOTE // the footnote was written in the text, ^[like this]
+	LIST_START            // the ordered list starts at its Start number rather than 1
 )
 
 // These are the possible flag values for the table cell renderer.
@@ -93,6 +117,21 @@ const (
 	TAB_SIZE_EIGHT   = 8
 )
 
+// The depth to which block quotes, lists, emphasis and the like can be
+// nested, unless set otherwise with WithMaxNesting.
+const MAX_NESTING_DEFAULT = 16
+
+// NestingPolicy tells the parser what to do with content that is nested
+// deeper than the maximum.
+type NestingPolicy int
+
+// These are the possible nesting policies.
+const (
+	NESTING_TEXT   NestingPolicy = iota // keep the rest as plain text
+	NESTING_ERROR                       // stop with a *NestingError
+	NESTING_REPORT                      // keep the rest as plain text and report a Diagnostic
+)
+
 // These are the tags that are recognized as HTML block tags.
 // Any of these can be included in markdown text without special escaping.
 var blockTags = map[string]bool{
@@ -134,6 +173,42 @@ var blockTags = map[string]bool{
 	"figcaption": true,
 }
 
+// Writer is what the Renderer callbacks write their output to. It is
+// satisfied by *bytes.Buffer, *bufio.Writer and *strings.Builder, among
+// others.
+type Writer interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+}
+
+// The writers a tree is rendered to keep what has been written to them for
+// the current top-level block, and let it be taken back, like a bytes.Buffer
+// does. The renderers of this package use that to look back at their output
+// and to take back elements that turn out to be empty; written to any other
+// writer, they just do without.
+type keepingWriter interface {
+	Writer
+	Bytes() []byte
+	Truncate(n int)
+}
+
+// written returns what has been written to out, as far as it is kept.
+func written(out Writer) []byte {
+	if w, ok := out.(keepingWriter); ok {
+		return w.Bytes()
+	}
+	return nil
+}
+
+// rollback takes back what has been written to out after the first n bytes
+// of written(out), if it can.
+func rollback(out Writer, n int) {
+	if w, ok := out.(keepingWriter); ok {
+		w.Truncate(n)
+	}
+}
+
 // Renderer is the rendering interface.
 // This is mostly of interest if you are implementing a new rendering format.
 //
@@ -141,72 +216,182 @@ var blockTags = map[string]bool{
 // element.
 //
 // When a callback is provided instead, it will write the contents of the
-// respective element directly to the output buffer and return true on success.
-// If the callback returns false, the rendering function should reset the
-// output buffer as though it had never been called.
+// respective element directly to the output and return true on success.
+// If the callback returns false, the rendering function should take back
+// what it wrote for the element, if its Writer lets it.
+//
+// While a tree is rendered, the callbacks are given a Writer that keeps the
+// output of the current top-level block, and has Bytes and Truncate methods
+// to look at it and take it back, like a bytes.Buffer. When rendering to an
+// io.Writer with Render, the finished top-level blocks are moved out of it
+// as the document goes, with only the last byte written left behind. A
+// renderer should not rely on reading back anything before the start of the
+// current top-level block, unless it reports HTML_TOC in its flags.
 //
 // Currently Html and Latex implementations are provided
 type Renderer interface {
 	// block-level callbacks
-	BlockCode(out *bytes.Buffer, text []byte, lang string)
-	BlockQuote(out *bytes.Buffer, text []byte)
-	BlockHtml(out *bytes.Buffer, text []byte)
-	Header(out *bytes.Buffer, text func() bool, level int, id string)
-	HRule(out *bytes.Buffer)
-	List(out *bytes.Buffer, text func() bool, flags int)
-	ListItem(out *bytes.Buffer, text []byte, flags int)
-	Paragraph(out *bytes.Buffer, text func() bool)
-	Table(out *bytes.Buffer, header []byte, body []byte, columnData []int)
-	TableRow(out *bytes.Buffer, text []byte)
-	TableHeaderCell(out *bytes.Buffer, text []byte, flags int)
-	TableCell(out *bytes.Buffer, text []byte, flags int)
-	Footnotes(out *bytes.Buffer, text func() bool)
-	FootnoteItem(out *bytes.Buffer, name, text []byte, flags int)
-	TitleBlock(out *bytes.Buffer, text []byte)
+	BlockCode(out Writer, text []byte, lang string)
+	BlockQuote(out Writer, text []byte)
+	BlockHtml(out Writer, text []byte)
+	Header(out Writer, text func() bool, level int, id string)
+	HRule(out Writer)
+	List(out Writer, text func() bool, flags int)
+	ListItem(out Writer, text []byte, flags int)
+	DefinitionList(out Writer, text func() bool, flags int)
+	DefinitionTerm(out Writer, text []byte, flags int)
+	DefinitionData(out Writer, text []byte, flags int)
+	Paragraph(out Writer, text func() bool)
+	Table(out Writer, header []byte, body []byte, columnData []int)
+	TableRow(out Writer, text []byte)
+	TableHeaderCell(out Writer, text []byte, flags int)
+	TableCell(out Writer, text []byte, flags int)
+	Footnotes(out Writer, text func() bool)
+	FootnoteItem(out Writer, name, text []byte, flags int)
+	TitleBlock(out Writer, text []byte)
+	MathBlock(out Writer, text []byte)
 
 	// Span-level callbacks
-	AutoLink(out *bytes.Buffer, link []byte, kind int)
-	CodeSpan(out *bytes.Buffer, text []byte)
-	DoubleEmphasis(out *bytes.Buffer, text []byte)
-	Emphasis(out *bytes.Buffer, text []byte)
-	Image(out *bytes.Buffer, link []byte, title []byte, alt []byte)
-	LineBreak(out *bytes.Buffer)
-	Link(out *bytes.Buffer, link []byte, title []byte, content []byte)
-	RawHtmlTag(out *bytes.Buffer, tag []byte)
-	TripleEmphasis(out *bytes.Buffer, text []byte)
-	StrikeThrough(out *bytes.Buffer, text []byte)
-	FootnoteRef(out *bytes.Buffer, ref []byte, id int)
+	AutoLink(out Writer, link []byte, kind int)
+	CodeSpan(out Writer, text []byte)
+	DoubleEmphasis(out Writer, text []byte)
+	Emphasis(out Writer, text []byte)
+	Image(out Writer, link []byte, title []byte, alt []byte)
+	LineBreak(out Writer)
+	Link(out Writer, link []byte, title []byte, content []byte)
+	RawHtmlTag(out Writer, tag []byte)
+	TripleEmphasis(out Writer, text []byte)
+	StrikeThrough(out Writer, text []byte)
+	FootnoteRef(out Writer, ref []byte, id int)
+	Abbreviation(out Writer, abbr []byte, title []byte)
+	MathSpan(out Writer, text []byte, display bool)
 
 	// Low-level callbacks
-	Entity(out *bytes.Buffer, entity []byte)
-	NormalText(out *bytes.Buffer, text []byte)
+	Entity(out Writer, entity []byte)
+	NormalText(out Writer, text []byte)
 
 	// Header and footer
-	DocumentHeader(out *bytes.Buffer)
-	DocumentFooter(out *bytes.Buffer)
+	DocumentHeader(out Writer)
+	DocumentFooter(out Writer)
 
 	GetFlags() int
 }
 
+// SourcePosRenderer can be implemented by a Renderer that wants to know
+// where in the input the elements it renders came from. Every block-level
+// node is rendered through SourcePos, where render calls the callback for
+// the node, writing to out.
+type SourcePosRenderer interface {
+	SourcePos(out Writer, node *Node, render func())
+}
+
+// InlineNoteRenderer can be implemented by a Renderer that writes inline
+// footnotes where they are referenced, as they were written. The reference
+// to such a note is then rendered by InlineNote, where text renders the
+// contents of the note to out, and its item is still passed to FootnoteItem
+// with the LIST_ITEM_INLINE_NOTE flag.
+type InlineNoteRenderer interface {
+	InlineNote(out Writer, text func() bool, id int)
+}
+
+// ListStartRenderer can be implemented by a Renderer that keeps the number
+// an ordered list starts at. A list with the LIST_START flag is then
+// rendered by ListStart instead of List, with the number of its first item.
+type ListStartRenderer interface {
+	ListStart(out Writer, text func() bool, flags int, start int)
+}
+
+// NodeHookRenderer can be implemented by a Renderer that renders some
+// elements with hooks instead of its callbacks. NodeHook returns the hook
+// for a node, or nil to render the node the usual way. It is asked about
+// every node but the Document.
+type NodeHookRenderer interface {
+	NodeHook(node *Node) NodeHook
+}
+
+// A NodeHook renders the element of a node in place of the Renderer
+// callbacks. contents renders just the children of the node to out, and
+// render renders the whole element to out the usual way, children included.
+// A hook can call one of them, once, to build on what it writes.
+type NodeHook func(out Writer, node *Node, contents, render func())
+
+// StatefulRenderer can be implemented by a Renderer that keeps track of
+// things while it renders a document. Every document is then rendered by a
+// renderer of its own, obtained from NewDocument, and the configured one is
+// left alone. That way one renderer can be shared by many goroutines.
+//
+// NewDocument has to return a renderer of the same type. A type that embeds
+// one of the renderers of this package has to have a NewDocument method of
+// its own: the one it gets from the embedded renderer would return a plain
+// copy of that, without the methods of the embedding type. Rendering with
+// such a type fails with a *RendererError.
+type StatefulRenderer interface {
+	Renderer
+	NewDocument() Renderer
+}
+
+// embeddable is implemented by the renderers of this package that keep
+// per-document state. Its method is promoted to the types that embed them,
+// where it returns the embedded renderer instead of the renderer itself.
+type embeddable interface {
+	base() Renderer
+}
+
+// embedsRenderer tells if r is not a renderer of this package, but embeds one.
+func embedsRenderer(r Renderer) bool {
+	b, ok := r.(embeddable)
+	return ok && b.base() != r
+}
+
 // Callback functions for inline parsing. One such function is defined
 // for each character that triggers a response when parsing inline data.
-type inlineParser func(p *parser, out *bytes.Buffer, data []byte, offset int) int
+type inlineParser func(p *parser, out *Node, data []byte, offset int) int
 
 // Parser holds runtime state used by the parser.
-// This is constructed by the Markdown function.
+// This is constructed by the Parse function.
 type parser struct {
-	r              Renderer
 	refs           map[string]*reference
 	inlineCallback [256]inlineParser
-	flags          int
+	flags          Extensions
 	nesting        int
 	maxNesting     int
+	nestingPolicy  NestingPolicy
 	insideLink     bool
+	spans          []*delimiters
+
+	// Custom syntax, and what the custom parsers get to see of the parser
+	blockParsers []BlockParser
+	public       *Parser
+
+	// Receives the diagnostics, if anybody wants them
+	diagnostics func(Diagnostic)
+
+	// Resource limits, and the inline work spent so far. The context is
+	// checked every time another contextCheckInterval units of work are
+	// spent.
+	limits    Limits
+	spent     int
+	nextCheck int
+	ctx       context.Context
+	done      <-chan struct{}
+
+	// Where the bytes of every working buffer came from in the input, and
+	// where the lines of the input start.
+	sources   sources
+	lines     lineIndex
+	inputSize int
+
+	// The first broken invariant found while parsing
+	err error
 
 	// Footnotes need to be ordered as well as available to quickly check for
 	// presence. If a ref is also a footnote, it's stored both in refs and here
 	// in notes. Slice is nil if footnotes not enabled.
 	notes []*reference
+
+	// The expansions of the abbreviations, by abbreviation. Map is nil if
+	// abbreviations are not enabled.
+	abbrs map[string][]byte
 }
 
 //
@@ -215,6 +400,188 @@ type parser struct {
 //
 //
 
+// Options holds everything that can be configured about turning markdown
+// into some output. The zero value renders HTML with no extensions, like
+// MarkdownBasic.
+type Options struct {
+	Renderer      Renderer         // formats the output; an Html renderer producing XHTML if nil
+	Extensions    Extensions       // EXTENSION_* flags ORed together
+	MaxNesting    int              // how deep elements can be nested; MAX_NESTING_DEFAULT if zero
+	NestingPolicy NestingPolicy    // what to do with content nested deeper than that
+	Diagnostics   func(Diagnostic) // called with the problems found in the input, if not nil
+	Limits        Limits           // bounds on the resources spent on a document
+
+	// Parsers for custom inline syntax, by the character that triggers them
+	InlineParsers map[byte]InlineParser
+
+	// Parsers for custom block-level syntax
+	BlockParsers []BlockParser
+}
+
+// Limits bounds the resources spent on a single document, for when the input
+// cannot be trusted. A document that goes over any of them fails with a
+// *LimitError. Zero means no limit.
+type Limits struct {
+	MaxInputSize  int // bytes of input
+	MaxReferences int // link references, footnote and abbreviation definitions
+	MaxFootnotes  int // footnotes referenced from the text
+	MaxOutputSize int // bytes of output, checked after each top-level block
+	MaxInlineWork int // bytes examined by the inline parser, counting each time they are looked at
+}
+
+// Option changes one aspect of the Options used by Markdown, Parse and
+// Render. Options are applied in order, so later ones win.
+type Option func(*Options)
+
+// WithOptions replaces all the options with 'opts'.
+func WithOptions(opts Options) Option {
+	return func(o *Options) {
+		*o = opts
+	}
+}
+
+// WithRenderer sets the Renderer that formats the output.
+func WithRenderer(renderer Renderer) Option {
+	return func(o *Options) {
+		o.Renderer = renderer
+	}
+}
+
+// WithExtensions sets the parser extensions.
+func WithExtensions(extensions Extensions) Option {
+	return func(o *Options) {
+		o.Extensions = extensions
+	}
+}
+
+// WithMaxNesting sets how deep block quotes, lists, emphasis and the like can
+// be nested before the parser stops descending into them. What happens to
+// the rest of the content is decided by the NestingPolicy.
+func WithMaxNesting(depth int) Option {
+	return func(o *Options) {
+		o.MaxNesting = depth
+	}
+}
+
+// WithNestingPolicy sets what to do with content nested too deeply.
+func WithNestingPolicy(policy NestingPolicy) Option {
+	return func(o *Options) {
+		o.NestingPolicy = policy
+	}
+}
+
+// Parser is handed to custom block parsers, so that they can parse the
+// markdown within the blocks they found.
+type Parser struct {
+	p *parser
+}
+
+// Block parses 'data', which has to end with a newline, as block-level
+// markdown, appending what it finds to 'out'.
+func (p *Parser) Block(out *Node, data []byte) {
+	p.p.block(out, data)
+}
+
+// Inline parses 'data' as the inline markdown within a block, appending what
+// it finds to 'out'.
+func (p *Parser) Inline(out *Node, data []byte) {
+	p.p.inline(out, data)
+}
+
+// InlineParser parses custom inline syntax that starts with a trigger
+// character at data[offset]. It appends the nodes it makes to 'out', which
+// can be of any type, and returns the number of bytes it used. If there is
+// nothing for it at the offset, it returns 0, and the character gets handled
+// as if the parser wasn't there.
+//
+// To render something no other node type stands for, append a CustomSpan
+// node with a Render function.
+type InlineParser func(out *Node, data []byte, offset int) int
+
+// WithInlineParser adds a parser for custom inline syntax starting with the
+// character 'c'. It gets its chance before the built-in syntax that starts
+// with the same character, if any.
+func WithInlineParser(c byte, parser InlineParser) Option {
+	return func(o *Options) {
+		parsers := make(map[byte]InlineParser, len(o.InlineParsers)+1)
+		for k, v := range o.InlineParsers {
+			parsers[k] = v
+		}
+		parsers[c] = parser
+		o.InlineParsers = parsers
+	}
+}
+
+// BlockParser parses custom block-level syntax.
+//
+// To render something no other node type stands for, its Parse function can
+// append a CustomBlock node with a Render function.
+type BlockParser struct {
+	// Starts tells if the line at the start of 'data' begins a block of
+	// this kind. Such a line also ends the paragraph before it.
+	Starts func(data []byte) bool
+
+	// Parse parses the block at the start of 'data', appending the nodes
+	// it makes to 'out', and returns the number of bytes it used, which
+	// should be whole lines. It returns 0 if there is no block there after
+	// all.
+	Parse func(p *Parser, out *Node, data []byte) int
+
+	// Priority decides the order the parsers are tried in, highest first.
+	// Parsers with a positive priority are tried before the built-in block
+	// syntax, the others after it, right before falling back to a
+	// paragraph.
+	Priority int
+}
+
+// WithBlockParser adds a parser for custom block-level syntax.
+func WithBlockParser(parser BlockParser) Option {
+	return func(o *Options) {
+		parsers := make([]BlockParser, 0, len(o.BlockParsers)+1)
+		o.BlockParsers = append(append(parsers, o.BlockParsers...), parser)
+	}
+}
+
+// WithLimits sets the resource limits.
+func WithLimits(limits Limits) Option {
+	return func(o *Options) {
+		o.Limits = limits
+	}
+}
+
+// WithDiagnostics sets a function to be called with every problem found in
+// the input that does not stop the parser.
+func WithDiagnostics(report func(Diagnostic)) Option {
+	return func(o *Options) {
+		o.Diagnostics = report
+	}
+}
+
+// Diagnostic describes a problem found in the input.
+type Diagnostic struct {
+	Pos Position // where the problem is
+	Msg string   // what the problem is
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%d:%d: %s", d.Pos.Line, d.Pos.Column, d.Msg)
+}
+
+// collectOptions applies the options in order and fills in the defaults.
+func collectOptions(opts []Option) Options {
+	var o Options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.Renderer == nil {
+		o.Renderer = HtmlRenderer(HTML_USE_XHTML, "", "")
+	}
+	if o.MaxNesting <= 0 {
+		o.MaxNesting = MAX_NESTING_DEFAULT
+	}
+	return o
+}
+
 // MarkdownBasic is a convenience function for simple rendering.
 // It processes markdown input with no extensions enabled.
 func MarkdownBasic(input []byte) []byte {
@@ -223,9 +590,9 @@ func MarkdownBasic(input []byte) []byte {
 	renderer := HtmlRenderer(htmlFlags, "", "")
 
 	// set up the parser
-	extensions := 0
+	var extensions Extensions
 
-	return Markdown(input, renderer, extensions)
+	return Markdown(input, WithRenderer(renderer), WithExtensions(extensions))
 }
 
 // Call Markdown with most useful extensions enabled
@@ -250,33 +617,260 @@ func MarkdownBasic(input []byte) []byte {
 func MarkdownCommon(input []byte) []byte {
 	// set up the HTML renderer
 	renderer := HtmlRenderer(commonHtmlFlags, "", "")
-	return Markdown(input, renderer, commonExtensions)
+	return Markdown(input, WithRenderer(renderer), WithExtensions(commonExtensions))
 }
 
 // Markdown is the main rendering function.
 // It parses and renders a block of markdown-encoded text.
-// The supplied Renderer is used to format the output, and extensions dictates
-// which non-standard extensions are enabled.
+// The options select the Renderer used to format the output, which
+// non-standard extensions are enabled, and so on; without any, the result is
+// the same as from MarkdownBasic:
+//
+//	output := Markdown(input,
+//		WithRenderer(HtmlRenderer(HTML_USE_XHTML|HTML_TOC, "", "")),
+//		WithExtensions(EXTENSION_TABLES|EXTENSION_FOOTNOTES))
 //
 // To use the supplied Html or LaTeX renderers, see HtmlRenderer and
 // LatexRenderer, respectively.
-func Markdown(input []byte, renderer Renderer, extensions int) []byte {
-	// no point in parsing if we can't render
-	if renderer == nil {
-		return nil
+//
+// Markdown never panics. Should parsing fail, which takes NESTING_ERROR or a
+// bug, it returns nil; use MarkdownE to find out what happened.
+func Markdown(input []byte, opts ...Option) []byte {
+	output, _ := MarkdownE(input, opts...)
+	return output
+}
+
+// MarkdownE works like Markdown, but also reports what went wrong, if
+// anything. The error is a *LimitError, a *NestingError, a *RendererError, an
+// *InvariantError or a *PanicError, and the output is nil whenever the error
+// is not.
+func MarkdownE(input []byte, opts ...Option) ([]byte, error) {
+	return MarkdownContext(context.Background(), input, opts...)
+}
+
+// MarkdownContext works like MarkdownE, but gives up as soon as it can when
+// the context is cancelled, returning the error of the context.
+func MarkdownContext(ctx context.Context, input []byte, opts ...Option) ([]byte, error) {
+	o := collectOptions(opts)
+	doc, err := parse(ctx, input, o)
+	if err != nil {
+		return nil, err
+	}
+	return renderTree(ctx, doc, o)
+}
+
+// LimitError is returned when a document goes over one of the Limits.
+type LimitError struct {
+	Limit string // the name of the field in Limits, like "MaxInputSize"
+	Max   int    // the value of the limit
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("blackfriday: document exceeds %s of %d", e.Limit, e.Max)
+}
+
+// NestingError is returned when content is nested deeper than allowed and
+// the NestingPolicy is NESTING_ERROR.
+type NestingError struct {
+	Pos      Position // where the content that is too deep starts
+	MaxDepth int      // the maximum nesting depth
+}
+
+func (e *NestingError) Error() string {
+	return fmt.Sprintf("blackfriday: %d:%d: nesting deeper than %d levels",
+		e.Pos.Line, e.Pos.Column, e.MaxDepth)
+}
+
+// InvariantError is returned when the parser catches itself in a state that
+// should be impossible. It points to a bug in blackfriday, not to a problem
+// with the input.
+type InvariantError struct {
+	Msg string // what was found to be wrong
+}
+
+func (e *InvariantError) Error() string {
+	return "blackfriday: " + e.Msg
+}
+
+// RendererError is returned when the renderer embeds one of the renderers of
+// this package without having a NewDocument method of its own, which it
+// needs to render more than one document, or to be shared by goroutines.
+type RendererError struct {
+	Renderer Renderer
+}
+
+func (e *RendererError) Error() string {
+	return fmt.Sprintf("blackfriday: %T embeds a renderer that keeps per-document state, but has no NewDocument method", e.Renderer)
+}
+
+// PanicError is returned when parsing or rendering panicked. The panic is
+// recovered, so that neither a bug in blackfriday nor one in a renderer
+// brings down the calling goroutine.
+type PanicError struct {
+	Value interface{} // the value passed to panic
+	Stack []byte      // the stack trace of the panicking goroutine
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("blackfriday: panic: %v", e.Value)
+}
+
+// recoverPanic turns a panic into a *PanicError stored in *err, or into the
+// error it carries if it was raised by abort.
+// It must be deferred directly by the function that may panic.
+func recoverPanic(err *error) {
+	if value := recover(); value != nil {
+		if a, ok := value.(aborted); ok {
+			*err = a.err
+			return
+		}
+		*err = &PanicError{Value: value, Stack: debug.Stack()}
+	}
+}
+
+// aborted carries the error that stops parsing from deep within.
+type aborted struct {
+	err error
+}
+
+// abort stops parsing with 'err' at once. The panic it raises is recovered
+// by the public entry points.
+func (p *parser) abort(err error) {
+	panic(aborted{err})
+}
+
+// How much inline work is done between checks for cancellation.
+const contextCheckInterval = 1 << 14
+
+// spend accounts for 'n' units of inline work, stopping the parser if the
+// limit is reached or the context is cancelled.
+func (p *parser) spend(n int) {
+	p.spent += n
+	if max := p.limits.MaxInlineWork; max > 0 && p.spent > max {
+		p.abort(&LimitError{Limit: "MaxInlineWork", Max: max})
+	}
+	if p.spent >= p.nextCheck {
+		p.nextCheck = p.spent + contextCheckInterval
+		p.checkContext()
+	}
+}
+
+// addNote adds a footnote, unless there are too many already.
+func (p *parser) addNote(ref *reference) {
+	if max := p.limits.MaxFootnotes; max > 0 && len(p.notes) >= max {
+		p.abort(&LimitError{Limit: "MaxFootnotes", Max: max})
+	}
+	p.notes = append(p.notes, ref)
+}
+
+// checkContext stops the parser if the context is cancelled.
+func (p *parser) checkContext() {
+	select {
+	case <-p.done:
+		p.abort(p.ctx.Err())
+	default:
+	}
+}
+
+// Render reads markdown from r and writes the rendered document to w.
+//
+// Only the output is streamed. The input is read completely and the whole
+// document tree is built before rendering starts, since link references and
+// footnotes may appear anywhere in it. The Renderer callbacks write to a
+// Writer that holds one top-level block at a time: it is moved to w as soon
+// as the block has been rendered, but for its last byte. A
+// Renderer that reports the HTML_TOC flag gets no streaming at all, as the
+// table of contents goes in front of everything else.
+//
+// The first error from reading or writing is returned, or the same errors as
+// from MarkdownE. Render never panics.
+func Render(w io.Writer, r io.Reader, opts ...Option) error {
+	return RenderContext(context.Background(), w, r, opts...)
+}
+
+// RenderContext works like Render, but gives up as soon as it can when the
+// context is cancelled, returning the error of the context.
+func RenderContext(ctx context.Context, w io.Writer, r io.Reader, opts ...Option) (err error) {
+	defer recoverPanic(&err)
+
+	o := collectOptions(opts)
+	if max := o.Limits.MaxInputSize; max > 0 {
+		// don't read more than it takes to tell the input is too big
+		r = io.LimitReader(r, int64(max)+1)
+	}
+	input, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	doc, err := parse(ctx, input, o)
+	if err != nil {
+		return err
+	}
+	return renderTo(ctx, w, doc, o)
+}
+
+// Parse is the main parsing function.
+// It parses a block of markdown-encoded text into a tree of nodes, rooted at
+// a Document node, without rendering it. Only the options that concern the
+// parser, like the extensions, make a difference; the renderer is ignored.
+//
+// The returned tree can be inspected or modified before it is handed over to
+// a renderer.
+//
+// Parse never panics. Should anything go wrong inside, which would be a bug,
+// the tree may be incomplete; use ParseE to find out what happened.
+func Parse(input []byte, opts ...Option) *Node {
+	doc, _ := ParseE(input, opts...)
+	return doc
+}
+
+// ParseE works like Parse, but also reports what went wrong, if anything.
+// The error is a *LimitError, a *NestingError, an *InvariantError or a
+// *PanicError. A Document node is returned even then, holding whatever was
+// parsed.
+func ParseE(input []byte, opts ...Option) (*Node, error) {
+	return parse(context.Background(), input, collectOptions(opts))
+}
+
+func parse(ctx context.Context, input []byte, opts Options) (doc *Node, err error) {
+	doc = NewNode(Document)
+	defer recoverPanic(&err)
+	extensions := opts.Extensions
+
+	if max := opts.Limits.MaxInputSize; max > 0 && len(input) > max {
+		return doc, &LimitError{Limit: "MaxInputSize", Max: max}
+	}
+
+	// fill in the parser structure
+	if extensions&EXTENSION_COMMONMARK != 0 {
+		// fenced code blocks and the space after the '#' of a header are
+		// part of the spec
+		extensions |= EXTENSION_FENCED_CODE | EXTENSION_SPACE_HEADERS
 	}
 
-	// fill in the render structure
 	p := new(parser)
-	p.r = renderer
 	p.flags = extensions
 	p.refs = make(map[string]*reference)
-	p.maxNesting = 16
+	p.maxNesting = opts.MaxNesting
+	p.nestingPolicy = opts.NestingPolicy
+	p.diagnostics = opts.Diagnostics
+	p.limits = opts.Limits
+	p.ctx = ctx
+	p.done = ctx.Done()
 	p.insideLink = false
+	p.sources = make(sources)
+	p.sources.register(input, []sourceRun{{n: len(input)}})
+	p.lines = newLineIndex(input)
+	p.inputSize = len(input)
 
 	// register inline parsers
-	p.inlineCallback['*'] = emphasis
-	p.inlineCallback['_'] = emphasis
+	if extensions&EXTENSION_COMMONMARK != 0 {
+		p.inlineCallback['*'] = delimiterRun
+		p.inlineCallback['_'] = delimiterRun
+	} else {
+		p.inlineCallback['*'] = emphasis
+		p.inlineCallback['_'] = emphasis
+	}
 	if extensions&EXTENSION_STRIKETHROUGH != 0 {
 		p.inlineCallback['~'] = emphasis
 	}
@@ -287,27 +881,57 @@ func Markdown(input []byte, renderer Renderer, extensions int) []byte {
 	p.inlineCallback['\\'] = escape
 	p.inlineCallback['&'] = entity
 
-	if extensions&EXTENSION_AUTOLINK != 0 {
+	if extensions&(EXTENSION_AUTOLINK|EXTENSION_EXTENDED_AUTOLINK) != 0 {
 		p.inlineCallback[':'] = autoLink
 	}
+	if extensions&EXTENSION_EXTENDED_AUTOLINK != 0 {
+		p.inlineCallback['w'] = wwwLink
+		p.inlineCallback['@'] = emailLink
+	}
+	if extensions&EXTENSION_MATH != 0 {
+		p.inlineCallback['$'] = math
+	}
+
+	p.public = &Parser{p}
+	for _, custom := range opts.BlockParsers {
+		if custom.Starts != nil && custom.Parse != nil {
+			p.blockParsers = append(p.blockParsers, custom)
+		}
+	}
+	sort.SliceStable(p.blockParsers, func(i, j int) bool {
+		return p.blockParsers[i].Priority > p.blockParsers[j].Priority
+	})
+	for c, custom := range opts.InlineParsers {
+		if custom != nil {
+			p.inlineCallback[c] = customInline(c, custom, p.inlineCallback[c])
+		}
+	}
 
 	if extensions&EXTENSION_FOOTNOTES != 0 {
 		p.notes = make([]*reference, 0)
 	}
 
+	if extensions&EXTENSION_ABBREVIATIONS != 0 {
+		p.abbrs = make(map[string][]byte)
+	}
+
 	first := firstPass(p, input)
-	second := secondPass(p, first)
-	return second
+
+	// nothing refers to the input itself any more; let it go
+	p.sources.unregister(input)
+
+	secondPass(p, doc, first)
+	return doc, p.err
 }
 
 // first pass:
-// - extract references
+// - extract references and abbreviations
 // - expand tabs
 // - normalize newlines
 // - copy everything else
 // - add missing newlines before fenced code blocks
 func firstPass(p *parser, input []byte) []byte {
-	var out bytes.Buffer
+	out := sourceBuffer{src: p.sources}
 	tabSize := TAB_SIZE_DEFAULT
 	if p.flags&EXTENSION_TAB_SIZE_EIGHT != 0 {
 		tabSize = TAB_SIZE_EIGHT
@@ -318,6 +942,8 @@ func firstPass(p *parser, input []byte) []byte {
 	for beg < len(input) { // iterate over lines
 		if end = isReference(p, input[beg:], tabSize); end > 0 {
 			beg += end
+		} else if end = isAbbreviation(p, input[beg:]); end > 0 {
+			beg += end
 		} else { // skip to the next line
 			end = beg
 			for end < len(input) && input[end] != '\n' && input[end] != '\r' {
@@ -327,9 +953,10 @@ func firstPass(p *parser, input []byte) []byte {
 			if p.flags&EXTENSION_FENCED_CODE != 0 {
 				// when last line was none blank and a fenced code block comes after
 				if beg >= lastFencedCodeBlockEnd {
-					if i := p.fencedCode(&out, input[beg:], false); i > 0 {
-						if !lastLineWasBlank {
-							out.WriteByte('\n') // need to inject additional linebreak
+					if i := p.fencedCode(nil, input[beg:], false); i > 0 {
+						// CommonMark lets fences interrupt paragraphs on their own
+						if !lastLineWasBlank && p.flags&EXTENSION_COMMONMARK == 0 {
+							out.fill('\n', 1, input[beg:]) // need to inject additional linebreak
 						}
 						lastFencedCodeBlockEnd = beg + i
 					}
@@ -340,12 +967,18 @@ func firstPass(p *parser, input []byte) []byte {
 			// add the line body if present
 			if end > beg {
 				if end < lastFencedCodeBlockEnd { // Do not expand tabs while inside fenced code blocks.
-					out.Write(input[beg:end])
+					out.copy(input[beg:end])
+				} else if p.flags&EXTENSION_COMMONMARK != 0 {
+					// CommonMark keeps the tabs in the content of a line,
+					// and only counts them as columns where they indent
+					n := containerPrefix(input[beg:end])
+					expandTabs(&out, input[beg:beg+n], tabSize)
+					out.copy(input[beg+n : end])
 				} else {
 					expandTabs(&out, input[beg:end], tabSize)
 				}
 			}
-			out.WriteByte('\n')
+			out.fill('\n', 1, input[end:])
 
 			if end < len(input) && input[end] == '\r' {
 				end++
@@ -360,45 +993,496 @@ func firstPass(p *parser, input []byte) []byte {
 
 	// empty input?
 	if out.Len() == 0 {
-		out.WriteByte('\n')
+		out.fill('\n', 1, input)
 	}
 
-	return out.Bytes()
+	return out.finish()
 }
 
-// second pass: actual rendering
-func secondPass(p *parser, input []byte) []byte {
-	var output bytes.Buffer
-
-	p.r.DocumentHeader(&output)
-	p.block(&output, input)
+// second pass: actual parsing
+func secondPass(p *parser, doc *Node, input []byte) {
+	p.block(doc, input)
 
 	if p.flags&EXTENSION_FOOTNOTES != 0 && len(p.notes) > 0 {
-		p.r.Footnotes(&output, func() bool {
-			flags := LIST_ITEM_BEGINNING_OF_LIST
-			for _, ref := range p.notes {
-				var buf bytes.Buffer
-				if ref.hasBlock {
-					flags |= LIST_ITEM_CONTAINS_BLOCK
-					p.block(&buf, ref.title)
-				} else {
-					p.inline(&buf, ref.title)
+		footnotes := doc.add(Footnotes)
+		flags := LIST_ITEM_BEGINNING_OF_LIST
+		// notes referenced from within the notes themselves are appended
+		// as they are found, so keep going until the list stops growing
+		for i := 0; i < len(p.notes); i++ {
+			ref := p.notes[i]
+			if ref.noteId != i+1 {
+				p.fail("Footnote numbers do not follow the list of notes")
+			}
+			item := footnotes.add(Item)
+			item.RefLink = ref.link
+			item.source = ref.title
+			if ref.hasBlock {
+				flags |= LIST_ITEM_CONTAINS_BLOCK
+				p.block(item, ref.title)
+			} else {
+				p.inline(item, ref.title)
+			}
+			if ref.isInline {
+				flags |= LIST_ITEM_INLINE_NOTE
+			}
+			item.ListFlags = flags
+			flags &^= LIST_ITEM_BEGINNING_OF_LIST | LIST_ITEM_CONTAINS_BLOCK | LIST_ITEM_INLINE_NOTE
+		}
+	}
+
+	if len(p.abbrs) > 0 {
+		p.abbreviations(doc)
+	}
+
+	if p.nesting != 0 {
+		p.fail("Nesting level did not end at zero")
+	}
+
+	p.resolvePositions(doc)
+}
+
+// fail records a broken invariant. Only the first error is reported.
+func (p *parser) fail(msg string) {
+	if p.err == nil {
+		p.err = &InvariantError{Msg: msg}
+	}
+}
+
+// tooDeep handles data that is nested deeper than allowed, according to the
+// nesting policy. Block-level data becomes a paragraph of plain text.
+func (p *parser) tooDeep(out *Node, data []byte, block bool) {
+	pos := p.position(data)
+	switch p.nestingPolicy {
+	case NESTING_ERROR:
+		if p.err == nil {
+			p.err = &NestingError{Pos: pos, MaxDepth: p.maxNesting}
+		}
+		return
+	case NESTING_REPORT:
+		p.report(pos, fmt.Sprintf("nesting deeper than %d levels, kept as plain text", p.maxNesting))
+	}
+
+	if block {
+		data = bytes.TrimRight(data, "\n")
+		if len(data) == 0 {
+			return
+		}
+		out = out.add(Paragraph)
+		out.source = data
+	}
+	out.addText(data)
+}
+
+// report hands a diagnostic over to whoever wants it.
+func (p *parser) report(pos Position, msg string) {
+	if p.diagnostics != nil {
+		p.diagnostics(Diagnostic{Pos: pos, Msg: msg})
+	}
+}
+
+// RenderTree renders a tree produced by Parse, or assembled by hand, with the
+// supplied Renderer. The node is normally a Document, but any subtree can be
+// rendered on its own.
+//
+// RenderTree never panics. If the renderer does, the result is nil.
+func RenderTree(doc *Node, renderer Renderer) []byte {
+	output, _ := renderTree(context.Background(), doc, Options{Renderer: renderer})
+	return output
+}
+
+func renderTree(ctx context.Context, doc *Node, opts Options) (output []byte, err error) {
+	defer recoverPanic(&err)
+	if doc == nil || opts.Renderer == nil {
+		return nil, nil
+	}
+	var out bytes.Buffer
+	t, err := newTreeRenderer(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	t.walk(&out, doc)
+	if t.err != nil {
+		return nil, t.err
+	}
+	return out.Bytes(), nil
+}
+
+// renderTo renders the tree rooted at node to w, one top-level block at a
+// time.
+func renderTo(ctx context.Context, w io.Writer, node *Node, opts Options) error {
+	var out bytes.Buffer
+	t, err := newTreeRenderer(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if HtmlFlags(opts.Renderer.GetFlags())&HTML_TOC == 0 {
+		t.w = w
+	}
+	t.walk(&out, node)
+	if t.err != nil {
+		return t.err
+	}
+	_, err = w.Write(out.Bytes())
+	return err
+}
+
+func newTreeRenderer(ctx context.Context, opts Options) (*treeRenderer, error) {
+	r := opts.Renderer
+	if s, ok := r.(StatefulRenderer); ok {
+		r = s.NewDocument()
+		// a NewDocument promoted from an embedded renderer loses the
+		// methods of the embedding one
+		if embedsRenderer(opts.Renderer) && !embedsRenderer(r) {
+			return nil, &RendererError{Renderer: opts.Renderer}
+		}
+	}
+	t := &treeRenderer{
+		r:         r,
+		maxOutput: opts.Limits.MaxOutputSize,
+		ctx:       ctx,
+		done:      ctx.Done(),
+	}
+	t.pos, _ = t.r.(SourcePosRenderer)
+	t.inline, _ = t.r.(InlineNoteRenderer)
+	t.start, _ = t.r.(ListStartRenderer)
+	t.hooks, _ = t.r.(NodeHookRenderer)
+	return t, nil
+}
+
+// treeRenderer walks a tree and calls the matching Renderer callback for
+// every node. Callbacks that take the rendered contents of an element as a
+// byte slice get a buffer of their own, which is pushed when the walk enters
+// the element and handed over when it leaves. Callbacks that take a function
+// instead render the children from within that function.
+type treeRenderer struct {
+	r    Renderer
+	pos  SourcePosRenderer // r, if it wants to know about source positions
+	bufs []*bytes.Buffer
+
+	// r, if it writes inline notes where they are referenced, and the items
+	// of the notes, by number, once one is looked up
+	inline InlineNoteRenderer
+	notes  []*Node
+
+	// r, if it keeps the numbers ordered lists start at
+	start ListStartRenderer
+
+	// r, if it renders some nodes with hooks of its own
+	hooks NodeHookRenderer
+
+	// If set, finished top-level blocks are moved from the output buffer to
+	// w as the walk goes. The first write error stops the walk.
+	w       io.Writer
+	written int
+	err     error
+
+	// The walk also stops when the output gets too big or the context is
+	// cancelled.
+	maxOutput int
+	ctx       context.Context
+	done      <-chan struct{}
+}
+
+func (t *treeRenderer) walk(out *bytes.Buffer, node *Node) {
+	t.bufs = append(t.bufs, out)
+	Walk(node, t.visit)
+	t.bufs = t.bufs[:len(t.bufs)-1]
+}
+
+func (t *treeRenderer) work(out *bytes.Buffer, node *Node) func() bool {
+	return func() bool {
+		for c := node.FirstChild; c != nil; c = c.Next {
+			t.walk(out, c)
+		}
+		return true
+	}
+}
+
+func (t *treeRenderer) visit(node *Node, entering bool) WalkStatus {
+	status := GoToNext
+	if entering {
+		status = t.enter(node)
+	} else {
+		t.leave(node)
+	}
+	if len(t.bufs) == 1 {
+		if status = t.check(status); t.w != nil {
+			status = t.flush(status)
+		}
+	}
+	return status
+}
+
+// check stops the walk if the output is over the limit or the context is
+// cancelled.
+func (t *treeRenderer) check(status WalkStatus) WalkStatus {
+	if t.maxOutput > 0 && t.written+t.bufs[0].Len() > t.maxOutput {
+		t.err = &LimitError{Limit: "MaxOutputSize", Max: t.maxOutput}
+		return Terminate
+	}
+	select {
+	case <-t.done:
+		t.err = t.ctx.Err()
+		return Terminate
+	default:
+	}
+	return status
+}
+
+// flush writes the output of the top-level blocks rendered so far to t.w.
+// The last byte is held back: renderers look at it (or just at whether there
+// is any output) to decide how to separate blocks.
+func (t *treeRenderer) flush(status WalkStatus) WalkStatus {
+	out := t.bufs[0]
+	if status == Terminate || out.Len() < 2 {
+		return status
+	}
+	data := out.Bytes()
+	last := data[len(data)-1]
+	if _, t.err = t.w.Write(data[:len(data)-1]); t.err != nil {
+		return Terminate
+	}
+	t.written += len(data) - 1
+	out.Reset()
+	out.WriteByte(last)
+	return status
+}
+
+// sourcePos renders a node with render, through the renderer if it wants to
+// know where block-level nodes came from.
+func (t *treeRenderer) sourcePos(out *bytes.Buffer, node *Node, render func()) {
+	if t.pos != nil && node.isBlock() {
+		t.pos.SourcePos(out, node, render)
+	} else {
+		render()
+	}
+}
+
+// hook returns the hook the renderer has for a node, if any.
+func (t *treeRenderer) hook(node *Node) NodeHook {
+	if t.hooks == nil || node.Type == Document {
+		return nil
+	}
+	return t.hooks.NodeHook(node)
+}
+
+func (t *treeRenderer) enter(node *Node) (status WalkStatus) {
+	out := t.bufs[len(t.bufs)-1]
+	t.sourcePos(out, node, func() {
+		// nodes with their contents collected are rendered on the way out
+		if hook := t.hook(node); hook != nil && !collectsContents(node) {
+			hook(out, node, func() {
+				t.work(out, node)()
+			}, func() {
+				if t.enterNode(out, node) == GoToNext {
+					t.work(out, node)()
 				}
-				p.r.FootnoteItem(&output, ref.link, buf.Bytes(), flags)
-				flags &^= LIST_ITEM_BEGINNING_OF_LIST | LIST_ITEM_CONTAINS_BLOCK
+			})
+			status = SkipChildren
+			return
+		}
+		status = t.enterNode(out, node)
+	})
+	return status
+}
+
+// collectsContents tells if the children of a node are rendered to a buffer
+// of their own, and handed to the callback for the node as it is left.
+func collectsContents(node *Node) bool {
+	switch node.Type {
+	case BlockQuote, Item, TableRow, TableCell,
+		Emphasis, DoubleEmphasis, TripleEmphasis, StrikeThrough, Link,
+		CustomBlock, CustomSpan:
+		return true
+	}
+	return false
+}
+
+func (t *treeRenderer) enterNode(out *bytes.Buffer, node *Node) WalkStatus {
+	r := t.r
+
+	switch node.Type {
+	case Document:
+		r.DocumentHeader(out)
+	case TitleBlock:
+		r.TitleBlock(out, node.Literal)
+	case HtmlBlock:
+		r.BlockHtml(out, node.Literal)
+	case Header:
+		r.Header(out, t.work(out, node), node.Level, node.HeaderID)
+		return SkipChildren
+	case HorizontalRule:
+		r.HRule(out)
+	case CodeBlock:
+		r.BlockCode(out, node.Literal, node.Lang)
+	case MathBlock:
+		r.MathBlock(out, node.Literal)
+	case List:
+		if node.ListFlags&LIST_TYPE_DEFINITION != 0 {
+			r.DefinitionList(out, t.work(out, node), node.ListFlags)
+		} else if node.ListFlags&LIST_START != 0 && t.start != nil {
+			t.start.ListStart(out, t.work(out, node), node.ListFlags, node.ListStart)
+		} else {
+			r.List(out, t.work(out, node), node.ListFlags)
+		}
+		return SkipChildren
+	case Paragraph:
+		r.Paragraph(out, t.work(out, node))
+		return SkipChildren
+	case Table:
+		var header, body bytes.Buffer
+		for c := node.FirstChild; c != nil; c = c.Next {
+			if c.Type == TableHead {
+				t.walk(&header, c)
+			} else {
+				t.walk(&body, c)
 			}
+		}
+		r.Table(out, header.Bytes(), body.Bytes(), node.Columns)
+		return SkipChildren
+	case Footnotes:
+		r.Footnotes(out, t.work(out, node))
+		return SkipChildren
+	case BlockQuote, Item, TableRow, TableCell,
+		Emphasis, DoubleEmphasis, TripleEmphasis, StrikeThrough, Link,
+		CustomBlock, CustomSpan:
+		// see collectsContents
+		t.bufs = append(t.bufs, new(bytes.Buffer))
+
+	case Text:
+		r.NormalText(out, node.Literal)
+	case CodeSpan:
+		r.CodeSpan(out, node.Literal)
+	case LineBreak:
+		r.LineBreak(out)
+	case Image:
+		r.Image(out, node.Destination, node.Title, node.Literal)
+	case AutoLink:
+		r.AutoLink(out, node.Destination, node.LinkType)
+	case HtmlSpan:
+		r.RawHtmlTag(out, node.Literal)
+	case FootnoteRef:
+		if item := t.inlineNote(node); item != nil {
+			t.inline.InlineNote(out, t.work(out, item), node.NoteID)
+			break
+		}
+		r.FootnoteRef(out, node.Destination, node.NoteID)
+	case Abbreviation:
+		r.Abbreviation(out, node.Literal, node.Title)
+	case MathSpan:
+		r.MathSpan(out, node.Literal, node.IsDisplay)
+	case Entity:
+		r.Entity(out, node.Literal)
+	}
+	return GoToNext
+}
 
-			return true
-		})
+// inlineNote finds the item of the inline note that ref refers to, if the
+// renderer writes such notes where they are referenced.
+func (t *treeRenderer) inlineNote(ref *Node) *Node {
+	if t.inline == nil || !ref.IsInlineNote {
+		return nil
 	}
+	if t.notes == nil {
+		doc := ref
+		for doc.Parent != nil {
+			doc = doc.Parent
+		}
+		if doc.LastChild != nil && doc.LastChild.Type == Footnotes {
+			for item := doc.LastChild.FirstChild; item != nil; item = item.Next {
+				t.notes = append(t.notes, item)
+			}
+		}
+	}
+	if ref.NoteID < 1 || ref.NoteID > len(t.notes) {
+		return nil
+	}
+	return t.notes[ref.NoteID-1]
+}
 
-	p.r.DocumentFooter(&output)
+func (t *treeRenderer) leave(node *Node) {
+	r, out := t.r, t.bufs[len(t.bufs)-1]
 
-	if p.nesting != 0 {
-		panic("Nesting level did not end at zero")
+	switch {
+	case node.Type == Document:
+		r.DocumentFooter(out)
+		return
+	case collectsContents(node):
+		// hand the contents over to the enclosing buffer
+		t.bufs = t.bufs[:len(t.bufs)-1]
+	default:
+		return
 	}
 
-	return output.Bytes()
+	text := out.Bytes()
+	out = t.bufs[len(t.bufs)-1]
+	t.sourcePos(out, node, func() {
+		if hook := t.hook(node); hook != nil {
+			hook(out, node, func() {
+				out.Write(text)
+			}, func() {
+				t.leaveNode(out, node, text)
+			})
+			return
+		}
+		t.leaveNode(out, node, text)
+	})
+}
+
+func (t *treeRenderer) leaveNode(out *bytes.Buffer, node *Node, text []byte) {
+	r := t.r
+
+	switch node.Type {
+	case BlockQuote:
+		r.BlockQuote(out, text)
+	case Item:
+		if node.Parent != nil && node.Parent.Type == Footnotes {
+			r.FootnoteItem(out, node.RefLink, text, node.ListFlags)
+			break
+		}
+		// strip trailing newlines
+		for len(text) > 0 && text[len(text)-1] == '\n' {
+			text = text[:len(text)-1]
+		}
+		switch {
+		case node.ListFlags&LIST_TYPE_TERM != 0:
+			r.DefinitionTerm(out, text, node.ListFlags)
+		case node.ListFlags&LIST_TYPE_DEFINITION != 0:
+			r.DefinitionData(out, text, node.ListFlags)
+		default:
+			r.ListItem(out, text, node.ListFlags)
+		}
+	case TableRow:
+		r.TableRow(out, text)
+	case TableCell:
+		if node.IsHeader {
+			r.TableHeaderCell(out, text, node.Align)
+		} else {
+			r.TableCell(out, text, node.Align)
+		}
+	case Emphasis:
+		r.Emphasis(out, text)
+	case DoubleEmphasis:
+		if len(text) > 0 {
+			r.DoubleEmphasis(out, text)
+		}
+	case TripleEmphasis:
+		if len(text) > 0 {
+			r.TripleEmphasis(out, text)
+		}
+	case StrikeThrough:
+		if len(text) > 0 {
+			r.StrikeThrough(out, text)
+		}
+	case Link:
+		r.Link(out, node.Destination, node.Title, text)
+	case CustomBlock, CustomSpan:
+		if node.Render != nil {
+			node.Render(r, out, text)
+		} else {
+			out.Write(text)
+		}
+	}
 }
 
 //
@@ -426,16 +1510,18 @@ func secondPass(p *parser, input []byte) []byte {
 // Footnotes should be placed at the end of the document in an ordered list.
 // Inline footnotes such as:
 //
-//    Inline footnotes^[Not supported.] also exist.
+//    Inline footnotes^[Like this one.] also exist.
 //
-// are not yet supported.
+// carry their text with them. Both kinds are numbered in the order they are
+// first referenced.
 
 // References are parsed and stored in this struct.
 type reference struct {
 	link     []byte
 	title    []byte
-	noteId   int // 0 if not a footnote ref
+	noteId   int // 0 if not a footnote ref, < 0 if not yet referenced
 	hasBlock bool
+	isInline bool // an inline footnote, written in the text
 }
 
 // Check whether or not data starts with a reference link.
@@ -461,10 +1547,10 @@ func isReference(p *parser, data []byte, tabSize int) int {
 	}
 	i++
 	if p.flags&EXTENSION_FOOTNOTES != 0 {
-		if data[i] == '^' {
-			// we can set it to anything here because the proper noteIds will
-			// be assigned later during the second pass. It just has to be != 0
-			noteId = 1
+		if i < len(data) && data[i] == '^' {
+			// the proper noteId is assigned when the note is first referenced;
+			// until then it just has to be < 0
+			noteId = -1
 			i++
 		}
 	}
@@ -524,7 +1610,7 @@ func isReference(p *parser, data []byte, tabSize int) int {
 		hasBlock: hasBlock,
 	}
 
-	if noteId > 0 {
+	if noteId != 0 {
 		// reusing the link field for the id since footnotes don't have links
 		ref.link = data[idOffset:idEnd]
 		// if footnote, it's not really a title, it's the contained text
@@ -534,9 +1620,18 @@ func isReference(p *parser, data []byte, tabSize int) int {
 		ref.title = data[titleOffset:titleEnd]
 	}
 
-	// id matches are case-insensitive
+	// id matches are case-insensitive; notes keep their '^' so that [^id]
+	// and [id] never find each other's definitions
+	if noteId != 0 {
+		idOffset--
+	}
 	id := string(bytes.ToLower(data[idOffset:idEnd]))
 
+	if max := p.limits.MaxReferences; max > 0 && len(p.refs) >= max {
+		if _, found := p.refs[id]; !found {
+			p.abort(&LimitError{Limit: "MaxReferences", Max: max})
+		}
+	}
 	p.refs[id] = ref
 
 	return lineEnd
@@ -552,7 +1647,7 @@ func scanLinkRef(p *parser, data []byte, i int) (linkOffset, linkEnd, titleOffse
 		i++
 	}
 	linkEnd = i
-	if data[linkOffset] == '<' && data[linkEnd-1] == '>' {
+	if linkOffset < linkEnd && data[linkOffset] == '<' && data[linkEnd-1] == '>' {
 		linkOffset++
 		linkEnd--
 	}
@@ -635,10 +1730,10 @@ func scanFootnote(p *parser, data []byte, i, indentSize int) (blockStart, blockE
 	}
 
 	// get working buffer
-	var raw bytes.Buffer
+	raw := sourceBuffer{src: p.sources}
 
 	// put the first line into the working buffer
-	raw.Write(data[blockEnd:i])
+	raw.copy(data[blockEnd:i])
 	blockEnd = i
 
 	// process the following lines
@@ -670,26 +1765,268 @@ gatherLines:
 
 		// if there were blank lines before this one, insert a new one now
 		if containsBlankLine {
-			raw.WriteByte('\n')
+			raw.fill('\n', 1, data[blockEnd:])
 			containsBlankLine = false
 		}
 
 		// get rid of that first tab, write to buffer
-		raw.Write(data[blockEnd+n : i])
+		raw.copy(data[blockEnd+n : i])
 		hasBlock = true
 
 		blockEnd = i
 	}
 
 	if data[blockEnd-1] != '\n' {
-		raw.WriteByte('\n')
+		raw.fill('\n', 1, data[blockEnd:])
 	}
 
-	contents = raw.Bytes()
+	contents = raw.finish()
 
 	return
 }
 
+//
+// Abbreviations
+//
+// These are the abbreviations of PHP Markdown Extra. They are defined
+// anywhere in the document, much like reference links:
+//
+//    *[HTML]: Hyper Text Markup Language
+//
+// and every time the abbreviation comes up as a word of its own in the text,
+// it is marked up with what it stands for.
+//
+
+// Check whether or not data starts with the definition of an abbreviation.
+// If so, it is stored in the parser.
+// Returns the number of bytes to skip to move past it,
+// or zero if the first line is not one.
+func isAbbreviation(p *parser, data []byte) int {
+	if p.abbrs == nil {
+		return 0
+	}
+
+	// up to 3 optional leading spaces
+	i := 0
+	for i < 3 && i < len(data) && data[i] == ' ' {
+		i++
+	}
+
+	// the abbreviation: anything but a newline between *[ and ]:
+	if i+1 >= len(data) || data[i] != '*' || data[i+1] != '[' {
+		return 0
+	}
+	i += 2
+	nameOffset := i
+	for i < len(data) && data[i] != '\n' && data[i] != '\r' && data[i] != ']' {
+		i++
+	}
+	if i+1 >= len(data) || data[i] != ']' || data[i+1] != ':' {
+		return 0
+	}
+	name := string(bytes.TrimSpace(data[nameOffset:i]))
+	if name == "" {
+		return 0
+	}
+	i += 2
+
+	// the expansion: the rest of the line, without the spaces around it
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t') {
+		i++
+	}
+	titleOffset := i
+	for i < len(data) && data[i] != '\n' && data[i] != '\r' {
+		i++
+	}
+	titleEnd := i
+	for titleEnd > titleOffset && (data[titleEnd-1] == ' ' || data[titleEnd-1] == '\t') {
+		titleEnd--
+	}
+	if i < len(data) && data[i] == '\r' {
+		i++
+	}
+	if i < len(data) && data[i] == '\n' {
+		i++
+	}
+
+	if max := p.limits.MaxReferences; max > 0 && len(p.refs)+len(p.abbrs) >= max {
+		if _, found := p.abbrs[name]; !found {
+			p.abort(&LimitError{Limit: "MaxReferences", Max: max})
+		}
+	}
+	p.abbrs[name] = data[titleOffset:titleEnd]
+
+	return i
+}
+
+// abbreviations marks up the abbreviations in the text of the document.
+func (p *parser) abbreviations(doc *Node) {
+	// the lengths of the abbreviations, longest first, which are tried in
+	// turn at the start of every word
+	var lengths []int
+	seen := make(map[int]bool)
+	for name := range p.abbrs {
+		if !seen[len(name)] {
+			seen[len(name)] = true
+			lengths = append(lengths, len(name))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(lengths)))
+
+	// the text is split up after the walk, which must not see it. Escaped
+	// chars and entities make nodes of their own, so abbreviations are
+	// looked for in runs of adjacent Text and Entity nodes.
+	var runs [][]*Node
+	Walk(doc, func(node *Node, entering bool) WalkStatus {
+		if node.Type != Text && node.Type != Entity {
+			return GoToNext
+		}
+		if n := len(runs); n > 0 && node.Prev != nil && node.Prev == runs[n-1][len(runs[n-1])-1] {
+			runs[n-1] = append(runs[n-1], node)
+		} else {
+			runs = append(runs, []*Node{node})
+		}
+		return GoToNext
+	})
+	for _, run := range runs {
+		p.abbreviate(run, lengths)
+	}
+}
+
+// abbreviate puts an Abbreviation node in place of every abbreviation in a
+// run of Text and Entity nodes that is not part of a longer word, trying the
+// given lengths at the start of every word. Entities are matched by what
+// they stand for, but only as a whole: an abbreviation can't start or end in
+// the middle of one.
+func (p *parser) abbreviate(run []*Node, lengths []int) {
+	// the text of the run, and where every node starts in it
+	var data []byte
+	starts := make([]int, len(run)+1)
+	for i, node := range run {
+		starts[i] = len(data)
+		if node.Type == Entity {
+			data = append(data, html.UnescapeString(string(node.Literal))...)
+		} else {
+			data = append(data, node.Literal...)
+		}
+	}
+	starts[len(run)] = len(data)
+	p.spend(len(data))
+
+	// inside tells if 'at' is in the middle of an entity
+	inside := func(at int) bool {
+		i := sort.SearchInts(starts, at)
+		return starts[i] != at && run[i-1].Type == Entity
+	}
+
+	var matches [][]int
+	for at := 0; at < len(data); {
+		before, _ := utf8.DecodeLastRune(data[:at])
+		if !isWordRune(before) && !inside(at) {
+			for _, n := range lengths {
+				end := at + n
+				if end > len(data) || inside(end) {
+					continue
+				}
+				if after, _ := utf8.DecodeRune(data[end:]); isWordRune(after) {
+					continue
+				}
+				p.spend(n)
+				if _, found := p.abbrs[string(data[at:end])]; found {
+					matches = append(matches, []int{at, end})
+					break
+				}
+			}
+		}
+		if n := len(matches); n > 0 && matches[n-1][0] == at {
+			at = matches[n-1][1]
+		} else {
+			_, size := utf8.DecodeRune(data[at:])
+			at += size
+		}
+	}
+	if len(matches) == 0 {
+		return
+	}
+
+	// the nodes of the run are put back piece by piece where it was
+	parent, next := run[0].Parent, run[len(run)-1].Next
+	for _, node := range run {
+		node.Unlink()
+	}
+	add := func(node *Node) {
+		if next != nil {
+			next.InsertBefore(node)
+		} else {
+			parent.AppendChild(node)
+		}
+	}
+
+	var abbr *Node // the abbreviation being put together
+	for i, node := range run {
+		beg, end := starts[i], starts[i+1]
+		if abbr == nil && (len(matches) == 0 || matches[0][0] >= end) {
+			add(node)
+			continue
+		}
+
+		// the pieces of a text keep their part of its source, unless
+		// escaped chars make them differ; an entity is never split up
+		piece := func(from, to int) []byte {
+			if node.Type == Entity || len(node.source) != len(node.Literal) {
+				return node.source
+			}
+			return node.source[from-beg : to-beg]
+		}
+		text := func(from, to int) {
+			rest := NewNode(Text)
+			rest.Literal = data[from:to]
+			rest.source = piece(from, to)
+			add(rest)
+		}
+
+		for at := beg; at < end; {
+			switch {
+			case abbr != nil:
+				to := end
+				if matches[0][1] < to {
+					to = matches[0][1]
+				}
+				abbr.source = joinSource(abbr.source, piece(at, to))
+				at = to
+			case len(matches) > 0 && matches[0][0] < end:
+				m := matches[0]
+				if m[0] > at {
+					text(at, m[0])
+				}
+				to := end
+				if m[1] < to {
+					to = m[1]
+				}
+				abbr = NewNode(Abbreviation)
+				abbr.Literal = data[m[0]:m[1]]
+				abbr.Title = p.abbrs[string(abbr.Literal)]
+				abbr.source = piece(m[0], to)
+				add(abbr)
+				at = to
+			default:
+				text(at, end)
+				at = end
+			}
+			if abbr != nil && at == matches[0][1] {
+				abbr = nil
+				matches = matches[1:]
+			}
+		}
+	}
+}
+
+// Test if a rune is part of a word, so that an abbreviation can't be next
+// to it.
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
 //
 //
 // Miscellaneous helper functions
@@ -723,9 +2060,18 @@ func isalnum(c byte) bool {
 	return (c >= '0' && c <= '9') || isletter(c)
 }
 
+// Test if a rune is punctuation, the way CommonMark has it when telling
+// which delimiter runs can open or close emphasis.
+func isPunctRune(r rune) bool {
+	if r < utf8.RuneSelf {
+		return ispunct(byte(r))
+	}
+	return unicode.IsPunct(r) || unicode.IsSymbol(r)
+}
+
 // Replace tab characters with spaces, aligning to the next TAB_SIZE column.
 // always ends output with a newline
-func expandTabs(out *bytes.Buffer, line []byte, tabSize int) {
+func expandTabs(out *sourceBuffer, line []byte, tabSize int) {
 	// first, check for common cases: no tabs, or only tabs at beginning of line
 	i, prefix := 0, 0
 	slowcase := false
@@ -742,10 +2088,10 @@ func expandTabs(out *bytes.Buffer, line []byte, tabSize int) {
 
 	// no need to decode runes if all tabs are at the beginning of the line
 	if !slowcase {
-		for i = 0; i < prefix*tabSize; i++ {
-			out.WriteByte(' ')
+		for i = 0; i < prefix; i++ {
+			out.fill(' ', tabSize, line[i:])
 		}
-		out.Write(line[prefix:])
+		out.copy(line[prefix:])
 		return
 	}
 
@@ -762,23 +2108,35 @@ func expandTabs(out *bytes.Buffer, line []byte, tabSize int) {
 		}
 
 		if i > start {
-			out.Write(line[start:i])
+			out.copy(line[start:i])
 		}
 
 		if i >= len(line) {
 			break
 		}
 
+		spaces := 0
 		for {
-			out.WriteByte(' ')
+			spaces++
 			column++
 			if column%tabSize == 0 {
 				break
 			}
 		}
+		out.fill(' ', spaces, line[i:])
+
+		i++
+	}
+}
 
+// containerPrefix returns the length of the indentation of a line, along
+// with the block quote and list markers and the hashes of a header in it.
+func containerPrefix(line []byte) int {
+	i := 0
+	for i < len(line) && (indexByte(" \t>-*+#.)=_", line[i]) || isdigit(line[i])) {
 		i++
 	}
+	return i
 }
 
 // Find if a line counts as indented or not.
@@ -0,0 +1,460 @@
+//
+// Blackfriday Markdown Processor
+// Available at http://github.com/russross/blackfriday
+//
+// Copyright © 2011 Russ Ross <russ@russross.com>.
+// Distributed under the Simplified BSD License.
+// See README.md for details.
+//
+
+//
+// Unit tests for the public entry points
+//
+
+package blackfriday
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// panickyRenderer is an Html renderer that falls over on paragraphs.
+type panickyRenderer struct {
+	Renderer
+}
+
+func (panickyRenderer) Paragraph(out Writer, text func() bool) {
+	panic("no paragraphs please")
+}
+
+func TestMarkdownE(t *testing.T) {
+	output, err := MarkdownE([]byte("# Title\n\ntext\n"), WithRenderer(HtmlRenderer(0, "", "")))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if expected := "<h1>Title</h1>\n\n<p>text</p>\n"; string(output) != expected {
+		t.Errorf("\nExpected[%#v]\nActual  [%#v]", expected, string(output))
+	}
+
+	output, err = MarkdownE(nil)
+	if len(output) != 0 || err != nil {
+		t.Errorf("expected no output for no input, got %q and %v", output, err)
+	}
+}
+
+// TestMarkdownEReference runs the reference inputs through MarkdownE, which
+// reports the broken invariants that Markdown keeps quiet about.
+func TestMarkdownEReference(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.text"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no reference inputs: %v", err)
+	}
+	for _, filename := range files {
+		input, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Errorf("Couldn't open '%s', error: %v\n", filename, err)
+			continue
+		}
+		for _, extensions := range []Extensions{0, commonExtensions} {
+			opts := []Option{WithRenderer(HtmlRenderer(0, "", "")), WithExtensions(extensions)}
+			output, err := MarkdownE(input, opts...)
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", filename, err)
+			}
+			if expected := Markdown(input, opts...); !bytes.Equal(output, expected) {
+				t.Errorf("%s: MarkdownE and Markdown disagree\nExpected[%#v]\nActual  [%#v]",
+					filename, string(expected), string(output))
+			}
+		}
+	}
+}
+
+func TestRecoverRendererPanic(t *testing.T) {
+	renderer := panickyRenderer{HtmlRenderer(0, "", "")}
+	input := []byte("# Title\n\ntext\n")
+
+	output, err := MarkdownE(input, WithRenderer(renderer))
+	perr, ok := err.(*PanicError)
+	if !ok {
+		t.Fatalf("expected a *PanicError, got %#v", err)
+	}
+	if perr.Value != "no paragraphs please" || len(perr.Stack) == 0 {
+		t.Errorf("unexpected panic error: %v", perr)
+	}
+	if output != nil {
+		t.Errorf("expected no output, got %q", output)
+	}
+
+	if output := Markdown(input, WithRenderer(renderer)); output != nil {
+		t.Errorf("expected Markdown to return nil, got %q", output)
+	}
+	if output := RenderTree(Parse(input), renderer); output != nil {
+		t.Errorf("expected RenderTree to return nil, got %q", output)
+	}
+
+	var w bytes.Buffer
+	if err := Render(&w, bytes.NewReader(input), WithRenderer(renderer)); err == nil {
+		t.Errorf("expected Render to return the panic as an error")
+	}
+}
+
+func TestInvariantError(t *testing.T) {
+	p := &parser{maxNesting: 16}
+	p.block(NewNode(Document), []byte("no newline"))
+	err, ok := p.err.(*InvariantError)
+	if !ok {
+		t.Fatalf("expected an *InvariantError, got %#v", p.err)
+	}
+	if !strings.Contains(err.Error(), "missing terminating newline") {
+		t.Errorf("unexpected error message %q", err.Error())
+	}
+}
+
+func TestOptions(t *testing.T) {
+	input := []byte("a | b\n---|---\n1 | 2\n\n> > > deep\n")
+
+	// no options: the same as MarkdownBasic
+	if actual, expected := string(Markdown(input)), string(MarkdownBasic(input)); actual != expected {
+		t.Errorf("\nExpected[%#v]\nActual  [%#v]", expected, actual)
+	}
+
+	// later options win
+	withTables := string(Markdown(input, WithExtensions(0), WithExtensions(EXTENSION_TABLES)))
+	if !strings.Contains(withTables, "<table>") {
+		t.Errorf("expected a table, got %q", withTables)
+	}
+	options := Options{Renderer: HtmlRenderer(0, "", ""), Extensions: EXTENSION_TABLES}
+	if actual := string(Markdown(input, WithOptions(options))); actual != withTables {
+		t.Errorf("\nExpected[%#v]\nActual  [%#v]", withTables, actual)
+	}
+
+	// nesting deeper than the limit is kept as text
+	shallow := string(Markdown(input, WithMaxNesting(2)))
+	if !strings.Contains(shallow, "<p>&gt; deep</p>") || strings.Count(shallow, "<blockquote>") != 2 {
+		t.Errorf("expected the nesting to stop after two quotes, got %q", shallow)
+	}
+}
+
+func TestNestingPolicy(t *testing.T) {
+	input := []byte("text\n\n> > > deep *er*\n")
+
+	var diagnostics []string
+	report := func(d Diagnostic) {
+		diagnostics = append(diagnostics, d.String())
+	}
+
+	output, err := MarkdownE(input, WithMaxNesting(3), WithDiagnostics(report))
+	expected := "<p>text</p>\n\n<blockquote>\n<blockquote>\n<blockquote>\n<p>deep *er*</p>\n" +
+		"</blockquote>\n</blockquote>\n</blockquote>\n"
+	if err != nil || string(output) != expected {
+		t.Errorf("\nExpected[%#v]\nActual  [%#v] %v", expected, string(output), err)
+	}
+	if len(diagnostics) != 0 {
+		t.Errorf("expected no diagnostics with NESTING_TEXT, got %v", diagnostics)
+	}
+
+	output, err = MarkdownE(input, WithMaxNesting(3), WithNestingPolicy(NESTING_REPORT), WithDiagnostics(report))
+	if err != nil || string(output) != expected {
+		t.Errorf("\nExpected[%#v]\nActual  [%#v] %v", expected, string(output), err)
+	}
+	if len(diagnostics) != 1 || diagnostics[0] != "3:7: nesting deeper than 3 levels, kept as plain text" {
+		t.Errorf("unexpected diagnostics %q", diagnostics)
+	}
+
+	output, err = MarkdownE(input, WithMaxNesting(3), WithNestingPolicy(NESTING_ERROR))
+	nerr, ok := err.(*NestingError)
+	if !ok || output != nil {
+		t.Fatalf("expected a *NestingError and no output, got %#v and %q", err, output)
+	}
+	if nerr.Pos.Line != 3 || nerr.Pos.Column != 7 || nerr.MaxDepth != 3 {
+		t.Errorf("unexpected nesting error %v", nerr)
+	}
+
+	// inline content too
+	output, _ = MarkdownE([]byte("**a *b* c**\n"), WithMaxNesting(2))
+	if expected := "<p><strong>a *b* c</strong></p>\n"; string(output) != expected {
+		t.Errorf("\nExpected[%#v]\nActual  [%#v]", expected, string(output))
+	}
+}
+
+func TestLimits(t *testing.T) {
+	var tests = []struct {
+		input  string
+		limits Limits
+		limit  string
+	}{
+		{"0123456789\n", Limits{MaxInputSize: 10}, "MaxInputSize"},
+		{"[a]: /a\n[b]: /b\n[c]: /c\n", Limits{MaxReferences: 2}, "MaxReferences"},
+		{"a[^1] b[^2]\n\n[^1]: one\n[^2]: two\n", Limits{MaxFootnotes: 1}, "MaxFootnotes"},
+		{"one\n\ntwo\n\nthree\n", Limits{MaxOutputSize: 20}, "MaxOutputSize"},
+		{strings.Repeat("[", 200000) + "\n", Limits{MaxInlineWork: 100000}, "MaxInlineWork"},
+		{strings.Repeat("*a ", 50000) + "\n", Limits{MaxInlineWork: 100000}, "MaxInlineWork"},
+
+		// the bytes that the inline parsers look through count as well
+		{"`" + strings.Repeat("a", 200000) + "`\n", Limits{MaxInlineWork: 100000}, "MaxInlineWork"},
+		{"<a" + strings.Repeat(" b", 100000) + ">\n", Limits{MaxInlineWork: 100000}, "MaxInlineWork"},
+		{"&" + strings.Repeat("a", 200000) + ";\n", Limits{MaxInlineWork: 100000}, "MaxInlineWork"},
+		{"http://" + strings.Repeat("a", 200000) + "\n", Limits{MaxInlineWork: 100000}, "MaxInlineWork"},
+	}
+	for _, test := range tests {
+		input := []byte(test.input)
+		opts := []Option{WithExtensions(EXTENSION_FOOTNOTES | EXTENSION_AUTOLINK), WithLimits(test.limits)}
+		output, err := MarkdownE(input, opts...)
+		lerr, ok := err.(*LimitError)
+		if !ok || lerr.Limit != test.limit || output != nil {
+			t.Errorf("input %q: expected a %s error and no output, got %v and %q",
+				test.input, test.limit, err, output)
+		}
+
+		var w bytes.Buffer
+		err = Render(&w, bytes.NewReader(input), opts...)
+		if lerr, ok := err.(*LimitError); !ok || lerr.Limit != test.limit {
+			t.Errorf("input %q: expected Render to fail with a %s error, got %v", test.input, test.limit, err)
+		}
+
+		// fine without the limits
+		opts = append(opts, WithLimits(Limits{}))
+		if _, err := MarkdownE(input, opts...); err != nil {
+			t.Errorf("input %q: unexpected error without limits: %v", test.input, err)
+		}
+	}
+
+	// redefining a reference doesn't count
+	input := []byte("[a]: /a\n[a]: /b\n[b]: /c\n")
+	if _, err := MarkdownE(input, WithLimits(Limits{MaxReferences: 2})); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMarkdownContext(t *testing.T) {
+	input := []byte("text\n\n" + strings.Repeat("[", 100000) + "\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	output, err := MarkdownContext(ctx, []byte("text\n"))
+	if expected := "<p>text</p>\n"; err != nil || string(output) != expected {
+		t.Errorf("\nExpected[%#v]\nActual  [%#v] %v", expected, string(output), err)
+	}
+
+	cancel()
+	output, err = MarkdownContext(ctx, input)
+	if err != context.Canceled || output != nil {
+		t.Errorf("expected context.Canceled and no output, got %v and %q", err, output)
+	}
+
+	var w bytes.Buffer
+	if err := RenderContext(ctx, &w, bytes.NewReader(input)); err != context.Canceled {
+		t.Errorf("expected context.Canceled from RenderContext, got %v", err)
+	}
+}
+
+func TestRendererReuse(t *testing.T) {
+	input := []byte("# Intro\n\ntext\n\n## Details\n")
+	renderer := HtmlRenderer(HTML_TOC, "", "")
+	opts := []Option{WithRenderer(renderer), WithExtensions(EXTENSION_AUTO_HEADER_IDS)}
+
+	expected := string(Markdown(input, opts...))
+	if !strings.Contains(expected, `id="intro"`) {
+		t.Fatalf("expected a header id, got %q", expected)
+	}
+
+	// the ids of the first document don't leak into the second
+	if actual := string(Markdown(input, opts...)); actual != expected {
+		t.Errorf("\nExpected[%#v]\nActual  [%#v]", expected, actual)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if actual := string(Markdown(input, opts...)); actual != expected {
+					t.Errorf("\nExpected[%#v]\nActual  [%#v]", expected, actual)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// A renderer that only embeds Html has to fail: it can't get a fresh copy of
+// itself for each document, and would share the state of the embedded one.
+func TestEmbeddedHtmlWithoutNewDocument(t *testing.T) {
+	html := NewHtml(HTML_TOC, "", "", HtmlRendererParameters{})
+	opts := []Option{WithRenderer(externalLinks{html}), WithExtensions(EXTENSION_AUTO_HEADER_IDS)}
+	input := []byte("# Intro\n\n[there](http://example.com/)\n")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				out, err := MarkdownE(input, opts...)
+				if _, ok := err.(*RendererError); !ok || out != nil {
+					t.Errorf("expected a *RendererError and no output, got %v and %q", err, out)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if out := Markdown(input, opts...); out != nil {
+		t.Errorf("expected no output, got %q", out)
+	}
+}
+
+func TestHtmlReset(t *testing.T) {
+	r := HtmlRenderer(0, "", "").(*Html)
+	header := func() string {
+		var out bytes.Buffer
+		r.Header(&out, func() bool { return true }, 1, "intro")
+		return out.String()
+	}
+
+	header()
+	if actual := header(); !strings.Contains(actual, `id="intro-1"`) {
+		t.Errorf("expected the second header to get a new id, got %q", actual)
+	}
+	r.Reset()
+	if actual := header(); !strings.Contains(actual, `id="intro"`) {
+		t.Errorf("expected the id to be free again after Reset, got %q", actual)
+	}
+}
+
+func TestRendererWriter(t *testing.T) {
+	r := HtmlRenderer(0, "", "")
+	paragraph := func(out Writer, ok bool) {
+		r.Paragraph(out, func() bool {
+			r.NormalText(out, []byte("a & b"))
+			return ok
+		})
+	}
+
+	// any writer will do
+	var sb strings.Builder
+	paragraph(&sb, true)
+	if expected := "<p>a &amp; b</p>\n"; sb.String() != expected {
+		t.Errorf("expected %q, got %q", expected, sb.String())
+	}
+
+	// one that keeps its output also gets it taken back
+	var buf bytes.Buffer
+	buf.WriteString("<hr>")
+	paragraph(&buf, false)
+	if expected := "<hr>"; buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+}
+
+// externalLinks is an Html renderer that marks the links leading elsewhere.
+type externalLinks struct {
+	*Html
+}
+
+func (r externalLinks) Link(out Writer, link, title, content []byte) {
+	r.Html.Link(out, link, title, content)
+	if !isRelativeLink(link) {
+		out.WriteString(" (external)")
+	}
+}
+
+// sharedExternalLinks can also be shared between goroutines.
+type sharedExternalLinks struct {
+	externalLinks
+}
+
+func (r sharedExternalLinks) NewDocument() Renderer {
+	return sharedExternalLinks{externalLinks{r.Html.NewDocument().(*Html)}}
+}
+
+func TestEmbeddedHtml(t *testing.T) {
+	input := []byte("# Intro\n\nSee [here](/a) and [there](http://example.com/) -- \"quoted\".\n\n# Intro\n")
+	expected := "<nav>\n<ul>\n" +
+		"<li><a href=\"#intro\">Intro</a></li>\n<li><a href=\"#intro-1\">Intro</a></li>\n" +
+		"</ul>\n</nav>\n\n" +
+		"<h1 id=\"intro\">Intro</h1>\n\n" +
+		"<p>See <a href=\"/a\">here</a> and <a href=\"http://example.com/\">there</a> (external) " +
+		"&ndash; &ldquo;quoted&rdquo;.</p>\n\n" +
+		"<h1 id=\"intro-1\">Intro</h1>\n"
+
+	html := NewHtml(HTML_TOC|HTML_USE_SMARTYPANTS|HTML_SMARTYPANTS_LATEX_DASHES, "", "", HtmlRendererParameters{})
+	renderer := sharedExternalLinks{externalLinks{html}}
+	opts := []Option{WithRenderer(renderer), WithExtensions(EXTENSION_AUTO_HEADER_IDS)}
+	for i := 0; i < 2; i++ {
+		if actual := string(Markdown(input, opts...)); actual != expected {
+			t.Errorf("\nExpected[%#v]\nActual  [%#v]", expected, actual)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if actual := string(Markdown(input, opts...)); actual != expected {
+					t.Errorf("\nExpected[%#v]\nActual  [%#v]", expected, actual)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestHtmlHooks(t *testing.T) {
+	input := []byte("# Intro\n\nSee [here](/a) and [there](http://example.com/) -- \"quoted\" `code`.\n\n# Intro\n")
+	expected := "<nav>\n<ul>\n" +
+		"<li><a href=\"#intro\">Intro</a></li>\n<li><a href=\"#intro-1\">Intro</a></li>\n" +
+		"</ul>\n</nav>\n\n" +
+		"<h1 id=\"intro\">Intro</h1>\n\n" +
+		"<p class=\"text\">See <a href=\"/a\">here</a> and <a href=\"http://example.com/\">there</a> (external) " +
+		"&ndash; &ldquo;quoted&rdquo; <kbd>code</kbd>.</p>\n\n" +
+		"<h1 id=\"intro-1\">Intro</h1>\n"
+
+	params := HtmlRendererParameters{
+		Hooks: map[NodeType]NodeHook{
+			Link: func(out Writer, node *Node, contents, render func()) {
+				render()
+				if !isRelativeLink(node.Destination) {
+					out.WriteString(" (external)")
+				}
+			},
+			Paragraph: func(out Writer, node *Node, contents, render func()) {
+				out.WriteString("\n<p class=\"text\">")
+				contents()
+				out.WriteString("</p>\n")
+			},
+			CodeSpan: func(out Writer, node *Node, contents, render func()) {
+				out.WriteString("<kbd>")
+				out.Write(node.Literal)
+				out.WriteString("</kbd>")
+			},
+		},
+	}
+	renderer := HtmlRendererWithParameters(HTML_TOC|HTML_USE_SMARTYPANTS|HTML_SMARTYPANTS_LATEX_DASHES, "", "", params)
+	opts := []Option{WithRenderer(renderer), WithExtensions(EXTENSION_AUTO_HEADER_IDS)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if actual := string(Markdown(input, opts...)); actual != expected {
+					t.Errorf("\nExpected[%#v]\nActual  [%#v]", expected, actual)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,387 @@
+//
+// Blackfriday Markdown Processor
+// Available at http://github.com/russross/blackfriday
+//
+// Copyright © 2011 Russ Ross <russ@russross.com>.
+// Distributed under the Simplified BSD License.
+// See README.md for details.
+//
+
+//
+//
+// Parsed document tree
+//
+//
+
+package blackfriday
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// NodeType specifies a type of a single node of a syntax tree. Usually one
+// node (and its type) corresponds to a single markdown feature, e.g. emphasis
+// or code block.
+type NodeType int
+
+// These are the possible node types. The block-level types came first,
+// followed by the span-level ones; types added since go at the end, so that
+// the values of the others stay the same.
+const (
+	Document NodeType = iota
+	TitleBlock
+	BlockQuote
+	HtmlBlock
+	Header
+	HorizontalRule
+	CodeBlock
+	List
+	Item
+	Paragraph
+	Table
+	TableHead
+	TableBody
+	TableRow
+	TableCell
+	Footnotes
+
+	Text
+	Emphasis
+	DoubleEmphasis
+	TripleEmphasis
+	StrikeThrough
+	CodeSpan
+	LineBreak
+	Link
+	Image
+	AutoLink
+	HtmlSpan
+	FootnoteRef
+	Entity
+	CustomSpan
+	CustomBlock
+	Abbreviation
+	MathBlock
+	MathSpan
+)
+
+var nodeTypeNames = []string{
+	Document:       "Document",
+	TitleBlock:     "TitleBlock",
+	BlockQuote:     "BlockQuote",
+	HtmlBlock:      "HtmlBlock",
+	Header:         "Header",
+	HorizontalRule: "HorizontalRule",
+	CodeBlock:      "CodeBlock",
+	List:           "List",
+	Item:           "Item",
+	Paragraph:      "Paragraph",
+	Table:          "Table",
+	TableHead:      "TableHead",
+	TableBody:      "TableBody",
+	TableRow:       "TableRow",
+	TableCell:      "TableCell",
+	Footnotes:      "Footnotes",
+
+	Text:           "Text",
+	Emphasis:       "Emphasis",
+	DoubleEmphasis: "DoubleEmphasis",
+	TripleEmphasis: "TripleEmphasis",
+	StrikeThrough:  "StrikeThrough",
+	CodeSpan:       "CodeSpan",
+	LineBreak:      "LineBreak",
+	Link:           "Link",
+	Image:          "Image",
+	AutoLink:       "AutoLink",
+	HtmlSpan:       "HtmlSpan",
+	FootnoteRef:    "FootnoteRef",
+	Entity:         "Entity",
+	CustomSpan:     "CustomSpan",
+	CustomBlock:    "CustomBlock",
+	Abbreviation:   "Abbreviation",
+	MathBlock:      "MathBlock",
+	MathSpan:       "MathSpan",
+}
+
+func (t NodeType) String() string {
+	if t >= 0 && int(t) < len(nodeTypeNames) {
+		return nodeTypeNames[t]
+	}
+	return fmt.Sprintf("NodeType(%d)", int(t))
+}
+
+// HeaderData contains fields relevant to a Header node type.
+type HeaderData struct {
+	Level    int    // This holds the heading level number
+	HeaderID string // This might hold header ID, if present
+}
+
+// ListData contains fields relevant to List and Item node types.
+type ListData struct {
+	ListFlags int    // LIST_* flags as passed to the List and ListItem renderers
+	RefLink   []byte // If this is a footnote item, this holds the note name
+	ListStart int    // The number the first item of a list with the LIST_START flag has
+}
+
+// CodeBlockData contains fields relevant to a CodeBlock node type.
+type CodeBlockData struct {
+	Lang string // The language given after the opening fence, if any
+}
+
+// LinkData contains fields relevant to Link, Image, AutoLink and FootnoteRef
+// node types. The Title of an Abbreviation is what it stands for.
+type LinkData struct {
+	Destination  []byte // Destination is what goes into a href
+	Title        []byte // Title is the tooltip thing that goes in a title attribute
+	LinkType     int    // LINK_TYPE_* value of an AutoLink
+	NoteID       int    // NoteID contains a serial number of a footnote, zero if it's not a footnote
+	IsInlineNote bool   // This tells if a FootnoteRef is to a note written in the text, ^[like this]
+}
+
+// MathData contains fields relevant to a MathSpan node type.
+type MathData struct {
+	IsDisplay bool // This tells if the math was between $$, which makes it display math
+}
+
+// TableData contains fields relevant to Table and TableCell node types.
+type TableData struct {
+	Columns  []int // TABLE_ALIGNMENT_* flags for each column of a Table
+	Align    int   // TABLE_ALIGNMENT_* flags of a TableCell
+	IsHeader bool  // This tells if the TableCell is in the header row
+}
+
+// CustomData contains fields relevant to CustomBlock and CustomSpan nodes,
+// which are made by the parsers added with WithBlockParser and
+// WithInlineParser.
+type CustomData struct {
+	// Render renders the node, usually by calling methods of the renderer.
+	// It gets the rendered children of the node as 'text'. If Render is
+	// nil, the children are rendered as they are.
+	Render func(r Renderer, out Writer, text []byte)
+
+	Value interface{} // Anything the parser wants to keep for rendering
+}
+
+// Node is a single element in the abstract syntax tree of the parsed document.
+// It holds connections to the structurally neighboring nodes and, for certain
+// types of nodes, additional information that might be needed when rendering.
+type Node struct {
+	Type       NodeType // Determines the type of the node
+	Parent     *Node    // Points to the parent
+	FirstChild *Node    // Points to the first child, if any
+	LastChild  *Node    // Points to the last child, if any
+	Prev       *Node    // Previous sibling; nil if it's the first child
+	Next       *Node    // Next sibling; nil if it's the last child
+
+	// Literal contains the raw contents of leaf nodes: the text of Text,
+	// CodeSpan and CodeBlock nodes, the TeX of MathSpan and MathBlock nodes,
+	// the markup of HtmlBlock, HtmlSpan and
+	// Entity nodes, the alt text of Image nodes, the abbreviation of an
+	// Abbreviation and the lines of a TitleBlock.
+	Literal []byte
+
+	HeaderData    // Populated if Type is Header
+	ListData      // Populated if Type is List or Item
+	CodeBlockData // Populated if Type is CodeBlock
+	LinkData      // Populated if Type is Link, Image, AutoLink, FootnoteRef or Abbreviation
+	TableData     // Populated if Type is Table or TableCell
+	MathData      // Populated if Type is MathSpan
+	CustomData    // Populated if Type is CustomBlock or CustomSpan
+
+	Start Position // Where the element starts in the original input
+	End   Position // Just past the last byte of the element in the original input
+
+	source []byte // The slice of the working buffer the node was parsed from
+}
+
+// NewNode allocates a node of a specified type.
+func NewNode(typ NodeType) *Node {
+	return &Node{
+		Type: typ,
+	}
+}
+
+func (n *Node) String() string {
+	ellipsis := ""
+	snippet := n.Literal
+	if len(snippet) > 16 {
+		snippet = snippet[:16]
+		ellipsis = "..."
+	}
+	return fmt.Sprintf("%s: '%s%s'", n.Type, snippet, ellipsis)
+}
+
+// Unlink removes node 'n' from the tree.
+// It panics if the node is nil.
+func (n *Node) Unlink() {
+	if n.Prev != nil {
+		n.Prev.Next = n.Next
+	} else if n.Parent != nil {
+		n.Parent.FirstChild = n.Next
+	}
+	if n.Next != nil {
+		n.Next.Prev = n.Prev
+	} else if n.Parent != nil {
+		n.Parent.LastChild = n.Prev
+	}
+	n.Parent = nil
+	n.Next = nil
+	n.Prev = nil
+}
+
+// AppendChild adds a node 'child' as a child of 'n'.
+// It panics if either node is nil.
+func (n *Node) AppendChild(child *Node) {
+	child.Unlink()
+	child.Parent = n
+	if n.LastChild != nil {
+		n.LastChild.Next = child
+		child.Prev = n.LastChild
+		n.LastChild = child
+	} else {
+		n.FirstChild = child
+		n.LastChild = child
+	}
+}
+
+// InsertBefore inserts 'sibling' immediately before 'n'.
+// It panics if either node is nil.
+func (n *Node) InsertBefore(sibling *Node) {
+	sibling.Unlink()
+	sibling.Prev = n.Prev
+	if sibling.Prev != nil {
+		sibling.Prev.Next = sibling
+	}
+	sibling.Next = n
+	n.Prev = sibling
+	sibling.Parent = n.Parent
+	if sibling.Prev == nil && sibling.Parent != nil {
+		sibling.Parent.FirstChild = sibling
+	}
+}
+
+// IsContainer returns true if 'n' can contain children.
+func (n *Node) IsContainer() bool {
+	switch n.Type {
+	case Document, BlockQuote, Header, List, Item, Paragraph, Table,
+		TableHead, TableBody, TableRow, TableCell, Footnotes, CustomBlock,
+		Emphasis, DoubleEmphasis, TripleEmphasis, StrikeThrough, Link,
+		CustomSpan:
+		return true
+	default:
+		return false
+	}
+}
+
+// add creates a node of the given type, appends it to 'n' and returns it.
+func (n *Node) add(typ NodeType) *Node {
+	child := NewNode(typ)
+	n.AppendChild(child)
+	return child
+}
+
+// addText appends a Text node holding 'text', unless it is empty.
+func (n *Node) addText(text []byte) {
+	if len(text) == 0 {
+		return
+	}
+	child := n.add(Text)
+	child.Literal = text
+	child.source = text
+}
+
+// trimSource drops 'k' bytes from the end of the source of a node.
+func (n *Node) trimSource(k int) {
+	if k <= len(n.source) {
+		n.source = n.source[:len(n.source)-k]
+	}
+}
+
+// trimTrailingText removes 'suffix' from the end of the text run that closes
+// the children of 'n', dropping Text nodes that end up empty. It reports
+// whether the suffix was found.
+func (n *Node) trimTrailingText(suffix []byte) bool {
+	last := n.LastChild
+	if last == nil || last.Type != Text || !bytes.HasSuffix(last.Literal, suffix) {
+		return false
+	}
+	last.Literal = last.Literal[:len(last.Literal)-len(suffix)]
+	last.trimSource(len(suffix))
+	if len(last.Literal) == 0 {
+		last.Unlink()
+	}
+	return true
+}
+
+// trimTrailingSpace removes spaces from the end of the text run that closes
+// the children of 'n', dropping Text nodes that end up empty.
+func (n *Node) trimTrailingSpace() {
+	for last := n.LastChild; last != nil && last.Type == Text; last = n.LastChild {
+		trimmed := bytes.TrimRight(last.Literal, " \t")
+		last.trimSource(len(last.Literal) - len(trimmed))
+		last.Literal = trimmed
+		if len(last.Literal) > 0 {
+			return
+		}
+		last.Unlink()
+	}
+}
+
+// WalkStatus allows a NodeVisitor to have some control over the tree
+// traversal. It is returned from NodeVisitor and different values allow
+// Walk to skip parts of the tree or stop altogether.
+type WalkStatus int
+
+const (
+	// GoToNext is the default traversal of every node.
+	GoToNext WalkStatus = iota
+	// SkipChildren tells the walker to skip all children of the current
+	// node. The node is still visited on exit.
+	SkipChildren
+	// Terminate tells the walker to stop the traversal altogether.
+	Terminate
+)
+
+// NodeVisitor is a callback to be called when traversing the syntax tree.
+// It is called twice for every node that can have children: once with
+// entering=true before the children are visited, and once with
+// entering=false after. Leaf nodes are only visited with entering=true.
+type NodeVisitor func(node *Node, entering bool) WalkStatus
+
+// Walk traverses the tree rooted at 'root' in document order, calling the
+// visitor for every node it enters and leaves.
+//
+// The visitor may modify the node it is given and anything below it, but
+// it should not touch the siblings or the ancestors of that node.
+func Walk(root *Node, visitor NodeVisitor) {
+	if root == nil {
+		return
+	}
+	node, entering := root, true
+	for {
+		status := visitor(node, entering)
+		switch {
+		case status == Terminate:
+			return
+		case status == SkipChildren && entering && node.IsContainer():
+			entering = false
+			continue
+		}
+
+		switch {
+		case entering && node.IsContainer():
+			if node.FirstChild != nil {
+				node = node.FirstChild
+			} else {
+				entering = false
+			}
+		case node == root:
+			return
+		case node.Next != nil:
+			node, entering = node.Next, true
+		default:
+			node, entering = node.Parent, false
+		}
+	}
+}
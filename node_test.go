@@ -0,0 +1,374 @@
+//
+// Blackfriday Markdown Processor
+// Available at http://github.com/russross/blackfriday
+//
+// Copyright © 2011 Russ Ross <russ@russross.com>.
+// Distributed under the Simplified BSD License.
+// See README.md for details.
+//
+
+//
+// Unit tests for the parsed document tree
+//
+
+package blackfriday
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// dumpTree prints the tree in a compact, indented form: one node per line,
+// with the literal of leaf nodes in quotes.
+func dumpTree(out *bytes.Buffer, node *Node, depth int) {
+	for i := 0; i < depth; i++ {
+		out.WriteString("  ")
+	}
+	out.WriteString(node.Type.String())
+	if len(node.Literal) > 0 {
+		fmt.Fprintf(out, " %q", node.Literal)
+	}
+	out.WriteByte('\n')
+	for c := node.FirstChild; c != nil; c = c.Next {
+		dumpTree(out, c, depth+1)
+	}
+}
+
+func doTestsParse(t *testing.T, tests []string, extensions Extensions) {
+	for i := 0; i+1 < len(tests); i += 2 {
+		input := tests[i]
+		expected := tests[i+1]
+		var out bytes.Buffer
+		dumpTree(&out, Parse([]byte(input), WithExtensions(extensions)), 0)
+		if actual := out.String(); actual != expected {
+			t.Errorf("\nInput   [%#v]\nExpected[%#v]\nActual  [%#v]",
+				input, expected, actual)
+		}
+	}
+}
+
+func TestParseTree(t *testing.T) {
+	var tests = []string{
+		"# Title\n\nSome *emphasis* and a [link](/url).\n",
+		"Document\n" +
+			"  Header\n" +
+			"    Text \"Title\"\n" +
+			"  Paragraph\n" +
+			"    Text \"Some \"\n" +
+			"    Emphasis\n" +
+			"      Text \"emphasis\"\n" +
+			"    Text \" and a \"\n" +
+			"    Link\n" +
+			"      Text \"link\"\n" +
+			"    Text \".\"\n",
+
+		"* one\n* two\n\n> quoted `code`\n",
+		"Document\n" +
+			"  List\n" +
+			"    Item\n" +
+			"      Text \"one\"\n" +
+			"      Text \"\\n\"\n" +
+			"    Item\n" +
+			"      Text \"two\"\n" +
+			"      Text \"\\n\"\n" +
+			"  BlockQuote\n" +
+			"    Paragraph\n" +
+			"      Text \"quoted \"\n" +
+			"      CodeSpan \"code\"\n",
+
+		"a | b\n---|---\n1 | 2\n",
+		"Document\n" +
+			"  Table\n" +
+			"    TableHead\n" +
+			"      TableRow\n" +
+			"        TableCell\n" +
+			"          Text \"a\"\n" +
+			"        TableCell\n" +
+			"          Text \"b\"\n" +
+			"    TableBody\n" +
+			"      TableRow\n" +
+			"        TableCell\n" +
+			"          Text \"1\"\n" +
+			"        TableCell\n" +
+			"          Text \"2\"\n",
+
+		"![alt](/img.png) text\n",
+		"Document\n" +
+			"  Paragraph\n" +
+			"    Image \"alt\"\n" +
+			"    Text \" text\"\n",
+	}
+	doTestsParse(t, tests, EXTENSION_TABLES)
+}
+
+func TestParseFootnotes(t *testing.T) {
+	var tests = []string{
+		"text[^a]\n\n[^a]: the note\n",
+		"Document\n" +
+			"  Paragraph\n" +
+			"    Text \"text\"\n" +
+			"    FootnoteRef\n" +
+			"  Footnotes\n" +
+			"    Item\n" +
+			"      Text \"the note\"\n" +
+			"      Text \"\\n\"\n",
+	}
+	doTestsParse(t, tests, EXTENSION_FOOTNOTES)
+}
+
+func TestParseNodeData(t *testing.T) {
+	doc := Parse([]byte("## Sub {#sub-id}\n\n```go\nx := 1\n```\n"),
+		WithExtensions(EXTENSION_HEADER_IDS|EXTENSION_FENCED_CODE))
+
+	header := doc.FirstChild
+	if header.Type != Header || header.Level != 2 || header.HeaderID != "sub-id" {
+		t.Errorf("unexpected header node: %s level %d id %q",
+			header.Type, header.Level, header.HeaderID)
+	}
+
+	code := header.Next
+	if code.Type != CodeBlock || code.Lang != "go" || string(code.Literal) != "x := 1\n" {
+		t.Errorf("unexpected code block node: %s lang %q literal %q",
+			code.Type, code.Lang, code.Literal)
+	}
+	if code.Parent != doc || doc.LastChild != code {
+		t.Errorf("code block is not linked as the last child of the document")
+	}
+}
+
+func TestParseTaskList(t *testing.T) {
+	doc := Parse([]byte("* [ ] one\n* [x] two\n    * [ ] three\n* four\n"),
+		WithExtensions(EXTENSION_TASK_LISTS))
+
+	open, done := 0, 0
+	Walk(doc, func(node *Node, entering bool) WalkStatus {
+		switch {
+		case !entering || node.Type != Item || node.ListFlags&LIST_ITEM_TASK == 0:
+		case node.ListFlags&LIST_ITEM_CHECKED != 0:
+			done++
+		default:
+			open++
+		}
+		return GoToNext
+	})
+	if open != 2 || done != 1 {
+		t.Errorf("expected 2 open tasks and 1 done, got %d and %d", open, done)
+	}
+}
+
+func TestWalkOrder(t *testing.T) {
+	doc := Parse([]byte("# A *b*\n\ntext\n"))
+
+	var events []string
+	Walk(doc, func(node *Node, entering bool) WalkStatus {
+		if entering {
+			events = append(events, "+"+node.Type.String())
+		} else {
+			events = append(events, "-"+node.Type.String())
+		}
+		return GoToNext
+	})
+
+	expected := "+Document +Header +Text +Emphasis +Text -Emphasis -Header " +
+		"+Paragraph +Text -Paragraph -Document"
+	if actual := fmt.Sprint(events); actual != "["+expected+"]" {
+		t.Errorf("\nExpected[%s]\nActual  %s", expected, actual)
+	}
+}
+
+func TestWalkSkipChildren(t *testing.T) {
+	doc := Parse([]byte("# Title *emph*\n\n* item *emph*\n"))
+
+	var seen []string
+	Walk(doc, func(node *Node, entering bool) WalkStatus {
+		if entering && node.Type == Emphasis {
+			seen = append(seen, node.Parent.Type.String())
+		}
+		if entering && node.Type == List {
+			return SkipChildren
+		}
+		return GoToNext
+	})
+
+	if len(seen) != 1 || seen[0] != "Header" {
+		t.Errorf("expected to see only the emphasis in the header, saw %v", seen)
+	}
+}
+
+func TestWalkTerminate(t *testing.T) {
+	doc := Parse([]byte("[one](/1) and [two](/2)\n"))
+
+	var links []string
+	Walk(doc, func(node *Node, entering bool) WalkStatus {
+		if node.Type == Link {
+			links = append(links, string(node.Destination))
+			return Terminate
+		}
+		return GoToNext
+	})
+
+	if len(links) != 1 || links[0] != "/1" {
+		t.Errorf("expected the walk to stop at the first link, got %v", links)
+	}
+}
+
+func TestRenderModifiedTree(t *testing.T) {
+	doc := Parse([]byte("# Title\n\nsome text\n"))
+
+	// demote all headers
+	Walk(doc, func(node *Node, entering bool) WalkStatus {
+		if entering && node.Type == Header {
+			node.Level++
+		}
+		return GoToNext
+	})
+
+	expected := "<h2>Title</h2>\n\n<p>some text</p>\n"
+	actual := string(RenderTree(doc, HtmlRenderer(0, "", "")))
+	if actual != expected {
+		t.Errorf("\nExpected[%#v]\nActual  [%#v]", expected, actual)
+	}
+}
+
+func doTestsPositions(t *testing.T, tests []string, extensions Extensions) {
+	for i := 0; i+1 < len(tests); i += 2 {
+		input := tests[i]
+		expected := tests[i+1]
+		var out bytes.Buffer
+		Walk(Parse([]byte(input), WithExtensions(extensions)), func(node *Node, entering bool) WalkStatus {
+			if entering {
+				fmt.Fprintf(&out, "%s %d:%d-%d:%d %q\n", node.Type,
+					node.Start.Line, node.Start.Column, node.End.Line, node.End.Column,
+					input[node.Start.Offset:node.End.Offset])
+			}
+			return GoToNext
+		})
+		if actual := out.String(); actual != expected {
+			t.Errorf("\nInput   [%#v]\nExpected[%#v]\nActual  [%#v]",
+				input, expected, actual)
+		}
+	}
+}
+
+func TestSourcePositions(t *testing.T) {
+	var tests = []string{
+		"# Title\r\n\r\n[ref]: /url\r\nSome *emph* and [a][ref].\r\n",
+		"Document 1:1-5:1 \"# Title\\r\\n\\r\\n[ref]: /url\\r\\nSome *emph* and [a][ref].\\r\\n\"\n" +
+			"Header 1:1-1:8 \"# Title\"\n" +
+			"Text 1:3-1:8 \"Title\"\n" +
+			"Paragraph 4:1-4:26 \"Some *emph* and [a][ref].\"\n" +
+			"Text 4:1-4:6 \"Some \"\n" +
+			"Emphasis 4:6-4:12 \"*emph*\"\n" +
+			"Text 4:7-4:11 \"emph\"\n" +
+			"Text 4:12-4:17 \" and \"\n" +
+			"Link 4:17-4:25 \"[a][ref]\"\n" +
+			"Text 4:18-4:19 \"a\"\n" +
+			"Text 4:25-4:26 \".\"\n",
+
+		"* one\n* two\n  more\n\n> quote\n> **x**\n",
+		"Document 1:1-7:1 \"* one\\n* two\\n  more\\n\\n> quote\\n> **x**\\n\"\n" +
+			"List 1:1-3:7 \"* one\\n* two\\n  more\"\n" +
+			"Item 1:1-1:6 \"* one\"\n" +
+			"Text 1:3-1:6 \"one\"\n" +
+			"Text 1:6-2:1 \"\\n\"\n" +
+			"Item 2:1-3:7 \"* two\\n  more\"\n" +
+			"Text 2:3-2:6 \"two\"\n" +
+			"Text 2:6-3:7 \"\\n  more\"\n" +
+			"Text 3:7-4:1 \"\\n\"\n" +
+			"BlockQuote 5:1-6:8 \"> quote\\n> **x**\"\n" +
+			"Paragraph 5:3-6:8 \"quote\\n> **x**\"\n" +
+			"Text 5:3-5:8 \"quote\"\n" +
+			"Text 5:8-6:1 \"\\n\"\n" +
+			"DoubleEmphasis 6:3-6:8 \"**x**\"\n" +
+			"Text 6:5-6:6 \"x\"\n",
+
+		"\tcode\n\nx\ty ![i](/i) http://a.com/\n\na | b\n---|---\n1 | 2\n",
+		"Document 1:1-8:1 \"\\tcode\\n\\nx\\ty ![i](/i) http://a.com/\\n\\na | b\\n---|---\\n1 | 2\\n\"\n" +
+			"CodeBlock 1:1-1:6 \"\\tcode\"\n" +
+			"Paragraph 3:1-3:27 \"x\\ty ![i](/i) http://a.com/\"\n" +
+			"Text 3:1-3:5 \"x\\ty \"\n" +
+			"Image 3:5-3:13 \"![i](/i)\"\n" +
+			"Text 3:13-3:14 \" \"\n" +
+			"AutoLink 3:14-3:27 \"http://a.com/\"\n" +
+			"Table 5:1-7:6 \"a | b\\n---|---\\n1 | 2\"\n" +
+			"TableHead 5:1-6:8 \"a | b\\n---|---\"\n" +
+			"TableRow 5:1-5:6 \"a | b\"\n" +
+			"TableCell 5:1-5:2 \"a\"\n" +
+			"Text 5:1-5:2 \"a\"\n" +
+			"TableCell 5:5-5:6 \"b\"\n" +
+			"Text 5:5-5:6 \"b\"\n" +
+			"TableBody 7:1-7:6 \"1 | 2\"\n" +
+			"TableRow 7:1-7:6 \"1 | 2\"\n" +
+			"TableCell 7:1-7:2 \"1\"\n" +
+			"Text 7:1-7:2 \"1\"\n" +
+			"TableCell 7:5-7:6 \"2\"\n" +
+			"Text 7:5-7:6 \"2\"\n",
+
+		"text[^a]\n\n[^a]: the note\n    more\n",
+		"Document 1:1-5:1 \"text[^a]\\n\\n[^a]: the note\\n    more\\n\"\n" +
+			"Paragraph 1:1-1:9 \"text[^a]\"\n" +
+			"Text 1:1-1:5 \"text\"\n" +
+			"FootnoteRef 1:5-1:9 \"[^a]\"\n" +
+			"Footnotes 3:7-4:9 \"the note\\n    more\"\n" +
+			"Item 3:7-4:9 \"the note\\n    more\"\n" +
+			"Paragraph 3:7-4:9 \"the note\\n    more\"\n" +
+			"Text 3:7-3:15 \"the note\"\n" +
+			"Text 3:15-4:9 \"\\n    more\"\n",
+
+		"text^[a *b*\nc] end\n",
+		"Document 1:1-3:1 \"text^[a *b*\\nc] end\\n\"\n" +
+			"Paragraph 1:1-2:7 \"text^[a *b*\\nc] end\"\n" +
+			"Text 1:1-1:5 \"text\"\n" +
+			"FootnoteRef 1:5-2:3 \"^[a *b*\\nc]\"\n" +
+			"Text 2:3-2:7 \" end\"\n" +
+			"Footnotes 1:7-2:2 \"a *b*\\nc\"\n" +
+			"Item 1:7-2:2 \"a *b*\\nc\"\n" +
+			"Text 1:7-1:9 \"a \"\n" +
+			"Emphasis 1:9-1:12 \"*b*\"\n" +
+			"Text 1:10-1:11 \"b\"\n" +
+			"Text 1:12-2:2 \"\\nc\"\n",
+
+		"Head\n====\n",
+		"Document 1:1-3:1 \"Head\\n====\\n\"\n" +
+			"Header 1:1-2:5 \"Head\\n====\"\n" +
+			"Text 1:1-1:5 \"Head\"\n",
+	}
+	doTestsPositions(t, tests, EXTENSION_TABLES|EXTENSION_FOOTNOTES|EXTENSION_AUTOLINK)
+}
+
+func TestAbbreviationPositions(t *testing.T) {
+	var tests = []string{
+		"*[W3C]: World Wide Web Consortium\n\nBy the W3C, not W3Cs.\n",
+		"Document 1:1-4:1 \"*[W3C]: World Wide Web Consortium\\n\\nBy the W3C, not W3Cs.\\n\"\n" +
+			"Paragraph 3:1-3:22 \"By the W3C, not W3Cs.\"\n" +
+			"Text 3:1-3:8 \"By the \"\n" +
+			"Abbreviation 3:8-3:11 \"W3C\"\n" +
+			"Text 3:11-3:22 \", not W3Cs.\"\n",
+
+		"*[A&B]: and\n\nx A&amp;B\n",
+		"Document 1:1-4:1 \"*[A&B]: and\\n\\nx A&amp;B\\n\"\n" +
+			"Paragraph 3:1-3:10 \"x A&amp;B\"\n" +
+			"Text 3:1-3:3 \"x \"\n" +
+			"Abbreviation 3:3-3:10 \"A&amp;B\"\n",
+	}
+	doTestsPositions(t, tests, EXTENSION_ABBREVIATIONS)
+}
+
+// The values of the node types are part of the API: types are only ever
+// added at the end.
+func TestNodeTypeValues(t *testing.T) {
+	types := []NodeType{
+		Document, TitleBlock, BlockQuote, HtmlBlock, Header, HorizontalRule,
+		CodeBlock, List, Item, Paragraph, Table, TableHead, TableBody, TableRow,
+		TableCell, Footnotes, Text, Emphasis, DoubleEmphasis, TripleEmphasis,
+		StrikeThrough, CodeSpan, LineBreak, Link, Image, AutoLink, HtmlSpan,
+		FootnoteRef, Entity, CustomSpan, CustomBlock, Abbreviation, MathBlock,
+		MathSpan,
+	}
+	for i, typ := range types {
+		if int(typ) != i {
+			t.Errorf("%v is %d, expected %d", typ, int(typ), i)
+		}
+	}
+}
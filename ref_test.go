@@ -8,23 +8,28 @@
 //
 
 //
-// Markdown 1.0.3 reference tests
+// Markdown 1.0.3 reference tests and the CommonMark spec
 //
 
 package blackfriday
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
 )
 
-func runMarkdownReference(input string, flag int) string {
+func runMarkdownReference(input string, flag Extensions) string {
 	renderer := HtmlRenderer(0, "", "")
-	return string(Markdown([]byte(input), renderer, flag))
+	return string(Markdown([]byte(input), WithRenderer(renderer), WithExtensions(flag)))
 }
 
-func doTestsReference(t *testing.T, files []string, flag int) {
+func doTestsReference(t *testing.T, files []string, flag Extensions) {
 	// catch and report panics
 	var candidate string
 	defer func() {
@@ -126,3 +131,191 @@ func TestReference_EXTENSION_NO_EMPTY_LINE_BEFORE_BLOCK(t *testing.T) {
 	}
 	doTestsReference(t, files, EXTENSION_NO_EMPTY_LINE_BEFORE_BLOCK)
 }
+
+// chunkWriter remembers every write separately and fails after a limit.
+type chunkWriter struct {
+	chunks []string
+	limit  int
+}
+
+func (w *chunkWriter) Write(data []byte) (int, error) {
+	if w.limit > 0 && len(w.chunks) >= w.limit {
+		return 0, errors.New("write limit reached")
+	}
+	w.chunks = append(w.chunks, string(data))
+	return len(data), nil
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestRenderStreaming(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.text"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no reference files found: %v", err)
+	}
+
+	for _, flags := range []HtmlFlags{0, HTML_TOC} {
+		for _, filename := range files {
+			input, err := ioutil.ReadFile(filename)
+			if err != nil {
+				t.Errorf("Couldn't open '%s', error: %v\n", filename, err)
+				continue
+			}
+			expected := string(Markdown(input,
+				WithRenderer(HtmlRenderer(flags, "", "")), WithExtensions(commonExtensions)))
+
+			var w chunkWriter
+			opts := Options{Renderer: HtmlRenderer(flags, "", ""), Extensions: commonExtensions}
+			if err := Render(&w, bytes.NewReader(input), WithOptions(opts)); err != nil {
+				t.Errorf("%s: unexpected error %v", filename, err)
+			}
+			if actual := strings.Join(w.chunks, ""); actual != expected {
+				t.Errorf("\n    [%#v]\nExpected[%#v]\nActual  [%#v]",
+					filename, expected, actual)
+			}
+			if flags&HTML_TOC != 0 && len(w.chunks) > 1 {
+				t.Errorf("%s: output with a table of contents was written in %d pieces",
+					filename, len(w.chunks))
+			}
+		}
+	}
+
+	// the syntax documentation has plenty of top-level blocks
+	input, _ := ioutil.ReadFile(filepath.Join("testdata", "Markdown Documentation - Syntax.text"))
+	var w chunkWriter
+	Render(&w, bytes.NewReader(input))
+	if len(w.chunks) < 10 {
+		t.Errorf("expected the output to be written block by block, got %d writes", len(w.chunks))
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	opts := WithRenderer(HtmlRenderer(0, "", ""))
+
+	if err := Render(&chunkWriter{}, errReader{}, opts); err == nil || err.Error() != "read failed" {
+		t.Errorf("expected the read error, got %v", err)
+	}
+
+	w := chunkWriter{limit: 2}
+	err := Render(&w, strings.NewReader("one\n\ntwo\n\nthree\n\nfour\n"), opts)
+	if err == nil || err.Error() != "write limit reached" {
+		t.Errorf("expected the write error, got %v", err)
+	}
+	if len(w.chunks) != 2 {
+		t.Errorf("expected rendering to stop at the first failed write, got %d writes", len(w.chunks))
+	}
+}
+
+// commonMarkExample is one entry of the CommonMark spec test suite.
+type commonMarkExample struct {
+	Markdown string `json:"markdown"`
+	HTML     string `json:"html"`
+	Example  int    `json:"example"`
+	Section  string `json:"section"`
+}
+
+var (
+	commonMarkSpace    = regexp.MustCompile(`\s+`)
+	commonMarkBlockTag = regexp.MustCompile(`\s*(</?(?:blockquote|h[1-6]|hr|li|ol|p|pre|ul)\b[^>]*>)\s*`)
+	commonMarkInnerTag = regexp.MustCompile(`\s+(</?(?:blockquote|h[1-6]|hr|li|ol|p|ul)\b[^>]*>)`)
+	commonMarkPre      = regexp.MustCompile(`(?s)<pre.*?</pre>`)
+)
+
+// normalizeCommonMark makes renderings comparable the way the spec's own
+// test runner does: runs of whitespace outside of <pre> are collapsed and
+// whitespace around block tags is dropped. Raw HTML can leave block tags
+// inside of a <pre>; whitespace before those is dropped as well.
+func normalizeCommonMark(html string) string {
+	var out bytes.Buffer
+	norm := func(s string) string {
+		s = commonMarkSpace.ReplaceAllString(s, " ")
+		return commonMarkBlockTag.ReplaceAllString(s, "$1")
+	}
+	last := 0
+	for _, loc := range commonMarkPre.FindAllStringIndex(html, -1) {
+		out.WriteString(norm(html[last:loc[0]]))
+		out.WriteString(html[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	out.WriteString(norm(html[last:]))
+	return strings.TrimSpace(commonMarkInnerTag.ReplaceAllString(out.String(), "$1"))
+}
+
+// commonMarkKnownFailures are the examples of the spec, by number, that
+// EXTENSION_COMMONMARK doesn't get right yet. They are still run, and one
+// that starts to pass has to be taken off the list.
+var commonMarkKnownFailures = map[int]bool{
+	// Backslash escapes: autolink destinations are not percent-encoded
+	20: true,
+
+	// Setext headings: lazy continuation lines can make a setext heading
+	93: true,
+
+	// Link reference definitions: escapes and line breaks in labels, titles
+	// and destinations
+	194: true, 195: true, 196: true, 199: true, 200: true, 201: true,
+	204: true, 208: true, 212: true, 213: true, 218: true,
+
+	// Code spans: autolink destinations are not percent-encoded
+	346: true,
+
+	// Links: autolink destinations are not percent-encoded, an image in a
+	// link is followed by a line break, labels are lowercased instead of
+	// case-folded, and the link reference definitions above
+	517: true, 526: true, 531: true, 538: true, 540: true, 541: true,
+	544: true, 546: true, 550: true, 551: true,
+
+	// Autolinks: destinations are not percent-encoded
+	603: true,
+}
+
+func TestCommonMarkSpec(t *testing.T) {
+	filename := filepath.Join("testdata", "CommonMark spec.json")
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Couldn't open '%s', error: %v\n", filename, err)
+	}
+	var examples []commonMarkExample
+	if err := json.Unmarshal(data, &examples); err != nil {
+		t.Fatalf("Couldn't decode '%s', error: %v\n", filename, err)
+	}
+
+	renderer := HtmlRenderer(HTML_USE_XHTML, "", "")
+	passed := 0
+	for _, ex := range examples {
+		output, err := MarkdownE([]byte(ex.Markdown),
+			WithRenderer(renderer), WithExtensions(EXTENSION_COMMONMARK))
+		if err != nil {
+			t.Errorf("%s, example %d: unexpected error %v", ex.Section, ex.Example, err)
+			continue
+		}
+		actual, expected := normalizeCommonMark(string(output)), normalizeCommonMark(ex.HTML)
+		switch {
+		case actual == expected && commonMarkKnownFailures[ex.Example]:
+			t.Errorf("%s, example %d: passes, take it off the known failures", ex.Section, ex.Example)
+		case actual == expected:
+			passed++
+		case !commonMarkKnownFailures[ex.Example]:
+			t.Errorf("%s, example %d:\n    [%#v]\nExpected[%#v]\nActual  [%#v]",
+				ex.Section, ex.Example, ex.Markdown, expected, actual)
+		}
+
+		// every prefix must parse without panicking, too
+		if !testing.Short() {
+			for end := 1; end < len(ex.Markdown); end++ {
+				_, err := MarkdownE([]byte(ex.Markdown[:end]),
+					WithRenderer(renderer), WithExtensions(EXTENSION_COMMONMARK))
+				if err != nil {
+					t.Errorf("%s, example %d: error %v on prefix [%#v]",
+						ex.Section, ex.Example, err, ex.Markdown[:end])
+				}
+			}
+		}
+	}
+	t.Logf("%d of %d examples pass, %d are known failures",
+		passed, len(examples), len(commonMarkKnownFailures))
+}
@@ -0,0 +1,290 @@
+//
+// Blackfriday Markdown Processor
+// Available at http://github.com/russross/blackfriday
+//
+// Copyright © 2011 Russ Ross <russ@russross.com>.
+// Distributed under the Simplified BSD License.
+// See README.md for details.
+//
+
+//
+//
+// Source positions
+//
+//
+
+package blackfriday
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Position is a location in the original input, as it was passed to Parse,
+// before tabs were expanded, newlines normalized and references removed.
+type Position struct {
+	Offset int `json:"offset"` // byte offset, starting at 0
+	Line   int `json:"line"`   // line number, starting at 1
+	Column int `json:"column"` // byte offset within the line, starting at 1
+}
+
+// The parser never works on the input directly: the first pass builds a
+// cleaned up copy of it, and block quotes, list items and footnotes are
+// parsed from buffers that have their prefixes stripped. Every such working
+// buffer gets a source map that knows where its bytes came from.
+//
+// Nodes remember the slice of a working buffer they were parsed from. Once
+// the whole document is parsed, those slices are translated into positions
+// in the original input.
+
+// A sourceRun maps a stretch of a working buffer to the input.
+type sourceRun struct {
+	at   int  // offset of the run in the working buffer
+	orig int  // offset in the input the run was copied from
+	n    int  // length of the run
+	fill bool // all bytes of the run stand for the single input byte at orig
+}
+
+// A sourceMap maps a whole working buffer to the input.
+type sourceMap struct {
+	size int // capacity of the working buffer
+	runs []sourceRun
+}
+
+// translate maps an offset in the working buffer to an offset in the input.
+func (m *sourceMap) translate(at int) int {
+	if len(m.runs) == 0 {
+		return 0
+	}
+	i := sort.Search(len(m.runs), func(i int) bool { return m.runs[i].at > at }) - 1
+	if i < 0 {
+		i = 0
+	}
+	run := m.runs[i]
+	switch {
+	case run.fill:
+		return run.orig
+	case at > run.at+run.n:
+		return run.orig + run.n
+	default:
+		return run.orig + at - run.at
+	}
+}
+
+// sources keeps the source maps of all the working buffers of a parser.
+// Buffers are told apart by the address of the last byte of their backing
+// array, which every slice of a buffer can reach.
+type sources map[*byte]*sourceMap
+
+func sourceKey(data []byte) *byte {
+	if cap(data) == 0 {
+		return nil
+	}
+	return &data[:cap(data)][cap(data)-1]
+}
+
+// register records the source map of a finished working buffer.
+func (s sources) register(buf []byte, runs []sourceRun) {
+	if key := sourceKey(buf); key != nil {
+		s[key] = &sourceMap{size: cap(buf), runs: runs}
+	}
+}
+
+// unregister forgets the source map of a buffer.
+func (s sources) unregister(buf []byte) {
+	delete(s, sourceKey(buf))
+}
+
+// locate finds the source map of the buffer 'data' is a slice of, and the
+// offset of 'data' in that buffer.
+func (s sources) locate(data []byte) (*sourceMap, int) {
+	m := s[sourceKey(data)]
+	if m == nil {
+		return nil, 0
+	}
+	return m, m.size - cap(data)
+}
+
+// span translates the slice 'data' of a working buffer to a range of offsets
+// in the input. It reports false if 'data' is not part of a known buffer.
+func (s sources) span(data []byte) (start, end int, ok bool) {
+	m, at := s.locate(data)
+	if m == nil {
+		return 0, 0, false
+	}
+	start = m.translate(at)
+	end = start
+	if len(data) > 0 {
+		end = m.translate(at+len(data)-1) + 1
+	}
+	return start, end, true
+}
+
+// joinSource returns the slice of a working buffer from the start of 'a' to
+// the end of 'b', which come after it in the same buffer. If they don't, it
+// returns 'a'.
+func joinSource(a, b []byte) []byte {
+	if sourceKey(a) == nil || sourceKey(a) != sourceKey(b) {
+		return a
+	}
+	end := cap(a) - cap(b) + len(b)
+	if end < len(a) {
+		return a
+	}
+	return a[:end]
+}
+
+// sourceBuffer builds a working buffer out of pieces of other buffers,
+// keeping track of where each piece came from.
+type sourceBuffer struct {
+	bytes.Buffer
+	src  sources
+	runs []sourceRun
+}
+
+func (b *sourceBuffer) addRun(run sourceRun) {
+	if run.n == 0 {
+		return
+	}
+	if k := len(b.runs) - 1; k >= 0 && !run.fill {
+		last := &b.runs[k]
+		if !last.fill && last.at+last.n == run.at && last.orig+last.n == run.orig {
+			last.n += run.n
+			return
+		}
+	}
+	b.runs = append(b.runs, run)
+}
+
+// copy writes 'data', which must be a slice of a registered buffer.
+func (b *sourceBuffer) copy(data []byte) {
+	at := b.Len()
+	b.Write(data)
+
+	m, from := b.src.locate(data)
+	if m == nil {
+		return
+	}
+	to := from + len(data)
+	i := sort.Search(len(m.runs), func(i int) bool { return m.runs[i].at+m.runs[i].n > from })
+	for ; i < len(m.runs) && m.runs[i].at < to; i++ {
+		run := m.runs[i]
+		lo, hi := run.at, run.at+run.n
+		if lo < from {
+			lo = from
+		}
+		if hi > to {
+			hi = to
+		}
+		orig := run.orig
+		if !run.fill {
+			orig += lo - run.at
+		}
+		b.addRun(sourceRun{at: at + lo - from, orig: orig, n: hi - lo, fill: run.fill})
+	}
+}
+
+// fill writes 'n' copies of 'c', all of which stand for the first byte of
+// 'at', a slice of a registered buffer. This is used for expanded tabs and
+// inserted newlines.
+func (b *sourceBuffer) fill(c byte, n int, at []byte) {
+	start := b.Len()
+	for i := 0; i < n; i++ {
+		b.WriteByte(c)
+	}
+	if _, _, ok := b.src.span(at); ok {
+		orig, _, _ := b.src.span(at[:0])
+		b.addRun(sourceRun{at: start, orig: orig, n: n, fill: true})
+	}
+}
+
+// finish registers the buffer and returns its contents.
+func (b *sourceBuffer) finish() []byte {
+	data := b.Bytes()
+	b.src.register(data, b.runs)
+	return data
+}
+
+// setSource records 'data' as the source of the nodes that were appended to
+// 'out' after 'last' and do not know their source yet.
+func setSource(out, last *Node, data []byte) {
+	for n := out.LastChild; n != nil && n != last && n.source == nil; n = n.Prev {
+		n.source = data
+	}
+}
+
+// lineIndex converts input offsets to line and column numbers.
+type lineIndex []int
+
+func newLineIndex(input []byte) lineIndex {
+	lines := lineIndex{0}
+	for i := 0; i < len(input); i++ {
+		switch {
+		case input[i] == '\n':
+			lines = append(lines, i+1)
+		case input[i] == '\r' && (i+1 >= len(input) || input[i+1] != '\n'):
+			lines = append(lines, i+1)
+		}
+	}
+	return lines
+}
+
+func (lines lineIndex) position(offset int) Position {
+	line := sort.Search(len(lines), func(i int) bool { return lines[i] > offset }) - 1
+	return Position{
+		Offset: offset,
+		Line:   line + 1,
+		Column: offset - lines[line] + 1,
+	}
+}
+
+// position returns where in the input 'data', a slice of a working buffer,
+// starts.
+func (p *parser) position(data []byte) Position {
+	start, _, _ := p.sources.span(data)
+	return p.lines.position(start)
+}
+
+// isBlock tells if the node is a block-level element.
+func (n *Node) isBlock() bool {
+	return n.Type < Text || n.Type == CustomBlock || n.Type == MathBlock
+}
+
+// resolvePositions fills in the Start and End of every node in the tree.
+// Nodes that have no source of their own span their children.
+func (p *parser) resolvePositions(doc *Node) {
+	lines := p.lines
+	Walk(doc, func(node *Node, entering bool) WalkStatus {
+		if entering {
+			if node.source == nil {
+				return GoToNext
+			}
+			data := node.source
+			if node.isBlock() {
+				data = bytes.TrimRight(data, " \n")
+			}
+			if start, end, ok := p.sources.span(data); ok {
+				node.Start = lines.position(start)
+				node.End = lines.position(end)
+			}
+			node.source = nil
+			if node.IsContainer() {
+				// mark the node as done for the way out
+				node.source = data[:0]
+			}
+			return GoToNext
+		}
+
+		switch {
+		case node.source != nil:
+			node.source = nil
+		case node == doc:
+			node.Start = lines.position(0)
+			node.End = lines.position(p.inputSize)
+		case node.FirstChild != nil:
+			node.Start = node.FirstChild.Start
+			node.End = node.LastChild.End
+		}
+		return GoToNext
+	})
+}
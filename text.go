@@ -0,0 +1,506 @@
+//
+// Blackfriday Markdown Processor
+// Available at http://github.com/russross/blackfriday
+//
+// Copyright © 2011 Russ Ross <russ@russross.com>.
+// Distributed under the Simplified BSD License.
+// See README.md for details.
+//
+
+//
+//
+// Plain text rendering backend
+//
+//
+
+package blackfriday
+
+import (
+	"bytes"
+	"html"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// PlainText is a type that implements the Renderer interface for plain text
+// output, for search excerpts, notifications and the like. Emphasis markers
+// and HTML are dropped, links are written as "text (url)", list items get
+// bullets, tables are laid out in aligned columns and code is kept as it is.
+//
+// Do not create this directly, instead use the TextRenderer function.
+type PlainText struct {
+	width int // the width to wrap text at, if positive
+
+	// what is left over from rendering the current document
+	*plainTextState
+}
+
+// plainTextState is what a PlainText keeps track of while it renders a
+// document.
+type plainTextState struct {
+	top   Writer          // where the top-level blocks go
+	lists []formatterList // the enclosing lists
+	notes int             // number of footnotes so far
+
+	// rows of the table being rendered, header rows first
+	rows    [][][]byte
+	cells   [][]byte
+	headers int
+}
+
+// TextRenderer creates and configures a PlainText object, which satisfies
+// the Renderer interface.
+//
+// width is the number of characters to wrap the lines of paragraphs at, or 0
+// to write every paragraph on a single line. Code blocks and tables are
+// never wrapped.
+func TextRenderer(width int) Renderer {
+	return &PlainText{
+		width:          width,
+		plainTextState: &plainTextState{},
+	}
+}
+
+// NewDocument returns a renderer with the same configuration, to render a
+// single document with.
+func (options *PlainText) NewDocument() Renderer {
+	r := *options
+	r.Reset()
+	return &r
+}
+
+func (options *PlainText) base() Renderer {
+	return options
+}
+
+// Reset forgets about the document rendered so far.
+func (options *PlainText) Reset() {
+	options.plainTextState = &plainTextState{}
+}
+
+func (options *PlainText) GetFlags() int {
+	return 0
+}
+
+// wrapMark is put in front of the text of a paragraph, as long as it is not
+// known what it will be nested in. Once the top-level block around it is
+// done, the text is wrapped to fit behind whatever went in front of the mark.
+const wrapMark = '\x00'
+
+// textReplacer turns soft line breaks into spaces, and keeps the wrapMark out
+// of the text.
+var textReplacer = strings.NewReplacer("\n", " ", string(wrapMark), "\uFFFD")
+
+// startBlock separates a block from what comes before it: a blank line after
+// another block, or a line break after the text of a list item.
+func (options *PlainText) startBlock(out Writer) {
+	rollback(out, len(bytes.TrimRight(written(out), " ")))
+	data := written(out)
+	switch n := len(data); {
+	case n == 0:
+	case data[n-1] != '\n':
+		out.WriteByte('\n')
+	case n < 2 || data[n-2] != '\n':
+		out.WriteByte('\n')
+	}
+}
+
+// startText starts a paragraph of text.
+func (options *PlainText) startText(out Writer) {
+	if options.width > 0 {
+		out.WriteByte(wrapMark)
+	}
+}
+
+// wrap wraps the paragraphs written to 'out' from 'start' on, if 'out' is
+// where top-level blocks go. Lines in blocks nested deeper are left for the
+// top-level block to wrap, when everything in front of them is known.
+func (options *PlainText) wrap(out Writer, start int) {
+	if options.width <= 0 || out != options.top {
+		return
+	}
+	text := append([]byte(nil), written(out)[start:]...)
+	rollback(out, start)
+	for len(text) > 0 {
+		end := bytes.IndexByte(text, '\n') + 1
+		if end == 0 {
+			end = len(text)
+		}
+		line := text[:end]
+		text = text[end:]
+
+		mark := bytes.IndexByte(line, wrapMark)
+		if mark < 0 {
+			out.Write(line)
+			continue
+		}
+		prefix := line[:mark]
+		words := strings.Fields(string(line[mark+1:]))
+		if len(words) == 0 {
+			out.Write(bytes.TrimRight(prefix, " "))
+		}
+
+		// the lines after the first line up with it, without the bullets
+		width := options.width - utf8.RuneCount(prefix)
+		column := 0
+		for i, word := range words {
+			if i > 0 && column+1+utf8.RuneCountInString(word) > width {
+				out.WriteByte('\n')
+				prefix = continuation(prefix)
+				column = 0
+			}
+			if column == 0 {
+				out.Write(prefix)
+			} else {
+				out.WriteByte(' ')
+				column++
+			}
+			out.WriteString(word)
+			column += utf8.RuneCountInString(word)
+		}
+		if line[len(line)-1] == '\n' {
+			out.WriteByte('\n')
+		}
+	}
+}
+
+// continuation turns the prefix of the first line of a paragraph into the
+// prefix of the lines after it: quote markers stay, anything else turns into
+// spaces.
+func continuation(prefix []byte) []byte {
+	var rest []byte
+	for _, r := range string(prefix) {
+		if r != '>' {
+			r = ' '
+		}
+		rest = append(rest, string(r)...)
+	}
+	return rest
+}
+
+func (options *PlainText) BlockCode(out Writer, text []byte, lang string) {
+	options.startBlock(out)
+	out.Write(bytes.Replace(bytes.TrimRight(text, "\n"), []byte{wrapMark}, []byte("\uFFFD"), -1))
+	out.WriteByte('\n')
+}
+
+func (options *PlainText) MathBlock(out Writer, text []byte) {
+	options.BlockCode(out, text, "")
+}
+
+func (options *PlainText) TitleBlock(out Writer, text []byte) {
+	options.startBlock(out)
+	text = bytes.TrimPrefix(text, []byte("% "))
+	text = bytes.Replace(text, []byte("\n% "), []byte("\n"), -1)
+	out.Write(bytes.TrimRight(text, "\n"))
+	out.WriteByte('\n')
+}
+
+func (options *PlainText) BlockQuote(out Writer, text []byte) {
+	options.startBlock(out)
+	start := len(written(out))
+	text = bytes.TrimRight(text, "\n")
+	for len(text) > 0 {
+		end := bytes.IndexByte(text, '\n') + 1
+		if end == 0 {
+			end = len(text)
+		}
+		if text[0] != '\n' {
+			out.WriteString("> ")
+		} else {
+			out.WriteByte('>')
+		}
+		out.Write(text[:end])
+		text = text[end:]
+	}
+	out.WriteByte('\n')
+	options.wrap(out, start)
+}
+
+// BlockHtml drops blocks of HTML, which are not for reading.
+func (options *PlainText) BlockHtml(out Writer, text []byte) {
+}
+
+func (options *PlainText) Header(out Writer, text func() bool, level int, id string) {
+	marker := len(written(out))
+	options.startBlock(out)
+	start := len(written(out))
+	options.startText(out)
+	if !text() {
+		rollback(out, marker)
+		return
+	}
+	rollback(out, len(bytes.TrimRight(written(out), " ")))
+	out.WriteByte('\n')
+	options.wrap(out, start)
+}
+
+func (options *PlainText) HRule(out Writer) {
+	options.startBlock(out)
+	out.WriteString("---\n")
+}
+
+func (options *PlainText) List(out Writer, text func() bool, flags int) {
+	marker := len(written(out))
+	options.startBlock(out)
+	options.lists = append(options.lists, formatterList{})
+	if !text() {
+		rollback(out, marker)
+	}
+	options.lists = options.lists[:len(options.lists)-1]
+}
+
+func (options *PlainText) ListItem(out Writer, text []byte, flags int) {
+	list := &options.lists[len(options.lists)-1]
+	list.items++
+
+	// items made of blocks are set apart by blank lines
+	loose := flags&LIST_ITEM_CONTAINS_BLOCK != 0
+	if list.items > 1 && (loose || list.loose) {
+		out.WriteByte('\n')
+	}
+	list.loose = loose
+
+	bullet := "- "
+	if flags&LIST_TYPE_ORDERED != 0 {
+		bullet = strconv.Itoa(list.items) + ". "
+	}
+	options.item(out, text, flags, bullet+taskBox(flags))
+}
+
+func (options *PlainText) DefinitionList(out Writer, text func() bool, flags int) {
+	options.List(out, text, flags)
+}
+
+func (options *PlainText) DefinitionTerm(out Writer, text []byte, flags int) {
+	list := &options.lists[len(options.lists)-1]
+	list.items++
+
+	// the entries of the list are set apart by blank lines
+	if list.items > 1 && !list.term {
+		out.WriteByte('\n')
+	}
+	list.term = true
+	options.item(out, text, flags, "")
+}
+
+func (options *PlainText) DefinitionData(out Writer, text []byte, flags int) {
+	list := &options.lists[len(options.lists)-1]
+	list.items++
+
+	// definitions made of blocks are set apart by blank lines, too
+	if !list.term && flags&LIST_ITEM_CONTAINS_BLOCK != 0 {
+		out.WriteByte('\n')
+	}
+	list.term = false
+	options.item(out, text, flags, "    ")
+}
+
+// item writes the text of a list item or a footnote behind 'marker'.
+func (options *PlainText) item(out Writer, text []byte, flags int, marker string) {
+	start := len(written(out))
+	text = bytes.TrimRight(text, "\n ")
+
+	// the text of a tight item is not in a paragraph of its own
+	if options.width > 0 && len(text) > 0 && flags&LIST_ITEM_CONTAINS_BLOCK == 0 {
+		end := bytes.IndexByte(text, '\n')
+		if end < 0 {
+			end = len(text)
+		}
+		if bytes.IndexByte(text[:end], wrapMark) < 0 {
+			text = append([]byte{wrapMark}, text...)
+		}
+	}
+	prefixLines(out, text, marker, strings.Repeat(" ", len(marker)))
+	out.WriteByte('\n')
+	options.wrap(out, start)
+}
+
+func (options *PlainText) Paragraph(out Writer, text func() bool) {
+	marker := len(written(out))
+	options.startBlock(out)
+	start := len(written(out))
+	options.startText(out)
+	if !text() {
+		rollback(out, marker)
+		return
+	}
+	rollback(out, len(bytes.TrimRight(written(out), " ")))
+	out.WriteByte('\n')
+	options.wrap(out, start)
+}
+
+func (options *PlainText) Table(out Writer, header []byte, body []byte, columnData []int) {
+	rows, headers := options.rows, options.headers
+	options.rows, options.headers = nil, 0
+	options.startBlock(out)
+
+	widths := make([]int, len(columnData))
+	for _, row := range rows {
+		for i, cell := range row {
+			if i < len(widths) && utf8.RuneCount(cell) > widths[i] {
+				widths[i] = utf8.RuneCount(cell)
+			}
+		}
+	}
+
+	for i, row := range rows {
+		if i == headers && headers > 0 {
+			options.tableRule(out, widths)
+		}
+		start := len(written(out))
+		for j, cell := range row {
+			if j >= len(widths) {
+				break
+			}
+			if j > 0 {
+				out.WriteString("  ")
+			}
+			pad := widths[j] - utf8.RuneCount(cell)
+			left := 0
+			switch columnData[j] {
+			case TABLE_ALIGNMENT_RIGHT:
+				left = pad
+			case TABLE_ALIGNMENT_CENTER:
+				left = pad / 2
+			}
+			out.Write(bytes.Repeat([]byte{' '}, left))
+			out.Write(cell)
+			out.Write(bytes.Repeat([]byte{' '}, pad-left))
+		}
+		rollback(out, start+len(bytes.TrimRight(written(out)[start:], " ")))
+		out.WriteByte('\n')
+	}
+}
+
+func (options *PlainText) tableRule(out Writer, widths []int) {
+	for i, width := range widths {
+		if i > 0 {
+			out.WriteString("  ")
+		}
+		out.Write(bytes.Repeat([]byte{'-'}, width))
+	}
+	out.WriteByte('\n')
+}
+
+func (options *PlainText) TableRow(out Writer, text []byte) {
+	options.rows = append(options.rows, options.cells)
+	options.cells = nil
+}
+
+func (options *PlainText) TableHeaderCell(out Writer, text []byte, align int) {
+	if len(options.cells) == 0 {
+		options.headers++
+	}
+	options.TableCell(out, text, align)
+}
+
+func (options *PlainText) TableCell(out Writer, text []byte, align int) {
+	cell := bytes.Replace(text, []byte{wrapMark}, nil, -1)
+	cell = bytes.Replace(cell, []byte("\n"), []byte(" "), -1)
+	options.cells = append(options.cells, bytes.TrimSpace(cell))
+}
+
+func (options *PlainText) Footnotes(out Writer, text func() bool) {
+	marker := len(written(out))
+	options.startBlock(out)
+	out.WriteString("---\n\n")
+	if !text() {
+		rollback(out, marker)
+	}
+}
+
+func (options *PlainText) FootnoteItem(out Writer, name, text []byte, flags int) {
+	options.notes++
+	if options.notes > 1 && flags&LIST_ITEM_CONTAINS_BLOCK != 0 {
+		options.startBlock(out)
+	}
+	options.item(out, text, flags, "["+strconv.Itoa(options.notes)+"] ")
+}
+
+func (options *PlainText) AutoLink(out Writer, link []byte, kind int) {
+	out.WriteString(textReplacer.Replace(string(link)))
+}
+
+func (options *PlainText) CodeSpan(out Writer, text []byte) {
+	out.WriteString(textReplacer.Replace(string(text)))
+}
+
+func (options *PlainText) MathSpan(out Writer, text []byte, display bool) {
+	out.WriteString(textReplacer.Replace(string(text)))
+}
+
+func (options *PlainText) DoubleEmphasis(out Writer, text []byte) {
+	out.Write(text)
+}
+
+func (options *PlainText) Emphasis(out Writer, text []byte) {
+	out.Write(text)
+}
+
+func (options *PlainText) TripleEmphasis(out Writer, text []byte) {
+	out.Write(text)
+}
+
+func (options *PlainText) StrikeThrough(out Writer, text []byte) {
+	out.Write(text)
+}
+
+// Image writes the alternate text of an image.
+func (options *PlainText) Image(out Writer, link []byte, title []byte, alt []byte) {
+	out.WriteString(textReplacer.Replace(string(alt)))
+}
+
+func (options *PlainText) LineBreak(out Writer) {
+	rollback(out, len(bytes.TrimRight(written(out), " ")))
+	out.WriteByte('\n')
+	options.startText(out)
+}
+
+// Link writes the text of a link followed by where it goes, unless that is
+// the text already.
+func (options *PlainText) Link(out Writer, link []byte, title []byte, content []byte) {
+	out.Write(content)
+	if len(link) == 0 || bytes.Equal(link, content) ||
+		bytes.HasPrefix(link, []byte("mailto:")) && bytes.Equal(link[len("mailto:"):], content) ||
+		bytes.HasPrefix(link, []byte("http://")) && bytes.Equal(link[len("http://"):], content) {
+		return
+	}
+	if len(content) > 0 {
+		out.WriteByte(' ')
+	}
+	out.WriteByte('(')
+	out.WriteString(textReplacer.Replace(string(link)))
+	out.WriteByte(')')
+}
+
+// RawHtmlTag drops inline HTML tags, but not the text between them.
+func (options *PlainText) RawHtmlTag(out Writer, text []byte) {
+}
+
+func (options *PlainText) FootnoteRef(out Writer, ref []byte, id int) {
+	out.WriteByte('[')
+	out.WriteString(strconv.Itoa(id))
+	out.WriteByte(']')
+}
+
+func (options *PlainText) Abbreviation(out Writer, abbr []byte, title []byte) {
+	options.NormalText(out, abbr)
+}
+
+// Entity writes the character an entity stands for.
+func (options *PlainText) Entity(out Writer, entity []byte) {
+	out.WriteString(textReplacer.Replace(html.UnescapeString(string(entity))))
+}
+
+func (options *PlainText) NormalText(out Writer, text []byte) {
+	out.WriteString(textReplacer.Replace(string(text)))
+}
+
+func (options *PlainText) DocumentHeader(out Writer) {
+	options.top = out
+}
+
+func (options *PlainText) DocumentFooter(out Writer) {
+}
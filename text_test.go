@@ -0,0 +1,146 @@
+//
+// Blackfriday Markdown Processor
+// Available at http://github.com/russross/blackfriday
+//
+// Copyright © 2011 Russ Ross <russ@russross.com>.
+// Distributed under the Simplified BSD License.
+// See README.md for details.
+//
+
+//
+// Unit tests for plain text output
+//
+
+package blackfriday
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func doTestsText(t *testing.T, tests []string, width int) {
+	for i := 0; i+1 < len(tests); i += 2 {
+		input, expected := tests[i], tests[i+1]
+		output, err := MarkdownE([]byte(input), WithRenderer(TextRenderer(width)),
+			WithExtensions(commonExtensions|EXTENSION_FOOTNOTES))
+		if err != nil {
+			t.Errorf("\nInput   [%#v]\nError   [%v]", input, err)
+			continue
+		}
+		if actual := string(output); actual != expected {
+			t.Errorf("\nInput   [%#v]\nExpected[%#v]\nActual  [%#v]",
+				input, expected, actual)
+		}
+	}
+}
+
+func TestTextRenderer(t *testing.T) {
+	var tests = []string{
+		"# Title #\n\nSome *emphasis*, __strong__ and ~~struck~~ text\non two lines.\n",
+		"Title\n\nSome emphasis, strong and struck text on two lines.\n",
+
+		"A [link](/url \"Title\"), [http://x.org/](http://x.org/), <http://y.org/> and ![an image](/img.png).\n",
+		"A link (/url), http://x.org/, http://y.org/ and an image.\n",
+
+		"&amp; &lt;b&gt; &copy; &#8212; &#x41; `&amp;`\n",
+		"& <b> © — A &amp;\n",
+
+		"Hard  \nbreak <b>tag</b>\n\n<div>\nblock\n</div>\n",
+		"Hard\nbreak tag\n",
+
+		"* one\n* two\n    1. three\n    2. four\n",
+		"- one\n- two\n  1. three\n  2. four\n",
+
+		"1. one\n\n2. two\n",
+		"1. one\n\n2. two\n",
+
+		"> quote\n>\n> > nested\n",
+		"> quote\n>\n> > nested\n",
+
+		"    code  with\n      spaces\n\n---\n",
+		"code  with\n  spaces\n\n---\n",
+
+		"Name|Value\n:---|---:\nalpha|1\nb|12345\n",
+		"Name   Value\n-----  -----\nalpha      1\nb      12345\n",
+
+		"Note[^a] and note[^b].\n\n[^a]: The first.\n[^b]: The second.\n",
+		"Note[1] and note[2].\n\n---\n\n[1] The first.\n[2] The second.\n",
+	}
+	doTestsText(t, tests, 0)
+}
+
+func TestTextRendererTaskList(t *testing.T) {
+	var tests = []string{
+		"* [ ] todo\n* [x] done\n",
+		"- [ ] todo\n- [x] done\n",
+	}
+	for i := 0; i+1 < len(tests); i += 2 {
+		output, err := MarkdownE([]byte(tests[i]), WithRenderer(TextRenderer(0)),
+			WithExtensions(EXTENSION_TASK_LISTS))
+		if err != nil || string(output) != tests[i+1] {
+			t.Errorf("\nInput   [%#v]\nExpected[%#v]\nActual  [%#v] %v",
+				tests[i], tests[i+1], string(output), err)
+		}
+	}
+}
+
+func TestTextRendererDefinitionList(t *testing.T) {
+	var tests = []string{
+		"Apple\n: Pomaceous fruit.\n\nOrange\n\n: Citrus.\n\n    More.\n",
+		"Apple\n    Pomaceous fruit.\n\nOrange\n    Citrus.\n\n    More.\n",
+	}
+	for i := 0; i+1 < len(tests); i += 2 {
+		output, err := MarkdownE([]byte(tests[i]), WithRenderer(TextRenderer(0)),
+			WithExtensions(EXTENSION_DEFINITION_LISTS))
+		if err != nil || string(output) != tests[i+1] {
+			t.Errorf("\nInput   [%#v]\nExpected[%#v]\nActual  [%#v] %v",
+				tests[i], tests[i+1], string(output), err)
+		}
+	}
+}
+
+func TestTextRendererWrap(t *testing.T) {
+	var tests = []string{
+		"A paragraph of text that is long enough\nto be wrapped, twice.\n",
+		"A paragraph of text\nthat is long enough to\nbe wrapped, twice.\n",
+
+		"Hard  \nbreak in a long enough paragraph\n",
+		"Hard\nbreak in a long enough\nparagraph\n",
+
+		"* an item that is long enough to wrap\n    * and a nested one that is long enough\n",
+		"- an item that is long\n  enough to wrap\n  - and a nested one\n    that is long\n    enough\n",
+
+		"> a quote that is long enough to wrap\n",
+		"> a quote that is long\n> enough to wrap\n",
+
+		"    code that is long enough, but not wrapped\n",
+		"code that is long enough, but not wrapped\n",
+
+		"Note[^1].\n\n[^1]: A note that is long enough to wrap.\n",
+		"Note[1].\n\n---\n\n[1] A note that is\n    long enough to\n    wrap.\n",
+	}
+	doTestsText(t, tests, 22)
+}
+
+func TestTextRendererReference(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.text"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, width := range []int{0, 30} {
+		for _, filename := range files {
+			input, err := ioutil.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			output := Markdown(input, WithRenderer(TextRenderer(width)),
+				WithExtensions(commonExtensions|EXTENSION_FOOTNOTES))
+			if bytes.IndexByte(output, wrapMark) >= 0 {
+				t.Errorf("%s: wrap marks left in the output with width %d:\n%s",
+					filename, width, output)
+			}
+		}
+	}
+}